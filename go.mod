@@ -5,3 +5,5 @@ go 1.24.4
 require github.com/gorilla/mux v1.8.1
 
 require dario.cat/mergo v1.0.2
+
+require golang.org/x/net v0.50.0
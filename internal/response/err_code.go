@@ -0,0 +1,45 @@
+package resp
+
+// error codes carried by ErrorMsg.ErrorCodeEnum
+// 0 means no specific code was assigned
+const (
+	CodeNone = 0
+
+	// path resolving
+	CodeInvalidPath   = 1001
+	CodePathTraversal = 1002
+	CodeSymlinkEscape = 1003
+	CodeRootForbidden = 1004
+	CodePathReserved  = 1005
+	CodeNotFound      = 1006
+
+	// upload
+	CodeFileExists           = 2001
+	CodeUploadTooLarge       = 2002
+	CodeUploadNotFound       = 2003
+	CodeUploadOffsetMismatch = 2004
+	CodeUploadInvalid        = 2005
+	CodeDigestMismatch       = 2006
+
+	// archive extraction
+	CodeArchiveInvalid  = 3001
+	CodeArchiveUnsafe   = 3002
+	CodeArchiveTooLarge = 3003
+
+	// move and copy
+	CodeMoveSamePath   = 4001
+	CodeMoveIntoItself = 4002
+
+	// trash
+	CodeTrashNotFound = 5001
+
+	// versions
+	CodeVersionNotFound = 6001
+
+	// quota
+	CodeQuotaExceeded = 7001
+
+	// thumbnails
+	CodeImageInvalid  = 8001
+	CodeImageTooLarge = 8002
+)
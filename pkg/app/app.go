@@ -63,6 +63,14 @@ func BoolPointer(v bool) *bool {
 	return &v
 }
 
+func IntPointer(v int) *int {
+	return &v
+}
+
+func Int64Pointer(v int64) *int64 {
+	return &v
+}
+
 var DefaultConfig = server.ServerConfig{
 	Addr:    "127.0.0.1:8080",
 	WorkDir: "",
@@ -71,6 +79,14 @@ var DefaultConfig = server.ServerConfig{
 	ShutdownTimeout: 15000,
 	ReadTimeout:     time.Duration(15 * time.Second),
 	WriteTimeout:    0,
+
+	FileNamingStrategy: string(server.NamingOriginal),
+	ExtractMaxRatio:    100,
+	ExtractMaxFiles:    10000,
+	TusExpiration:      IntPointer(24 * 60 * 60),
+	TrashRetention:     IntPointer(30 * 24 * 60 * 60),
+	VersionMaxCount:    IntPointer(10),
+	CompressMinSize:    Int64Pointer(1024),
 }
 
 // args config
@@ -130,7 +146,8 @@ func (a *App) ParseConfig(args []string) (*server.ServerConfig, error) {
 			return nil, fmt.Errorf("failed decode config file: %w", err)
 		}
 
-		if err := mergo.Merge(&config, fileConfig, mergo.WithOverride); err != nil {
+		// pointer fields set to zero in the file still override the defaults
+		if err := mergo.Merge(&config, fileConfig, mergo.WithOverride, mergo.WithoutDereference); err != nil {
 			return nil, fmt.Errorf("failed merge default and fileconfig: %w", err)
 		}
 		logger.Info(fmt.Sprintf("default config and fileconfig merge result: %+v\n", config))
@@ -165,5 +182,9 @@ func (a *App) ParseConfig(args []string) (*server.ServerConfig, error) {
 	}
 	logger.Info(fmt.Sprintf("final config: %+v", config))
 
+	if _, err := server.ParseNamingStrategy(config.FileNamingStrategy); err != nil {
+		return nil, err
+	}
+
 	return &config, nil
 }
@@ -1,17 +1,23 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	resp "httpserver/internal/response"
 	logger "httpserver/pkg/log"
 	"io"
+	"mime/multipart"
 	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -31,21 +37,118 @@ type ServerConfig struct {
 	ReadTimeout time.Duration `json:"read_timeout"`
 	// write timeout
 	WriteTimeout time.Duration `json:"write_timeout"`
+	// upload naming strategy: original, overwrite, suffix, timestamp, uuid or hash
+	FileNamingStrategy string `json:"file_naming_strategy"`
+	// archive extraction limits: total extracted bytes per archive byte, also
+	// bounding the total to MaxUploadSize times this ratio, and max entries
+	ExtractMaxRatio int `json:"extract_max_ratio"`
+	ExtractMaxFiles int `json:"extract_max_files"`
+	// resumable (tus) upload expiration seconds, zero or unset means never
+	// expire; a pointer so an explicit zero in the config file isn't taken
+	// for a missing value
+	TusExpiration *int `json:"tus_expiration"`
+	// seconds deleted files are kept in the trash, zero or unset means until
+	// purged; a pointer like TusExpiration
+	TrashRetention *int `json:"trash_retention"`
+	// previous contents kept when a file is overwritten: the last
+	// VersionMaxCount ones, dropping those older than VersionMaxAge seconds,
+	// zero or unset disables a limit, both zero disable versioning;
+	// VersionMaxCount is a pointer like TusExpiration
+	VersionMaxCount *int `json:"version_max_count"`
+	VersionMaxAge   int  `json:"version_max_age"`
+	// storage quota of the whole work dir, zero means no limit
+	QuotaMaxBytes int64 `json:"quota_max_bytes"`
+	QuotaMaxFiles int64 `json:"quota_max_files"`
+	// storage quotas of directories, keyed by path relative to the work dir
+	DirQuotas map[string]DirQuota `json:"dir_quotas"`
+	// images decoded at once for thumbnails, zero means one per CPU
+	ThumbnailWorkers int `json:"thumbnail_workers"`
+	// bytes the images decoded for thumbnails may hold together, larger
+	// images are refused, zero means 512 MiB
+	ThumbnailMemory int64 `json:"thumbnail_memory"`
+	// URL prefix of the WebDAV endpoint, empty disables it
+	WebDAVPrefix string `json:"webdav_prefix"`
+	// S3-compatible API address, empty disables it
+	S3Addr string `json:"s3_addr"`
+	// S3 secret keys by access key id
+	S3Keys map[string]string `json:"s3_keys"`
+	// responses smaller than this many bytes are sent uncompressed, zero or
+	// unset compresses all, a negative value disables compression; a pointer
+	// like TusExpiration
+	CompressMinSize *int64 `json:"compress_min_size"`
 }
 
 type Server struct {
 	ServerConfig
-	// fs afero.Fs
+	fs       Storage
+	paths    *PathResolver
+	tus      *tusStore
+	trash    *trashStore
+	versions *versionStore
+	quota    *quotaTracker
+	// S3 multipart uploads
+	s3Uploads *s3UploadStore
+	// md5 etags of S3 objects
+	s3ETags *s3ETagStore
+	thumbs  *thumbnailer
 }
 
+// NewServer serves config.WorkDir from the local disk
 func NewServer(config ServerConfig) *Server {
-	return &Server{ServerConfig: config}
+	return NewServerWithStorage(config, NewOSStorage(config.WorkDir))
+}
+
+// NewServerWithStorage serves fs, config.WorkDir is not used
+func NewServerWithStorage(config ServerConfig, fs Storage) *Server {
+	paths := NewPathResolver(fs)
+	quota := newQuotaTracker(fs, paths, DirQuota{MaxBytes: config.QuotaMaxBytes, MaxFiles: config.QuotaMaxFiles}, config.DirQuotas)
+	return &Server{
+		ServerConfig: config,
+		fs:           fs,
+		paths:        paths,
+		tus:          newTusStore(fs, paths, time.Duration(intValue(config.TusExpiration))*time.Second),
+		trash:        newTrashStore(fs, paths, time.Duration(intValue(config.TrashRetention))*time.Second, quota),
+		versions:     newVersionStore(fs, paths, intValue(config.VersionMaxCount), time.Duration(config.VersionMaxAge)*time.Second, quota),
+		quota:        quota,
+		s3Uploads:    newS3UploadStore(fs, paths),
+		s3ETags:      newS3ETagStore(fs, paths),
+		thumbs:       newThumbnailer(config.ThumbnailWorkers, config.ThumbnailMemory),
+	}
+}
+
+// intValue returns the value of an optional setting, zero when unset
+func intValue(p *int) int {
+	if p == nil {
+		return 0
+	}
+	return *p
+}
+
+// int64Value is intValue for int64 settings
+func int64Value(p *int64) int64 {
+	if p == nil {
+		return 0
+	}
+	return *p
 }
 
 func errorResponse(status int, message error) resp.Response {
 	return resp.NewErrorMsgBuilder().WithStatus(status).WithMessage(message.Error()).Build()
 }
 
+func errorCodeResponse(status int, code int, message error) resp.Response {
+	return resp.NewErrorMsgBuilder().WithStatus(status).WithCode(code).WithMessage(message.Error()).Build()
+}
+
+// pathErrorResponse converts an error returned by PathResolver to a response
+func pathErrorResponse(err error) resp.Response {
+	var pathErr *PathError
+	if errors.As(err, &pathErr) {
+		return errorCodeResponse(pathErr.Status(), pathErr.Code, pathErr)
+	}
+	return errorResponse(http.StatusInternalServerError, errors.New("failed to resolve path"))
+}
+
 func successResponse(status int, message string, data any) resp.Response {
 	if status < 200 || status >= 300 {
 		logger.Warn(fmt.Sprintf("success response with non-2xx status: %d", status))
@@ -53,10 +156,15 @@ func successResponse(status int, message string, data any) resp.Response {
 	return resp.NewSuccessMsgBuilder().WithStatus(status).WithMessage(message).WithData(data).Build()
 }
 
+// handle writes the response returned by f as json.
+// f returns nil when it has already written the response itself, e.g. a file body.
 func (s *Server) handle(f func(http.ResponseWriter, *http.Request) resp.Response) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		result := f(w, r)
+		if result == nil {
+			return
+		}
 		var respBody []byte
 		logger.Info(result)
 		// to json
@@ -67,6 +175,7 @@ func (s *Server) handle(f func(http.ResponseWriter, *http.Request) resp.Response
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(respBody)))
 
 		w.WriteHeader(result.GetStatus())
 
@@ -76,61 +185,326 @@ func (s *Server) handle(f func(http.ResponseWriter, *http.Request) resp.Response
 	}
 }
 
+// UploadResult describes the outcome of one stored file: an upload, an
+// extracted archive entry or a copied file
+type UploadResult struct {
+	// multipart form field the file came from
+	Field string `json:"field,omitempty"`
+	// name sent by the client, entry name or source path
+	Filename string `json:"filename"`
+	// final stored name, may differ from the uploaded name
+	Name string `json:"name,omitempty"`
+	// path relative to workDir
+	Path   string `json:"path,omitempty"`
+	Size   int64  `json:"size"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+	Code   int    `json:"error_code,omitempty"`
+	// hex digests computed while storing, keyed by algorithm (sha-256, sha-512)
+	Digests map[string]string `json:"digests,omitempty"`
+	// entries of an archive uploaded with extract=true
+	Extracted []UploadResult `json:"extracted,omitempty"`
+}
+
+// uploadOptions are the per request upload settings
+type uploadOptions struct {
+	naming NamingStrategy
+	// unpack archives into distPath instead of storing them
+	extract bool
+}
+
+// maxUploadMemory is the part of a multipart body kept in memory, the rest is spooled to temp files
+const maxUploadMemory = 32 << 20
+
+// multipartOverhead is an allowance for boundaries, part headers and form
+// fields when a body size is compared with the room left for file content
+const multipartOverhead = 4 << 10
+
+// every file part of the multipart body is stored, whatever its field name.
+// a single file answers like any other handler; several files answer 200 when
+// all succeeded, otherwise 207 with the per-file status in the result list.
+// integrity is checked against RFC 9530 digests when present: request level
+// Content-Digest and Repr-Digest cover the whole body, the same fields on a
+// multipart part or a sha256 form field cover one file. Mismatching files are
+// discarded.
 // query params:
 // - overwrite: if true, allows overwriting the existing file
+// - naming: file naming strategy, overrides the server config
 // -distPath: save file to distPath, default to workDir
+// - sha256: hex sha256 of the file, repeated in part order for several files
+// - extract: if true, zip/tar/tar.gz files are unpacked into distPath
 func (s *Server) uploadFileHandler(w http.ResponseWriter, r *http.Request) resp.Response {
-	distPath := r.FormValue("distPath")
-	file, info, err := r.FormFile("file")
+	bodyDigests, err := headerDigests(r.Header)
 	if err != nil {
-		logger.Error(fmt.Sprintf("failed to get file from request: %v\n", err))
+		logger.Error(fmt.Sprintf("invalid digest header: %v", err))
+		return errorCodeResponse(http.StatusBadRequest, resp.CodeUploadInvalid, err)
+	}
+	var bodyDigester *digester
+	if len(bodyDigests) > 0 {
+		bodyDigester = newDigester(bodyDigests)
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(r.Body, bodyDigester), r.Body}
+	}
+
+	// reject a body that can't fit before reading it, distPath may only be
+	// known once the form is parsed, the files are checked again while stored
+	if r.ContentLength > multipartOverhead {
+		quotaDir, err := s.paths.Resolve(r.URL.Query().Get("distPath"))
+		if err != nil {
+			quotaDir, _ = s.paths.Root()
+		}
+		res, err := s.quota.reserve(quotaDir, quotaUsage{Bytes: r.ContentLength - multipartOverhead}, "")
+		if err != nil {
+			logger.Error(fmt.Sprintf("upload rejected: %v", err))
+			return quotaErrorResponse(err)
+		}
+		res.release()
+	}
+
+	if err := r.ParseMultipartForm(maxUploadMemory); err != nil {
+		logger.Error(fmt.Sprintf("failed to parse multipart form: %v\n", err))
 		return errorResponse(http.StatusBadRequest, errors.New("failed to get file from request"))
 	}
-	defer file.Close()
+	defer r.MultipartForm.RemoveAll()
+
+	if bodyDigester != nil {
+		// the multipart reader stops at the closing boundary, hash the epilogue too
+		io.Copy(io.Discard, r.Body)
+		if err := bodyDigester.verify(bodyDigests); err != nil {
+			logger.Error(fmt.Sprintf("request body %v", err))
+			return errorCodeResponse(http.StatusBadRequest, resp.CodeDigestMismatch, err)
+		}
+	}
 
-	if distPath == "" {
-		distPath = filepath.Join(s.WorkDir, info.Filename)
-	} else {
-		distPath = strings.TrimSpace(distPath)
-		distPath = strings.TrimLeft(distPath, "/\\")
-		distPath = filepath.Join(s.WorkDir, distPath, info.Filename)
+	fields := make([]string, 0, len(r.MultipartForm.File))
+	for field := range r.MultipartForm.File {
+		fields = append(fields, field)
 	}
+	sort.Strings(fields)
 
-	if _, err := os.Stat(distPath); err == nil {
-		logger.Error("file already exist")
-		return errorResponse(http.StatusBadRequest, errors.New("file already exist"))
+	type part struct {
+		field  string
+		header *multipart.FileHeader
+	}
+	var parts []part
+	for _, field := range fields {
+		for _, header := range r.MultipartForm.File[field] {
+			parts = append(parts, part{field: field, header: header})
+		}
+	}
+	if len(parts) == 0 {
+		logger.Error("no file in request")
+		return errorResponse(http.StatusBadRequest, errors.New("failed to get file from request"))
+	}
+
+	strategy, err := s.namingStrategy(r)
+	if err != nil {
+		logger.Error(fmt.Sprintf("invalid naming strategy: %v", err))
+		return errorCodeResponse(http.StatusBadRequest, resp.CodeUploadInvalid, err)
+	}
+	opts := uploadOptions{naming: strategy}
+	if extract := r.FormValue("extract"); extract != "" {
+		if opts.extract, err = strconv.ParseBool(extract); err != nil {
+			logger.Error(fmt.Sprintf("invalid extract: %q", extract))
+			return errorCodeResponse(http.StatusBadRequest, resp.CodeUploadInvalid, fmt.Errorf("invalid extract: %q", extract))
+		}
 	}
 
-	if _, err := os.Stat(filepath.Dir(distPath)); err != nil {
-		if err = os.MkdirAll(filepath.Dir(distPath), 0755); err != nil {
+	checksums := r.MultipartForm.Value["sha256"]
+	if len(checksums) > 0 && len(checksums) != len(parts) {
+		logger.Error(fmt.Sprintf("got %d sha256 fields for %d files", len(checksums), len(parts)))
+		return errorCodeResponse(http.StatusBadRequest, resp.CodeUploadInvalid, errors.New("sha256 fields must match the files one to one"))
+	}
+
+	distDir, err := s.paths.Resolve(r.FormValue("distPath"))
+	if err != nil {
+		logger.Error(fmt.Sprintf("invalid distPath: %v", err))
+		return pathErrorResponse(err)
+	}
+
+	if _, err := s.fs.Stat(distDir); err != nil {
+		if err = s.fs.MkdirAll(distDir, 0755); err != nil {
 			logger.Error(fmt.Sprintf("failed to make dir: %v", err))
 			return errorResponse(http.StatusInternalServerError, errors.New("failed to make dir"))
 		}
 	}
 
-	distFile, err := os.Create(distPath)
+	results := make([]UploadResult, 0, len(parts))
+	failed, partial := 0, false
+	for i, p := range parts {
+		var checksum string
+		if len(checksums) > 0 {
+			checksum = checksums[i]
+		}
+		result, errResp := s.storeUpload(w, p.header, distDir, opts, checksum)
+		if errResp != nil {
+			if len(parts) == 1 {
+				return errResp
+			}
+			failed++
+			result.Status = errResp.GetStatus()
+			result.Error = errResp.GetMessage()
+			if errMsg, ok := errResp.(resp.ErrorMsg); ok {
+				result.Code = errMsg.ErrorCodeEnum
+			}
+		}
+		result.Field = p.field
+		partial = partial || result.Status == http.StatusMultiStatus
+		results = append(results, result)
+	}
+
+	switch {
+	case failed == 0 && partial:
+		return successResponse(http.StatusMultiStatus, "Some archive entries were not extracted", results)
+	case failed == 0:
+		return successResponse(http.StatusOK, "File uploaded successfully", results)
+	case failed == len(results):
+		return successResponse(http.StatusMultiStatus, "No file uploaded", results)
+	default:
+		return successResponse(http.StatusMultiStatus, fmt.Sprintf("%d of %d files uploaded", len(results)-failed, len(results)), results)
+	}
+}
+
+// storeUpload stores one multipart file in distDir, checksum is an optional hex sha256
+func (s *Server) storeUpload(w http.ResponseWriter, header *multipart.FileHeader, distDir string, opts uploadOptions, checksum string) (UploadResult, resp.Response) {
+	result := UploadResult{Filename: header.Filename}
+
+	want, err := headerDigests(header.Header)
+	if err != nil {
+		logger.Error(fmt.Sprintf("invalid digest header: %v", err))
+		return result, errorCodeResponse(http.StatusBadRequest, resp.CodeUploadInvalid, err)
+	}
+	if checksum != "" {
+		sum, err := hex.DecodeString(strings.TrimSpace(checksum))
+		if err != nil || len(sum) != sha256.Size {
+			logger.Error(fmt.Sprintf("invalid sha256: %q", checksum))
+			return result, errorCodeResponse(http.StatusBadRequest, resp.CodeUploadInvalid, errors.New("invalid sha256"))
+		}
+		if other, ok := want["sha-256"]; ok && !bytes.Equal(other, sum) {
+			logger.Error("conflicting sha256 and digest header")
+			return result, errorCodeResponse(http.StatusBadRequest, resp.CodeUploadInvalid, errors.New("conflicting sha-256 digests"))
+		}
+		want["sha-256"] = sum
+	}
+
+	distPath, err := s.paths.ResolveName(distDir, header.Filename)
+	if err != nil {
+		logger.Error(fmt.Sprintf("invalid file name: %v", err))
+		return result, pathErrorResponse(err)
+	}
+
+	if _, err := s.fs.Stat(distPath); err == nil && opts.naming == NamingOriginal && !opts.extract {
+		logger.Error("file already exist")
+		return result, errorCodeResponse(http.StatusBadRequest, resp.CodeFileExists, ErrFileExists)
+	}
+
+	file, err := header.Open()
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to get file from request: %v\n", err))
+		return result, errorResponse(http.StatusBadRequest, errors.New("failed to get file from request"))
+	}
+	defer file.Close()
+
+	tmpFile, err := s.createStaging()
 	if err != nil {
 		logger.Error(fmt.Sprintf("failed to create dist file: %v", err))
-		return errorResponse(http.StatusInternalServerError, errors.New("failed to create dist file"))
+		return result, errorResponse(http.StatusInternalServerError, errors.New("failed to create dist file"))
+	}
+	defer s.fs.Remove(tmpFile.Name())
+
+	res, err := s.quota.reserve(distPath, quotaUsage{Files: 1}, "")
+	if err != nil {
+		logger.Error(fmt.Sprintf("upload rejected: %v", err))
+		return result, quotaErrorResponse(err)
 	}
-	defer distFile.Close()
+	defer res.release()
 
+	d := newDigester(want)
 	srcFile := http.MaxBytesReader(w, file, s.MaxUploadSize)
-	if _, err := io.Copy(distFile, srcFile); err != nil {
+	size, err := io.Copy(io.MultiWriter(&quotaWriter{w: tmpFile, res: res}, d), srcFile)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			logger.Error(fmt.Sprintf("file too large: %v", err))
+			return result, errorCodeResponse(http.StatusRequestEntityTooLarge, resp.CodeUploadTooLarge, errors.New("file too large"))
+		}
+		if errors.Is(err, ErrQuotaExceeded) {
+			logger.Error(fmt.Sprintf("upload rejected: %v", err))
+			return result, quotaErrorResponse(err)
+		}
 		logger.Error(fmt.Sprintf("failed to upload file: %v", err))
-		return errorResponse(http.StatusInternalServerError, errors.New("failed to upload file"))
+		return result, errorResponse(http.StatusInternalServerError, errors.New("failed to upload file"))
 	}
+	if err := d.verify(want); err != nil {
+		logger.Error(fmt.Sprintf("file %v %v", header.Filename, err))
+		return result, errorCodeResponse(http.StatusBadRequest, resp.CodeDigestMismatch, err)
+	}
+	// the stored files are checked again when placed
+	res.release()
 
-	return successResponse(http.StatusOK, "File uploaded successfully", nil)
+	if opts.extract {
+		extracted, err := s.extractArchive(tmpFile.Name(), distDir, opts.naming)
+		if err != nil {
+			logger.Error(fmt.Sprintf("failed to extract %v: %v", header.Filename, err))
+			return result, archiveErrorResponse(err)
+		}
+		result.Size = size
+		result.Digests = hexDigests(d.Sums())
+		result.Extracted = extracted
+		result.Status = http.StatusOK
+		for _, e := range extracted {
+			if e.Error != "" {
+				result.Status = http.StatusMultiStatus
+			}
+		}
+		return result, nil
+	}
+
+	distPath, err = s.placeFile(tmpFile.Name(), distDir, header.Filename, opts.naming)
+	if err != nil {
+		if errors.Is(err, ErrFileExists) || errors.Is(err, os.ErrExist) {
+			logger.Error("file already exist")
+			return result, errorCodeResponse(http.StatusBadRequest, resp.CodeFileExists, ErrFileExists)
+		}
+		if errors.Is(err, ErrQuotaExceeded) {
+			logger.Error(fmt.Sprintf("upload rejected: %v", err))
+			return result, quotaErrorResponse(err)
+		}
+		logger.Error(fmt.Sprintf("failed to store file: %v", err))
+		return result, errorResponse(http.StatusInternalServerError, errors.New("failed to store file"))
+	}
+
+	syncDir(s.fs, distDir)
+	sums := d.Sums()
+	s.storeDigests(distPath, sums)
+
+	result.Name = filepath.Base(distPath)
+	result.Path = s.paths.Rel(distPath)
+	result.Size = size
+	result.Status = http.StatusOK
+	result.Digests = hexDigests(sums)
+	return result, nil
 }
 
 // query params:
 // - path: the path of the file to download
+// supports HEAD, Range and conditional requests, a file.gz next to the file
+// is sent instead to clients accepting gzip
 func (s *Server) downloadFileHandler(w http.ResponseWriter, r *http.Request) resp.Response {
-	path := r.URL.Query().Get("path")
-	path = strings.TrimPrefix(path, "/")
-	localPath := filepath.Join(s.WorkDir, path)
-	info, err := os.Stat(localPath)
+	localPath, err := s.paths.Resolve(r.URL.Query().Get("path"))
+	if err != nil {
+		logger.Error(fmt.Sprintf("invalid path: %v", err))
+		return pathErrorResponse(err)
+	}
+	info, err := s.fs.Stat(localPath)
 	if err != nil {
 		logger.Error(fmt.Sprintf("file not found: %v", err))
 		return errorResponse(http.StatusNotFound, errors.New("file not found"))
@@ -141,45 +515,70 @@ func (s *Server) downloadFileHandler(w http.ResponseWriter, r *http.Request) res
 		return errorResponse(http.StatusBadRequest, errors.New("cannot download a directory"))
 	}
 
-	file, err := os.Open(localPath)
+	file, info, err := s.openPrecompressed(w, r, localPath, info)
 	if err != nil {
 		logger.Error(fmt.Sprintf("failed to open file: %v", err))
 		return errorResponse(http.StatusInternalServerError, errors.New("failed to open file"))
 	}
 	defer file.Close()
 
-	_, err = io.Copy(w, file)
-	if err != nil {
-		logger.Error(fmt.Sprintf("failed to write file to response: %v", err))
-		return errorResponse(http.StatusInternalServerError, errors.New("failed to write file to response"))
-	}
-
-	return successResponse(http.StatusOK, "File download successfully", nil)
+	s.serveFile(w, r, file, info)
+	return nil
 }
 
+// moves a file or directory to the trash
 // query params:
 // - path: the path of the file to delete
+// - permanent: if true, delete right away instead of moving to the trash
 func (s *Server) deleteFileHandler(w http.ResponseWriter, r *http.Request) resp.Response {
-	path := r.URL.Query().Get("path")
-	path = strings.TrimPrefix(path, "/")
-	localPath := filepath.Join(s.WorkDir, path)
-	info, err := os.Stat(localPath)
+	localPath, err := s.paths.Resolve(r.URL.Query().Get("path"))
+	if err != nil {
+		logger.Error(fmt.Sprintf("invalid path: %v", err))
+		return pathErrorResponse(err)
+	}
+	var permanent bool
+	if v := r.URL.Query().Get("permanent"); v != "" {
+		if permanent, err = strconv.ParseBool(v); err != nil {
+			logger.Error(fmt.Sprintf("invalid permanent: %q", v))
+			return errorResponse(http.StatusBadRequest, fmt.Errorf("invalid permanent: %q", v))
+		}
+	}
+	info, err := s.fs.Stat(localPath)
 	if err != nil {
 		logger.Error(fmt.Sprintf("file not found: %v", err))
 		return errorResponse(http.StatusNotFound, errors.New("file not found"))
 	}
 
+	if s.paths.IsRoot(localPath) {
+		logger.Error("refuse to delete work dir")
+		return errorCodeResponse(http.StatusForbidden, resp.CodeRootForbidden, errors.New("cannot delete work dir"))
+	}
+
+	if !permanent {
+		item, err := s.trash.put(localPath)
+		if err != nil {
+			logger.Error(fmt.Sprintf("failed to move to trash: %v", err))
+			return errorResponse(http.StatusInternalServerError, errors.New("failed to move to trash"))
+		}
+		return successResponse(http.StatusOK, "Moved to trash successfully", item)
+	}
+
+	usage := s.quota.usage(localPath)
 	if info.IsDir() {
-		if err = os.RemoveAll(localPath); err != nil {
+		if err = s.fs.RemoveAll(localPath); err != nil {
 			logger.Error(fmt.Sprintf("failed to delete directory: %v", err))
+			// part of the tree may be gone already
+			s.quota.update(localPath, s.quota.usage(localPath).sub(usage))
 			return errorResponse(http.StatusInternalServerError, errors.New("failed to delete directory"))
 		}
+		s.quota.update(localPath, quotaUsage{}.sub(usage))
 		return successResponse(http.StatusOK, "Directory delete successfully", nil)
 	} else {
-		if err = os.Remove(localPath); err != nil {
+		if err = s.fs.Remove(localPath); err != nil {
 			logger.Error(fmt.Sprintf("failed to delete file: %v", err))
 			return errorResponse(http.StatusInternalServerError, errors.New("failed to delete file"))
 		}
+		s.quota.update(localPath, quotaUsage{}.sub(usage))
 		return successResponse(http.StatusOK, "File delete successfully", nil)
 	}
 }
@@ -210,23 +609,93 @@ func methodNotAllowedHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// Start starts the HTTP server and listens for shutdown signals
-// stop: channel to receive termination signals for graceful shutdown
-// ready: channel to signal when server is ready to accept connections
-func (s *Server) Start(stop chan os.Signal, ready chan struct{}) error {
+// handler routes the requests of the main server
+func (s *Server) handler() http.Handler {
 	r := mux.NewRouter()
 	r.HandleFunc("/upload", s.handle(s.uploadFileHandler)).Methods("POST")
-	r.HandleFunc("/download", s.handle(s.downloadFileHandler)).Methods("GET")
+	r.HandleFunc("/tus", s.tusOptionsHandler).Methods("OPTIONS")
+	r.HandleFunc("/tus", s.handle(s.tusCreateHandler)).Methods("POST")
+	r.HandleFunc("/tus/{id}", s.tusOptionsHandler).Methods("OPTIONS")
+	r.HandleFunc("/tus/{id}", s.handle(s.tusHeadHandler)).Methods("HEAD")
+	r.HandleFunc("/tus/{id}", s.handle(s.tusPatchHandler)).Methods("PATCH")
+	r.HandleFunc("/tus/{id}", s.handle(s.tusDeleteHandler)).Methods("DELETE")
+	r.HandleFunc("/download", s.handle(s.downloadFileHandler)).Methods("GET", "HEAD")
 	r.HandleFunc("/delete", s.handle(s.deleteFileHandler)).Methods("DELETE")
-
-	r.HandleFunc("/files/{path:.*}", s.BrowserGetHandler).Methods("GET")
+	r.HandleFunc("/trash", s.handle(s.trashListHandler)).Methods("GET")
+	r.HandleFunc("/trash", s.handle(s.trashPurgeHandler)).Methods("DELETE")
+	r.HandleFunc("/trash/restore", s.handle(s.trashRestoreHandler)).Methods("POST")
+	r.HandleFunc("/versions", s.handle(s.versionListHandler)).Methods("GET")
+	r.HandleFunc("/versions/download", s.handle(s.versionDownloadHandler)).Methods("GET", "HEAD")
+	r.HandleFunc("/versions/restore", s.handle(s.versionRestoreHandler)).Methods("POST")
+	r.HandleFunc("/quota", s.handle(s.quotaHandler)).Methods("GET")
+	r.HandleFunc("/extract", s.handle(s.extractHandler)).Methods("POST")
+	r.HandleFunc("/move", s.handle(s.moveHandler)).Methods("POST")
+	r.HandleFunc("/copy", s.handle(s.copyHandler)).Methods("POST")
+	r.HandleFunc("/mkdir", s.handle(s.mkdirHandler)).Methods("POST")
+	r.HandleFunc("/list", s.handle(s.listHandler)).Methods("GET")
+	r.HandleFunc("/stat", s.handle(s.statHandler)).Methods("GET")
+	r.HandleFunc("/search", s.handle(s.searchHandler)).Methods("GET")
+	r.HandleFunc("/archive", s.handle(s.archiveHandler)).Methods("GET", "HEAD", "POST")
+	r.HandleFunc("/thumbnail", s.handle(s.thumbnailHandler)).Methods("GET", "HEAD")
+
+	r.HandleFunc("/files/{path:.*}", s.BrowserGetHandler).Methods("GET", "HEAD")
+
+	if prefix := webdavPrefix(s.WebDAVPrefix); prefix != "" {
+		dav := s.webdavHandler(prefix)
+		r.Path(prefix).Handler(dav)
+		r.PathPrefix(prefix + "/").Handler(dav)
+	}
 
 	r.NotFoundHandler = http.HandlerFunc(notFoundHandler)
 	r.MethodNotAllowedHandler = http.HandlerFunc(methodNotAllowedHandler)
+	return s.compress(r)
+}
+
+// sweepInterval is how often expired uploads, trash items and versions are
+// removed while the server runs, besides on start and when they are accessed
+const sweepInterval = time.Hour
+
+// sweep removes what expired or was left behind
+func (s *Server) sweep() {
+	s.sweepStaging(stagingMaxAge)
+	s.tus.sweep()
+	s.trash.sweep()
+	s.versions.sweep()
+	s.s3Uploads.sweep()
+	s.sweepThumbnails()
+}
+
+// sweepEvery sweeps every interval until done is closed
+func (s *Server) sweepEvery(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.sweep()
+		case <-done:
+			return
+		}
+	}
+}
+
+// Start starts the HTTP server and listens for shutdown signals
+// stop: channel to receive termination signals for graceful shutdown
+// ready: channel to signal when server is ready to accept connections
+func (s *Server) Start(stop chan os.Signal, ready chan struct{}) error {
+	// no upload runs yet, all that is staged was left by a crash
+	s.sweepStaging(0)
+	s.sweep()
+	s.s3ETags.sweep()
+	s.quota.scan(s.trash, s.versions)
+
+	if s.S3Addr != "" && len(s.S3Keys) == 0 {
+		return errors.New("s3_keys must be set to serve the S3 API")
+	}
 
 	srv := http.Server{
 		Addr:         s.Addr,
-		Handler:      r,
+		Handler:      s.handler(),
 		ReadTimeout:  s.ReadTimeout,
 		WriteTimeout: s.WriteTimeout,
 	}
@@ -246,10 +715,47 @@ func (s *Server) Start(stop chan os.Signal, ready chan struct{}) error {
 		ret <- nil
 	}()
 
+	var s3Srv *http.Server
+	s3Ret := make(chan error, 1)
+	if s.S3Addr != "" {
+		s3Srv = &http.Server{
+			Addr:         s.S3Addr,
+			Handler:      s.s3Handler(),
+			ReadTimeout:  s.ReadTimeout,
+			WriteTimeout: s.WriteTimeout,
+		}
+		s3l, err := net.Listen("tcp", s3Srv.Addr)
+		if err != nil {
+			srv.Close()
+			return fmt.Errorf("fail to create S3 Listener: %w", err)
+		}
+		go func() {
+			logger.Info(fmt.Sprintf("s3 server start to: %v", s3Srv.Addr))
+			if err := s3Srv.Serve(s3l); err != nil && err != http.ErrServerClosed {
+				s3Ret <- fmt.Errorf("failed to start s3 server: %w", err)
+				return
+			}
+			logger.Info("s3 server successful shut down")
+			s3Ret <- nil
+		}()
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go s.sweepEvery(sweepInterval, done)
+
 	<-stop
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
+	if s3Srv != nil {
+		if err = s3Srv.Shutdown(ctx); err != nil {
+			return fmt.Errorf("failed to shut down s3 server: %w", err)
+		}
+		if err = <-s3Ret; err != nil {
+			return err
+		}
+	}
 	if err = srv.Shutdown(ctx); err != nil {
 		return fmt.Errorf("failed to shut down server: %w", err)
 	}
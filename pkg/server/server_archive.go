@@ -0,0 +1,309 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	resp "httpserver/internal/response"
+	logger "httpserver/pkg/log"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// archive formats supported by the archive endpoint
+const (
+	archiveZip   = "zip"
+	archiveTar   = "tar"
+	archiveTarGz = "tar.gz"
+)
+
+var archiveContentTypes = map[string]string{
+	archiveZip:   "application/zip",
+	archiveTar:   "application/x-tar",
+	archiveTarGz: "application/gzip",
+}
+
+// archiveWriter is the common part of zip and tar writers
+type archiveWriter interface {
+	// addDir adds a directory entry, name is slash separated and ends with "/"
+	addDir(name string, info os.FileInfo) error
+	// addFile adds a regular file entry with the content of r
+	addFile(name string, info os.FileInfo, r io.Reader) error
+	Close() error
+}
+
+type zipArchive struct {
+	w *zip.Writer
+}
+
+func (z *zipArchive) addDir(name string, info os.FileInfo) error {
+	h, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	h.Name = name
+	_, err = z.w.CreateHeader(h)
+	return err
+}
+
+func (z *zipArchive) addFile(name string, info os.FileInfo, r io.Reader) error {
+	h, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	h.Name = name
+	h.Method = zip.Deflate
+	fw, err := z.w.CreateHeader(h)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, r)
+	return err
+}
+
+func (z *zipArchive) Close() error {
+	return z.w.Close()
+}
+
+type tarArchive struct {
+	w  *tar.Writer
+	gz *gzip.Writer
+}
+
+func (t *tarArchive) addDir(name string, info os.FileInfo) error {
+	h, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	h.Name = name
+	return t.w.WriteHeader(h)
+}
+
+func (t *tarArchive) addFile(name string, info os.FileInfo, r io.Reader) error {
+	h, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	h.Name = name
+	if err := t.w.WriteHeader(h); err != nil {
+		return err
+	}
+	// the header promised info.Size() bytes, a file growing meanwhile must not break the stream
+	_, err = io.Copy(t.w, io.LimitReader(r, info.Size()))
+	return err
+}
+
+func (t *tarArchive) Close() error {
+	err := t.w.Close()
+	if t.gz != nil {
+		if gzErr := t.gz.Close(); err == nil {
+			err = gzErr
+		}
+	}
+	return err
+}
+
+func newArchiveWriter(format string, w io.Writer) archiveWriter {
+	switch format {
+	case archiveZip:
+		return &zipArchive{w: zip.NewWriter(w)}
+	case archiveTarGz:
+		gz := gzip.NewWriter(w)
+		return &tarArchive{w: tar.NewWriter(gz), gz: gz}
+	default:
+		return &tarArchive{w: tar.NewWriter(w)}
+	}
+}
+
+// archiveItem is a resolved path to put in the archive under name
+type archiveItem struct {
+	local string
+	name  string
+}
+
+// archive streams a directory or a selection of paths without buffering to disk.
+// GET query params:
+// - path: the directory (or file) to archive, default to workDir
+// - format: zip (default), tar or tar.gz
+// POST form params:
+// - paths: repeated, the files and directories to archive
+// - format: zip (default), tar or tar.gz
+// - name: optional archive base name
+func (s *Server) archiveHandler(w http.ResponseWriter, r *http.Request) resp.Response {
+	format := strings.ToLower(r.FormValue("format"))
+	if format == "" {
+		format = archiveZip
+	}
+	if format == "tgz" {
+		format = archiveTarGz
+	}
+	contentType, ok := archiveContentTypes[format]
+	if !ok {
+		logger.Error(fmt.Sprintf("unsupported archive format: %q", format))
+		return errorResponse(http.StatusBadRequest, fmt.Errorf("unsupported archive format: %q", format))
+	}
+
+	var userPaths []string
+	if r.Method == http.MethodPost {
+		if err := r.ParseMultipartForm(maxUploadMemory); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+			logger.Error(fmt.Sprintf("failed to parse form: %v", err))
+			return errorResponse(http.StatusBadRequest, errors.New("failed to parse form"))
+		}
+		userPaths = r.Form["paths"]
+		if len(userPaths) == 0 {
+			logger.Error("no paths to archive")
+			return errorResponse(http.StatusBadRequest, errors.New("no paths to archive"))
+		}
+	} else {
+		userPaths = []string{r.FormValue("path")}
+	}
+
+	items := make([]archiveItem, 0, len(userPaths))
+	used := make(map[string]bool)
+	for _, userPath := range userPaths {
+		local, err := s.paths.Resolve(userPath)
+		if err != nil {
+			logger.Error(fmt.Sprintf("invalid path: %v", err))
+			return pathErrorResponse(err)
+		}
+		if _, err := s.fs.Stat(local); err != nil {
+			logger.Error(fmt.Sprintf("file not found: %v", err))
+			return errorResponse(http.StatusNotFound, fmt.Errorf("file not found: %q", userPath))
+		}
+
+		// a selection of the same name from different dirs gets "name (1)"
+		base := archiveBaseName(s.paths.Rel(local))
+		name := base
+		for i := 1; used[name]; i++ {
+			name = suffixName(base, i)
+		}
+		used[name] = true
+		items = append(items, archiveItem{local: local, name: name})
+	}
+
+	archiveName := r.FormValue("name")
+	if archiveName == "" {
+		if len(items) == 1 {
+			archiveName = items[0].name
+		} else {
+			archiveName = "download"
+		}
+	}
+	archiveName = strings.NewReplacer("/", "_", "\\", "_").Replace(archiveName) + "." + format
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", archiveName))
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+
+	aw := newArchiveWriter(format, w)
+	for _, item := range items {
+		// a single directory is archived with its content at the top level
+		prefix := item.name + "/"
+		if len(items) == 1 {
+			prefix = ""
+		}
+		if err := s.addToArchive(aw, item.local, prefix, item.name); err != nil {
+			// the status line is gone, cut the connection so the client sees a broken download
+			logger.Error(fmt.Sprintf("failed to write archive: %v", err))
+			panic(http.ErrAbortHandler)
+		}
+	}
+	if err := aw.Close(); err != nil {
+		logger.Error(fmt.Sprintf("failed to finish archive: %v", err))
+		panic(http.ErrAbortHandler)
+	}
+	return nil
+}
+
+// archiveBaseName is the name of an archived path, "workdir" for the root
+func archiveBaseName(rel string) string {
+	if rel == "" {
+		return "workdir"
+	}
+	return path.Base(rel)
+}
+
+// addToArchive walks local, dirs get prefix prepended to their entries, a
+// single file is stored as name. Symlinks are followed only when they point
+// to a regular file inside the work dir.
+func (s *Server) addToArchive(aw archiveWriter, local, prefix, name string) error {
+	info, err := s.fs.Stat(local)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return addArchiveFile(s.fs, aw, local, name, info)
+	}
+
+	root, err := s.paths.Root()
+	if err != nil {
+		return err
+	}
+	return walkDir(s.fs, local, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if isStateDir(root, p) {
+			return filepath.SkipDir
+		}
+		rel, err := filepath.Rel(local, p)
+		if err != nil {
+			return err
+		}
+		entryName := prefix + filepath.ToSlash(rel)
+
+		if d.Type()&fs.ModeSymlink != 0 {
+			target, err := s.paths.Resolve(s.paths.Rel(p))
+			if err != nil {
+				logger.Warn(fmt.Sprintf("skip symlink %v: %v", p, err))
+				return nil
+			}
+			info, err := s.fs.Stat(target)
+			if err != nil || !info.Mode().IsRegular() {
+				return nil
+			}
+			return addArchiveFile(s.fs, aw, p, entryName, info)
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			if rel == "." {
+				if prefix == "" {
+					return nil
+				}
+				entryName = prefix
+			} else {
+				entryName += "/"
+			}
+			return aw.addDir(entryName, info)
+		case info.Mode().IsRegular():
+			return addArchiveFile(s.fs, aw, p, entryName, info)
+		default:
+			// sockets, devices and pipes have no content to archive
+			return nil
+		}
+	})
+}
+
+func addArchiveFile(fsys Storage, aw archiveWriter, local, name string, info os.FileInfo) error {
+	f, err := fsys.Open(local)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return aw.addFile(name, info, f)
+}
@@ -0,0 +1,317 @@
+package server
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	logger "httpserver/pkg/log"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// compressedTypes are skipped by the compression middleware, their content
+// is compressed already
+var compressedTypes = map[string]bool{
+	"application/gzip":             true,
+	"application/x-gzip":           true,
+	"application/zip":              true,
+	"application/x-bzip2":          true,
+	"application/x-xz":             true,
+	"application/zstd":             true,
+	"application/x-7z-compressed":  true,
+	"application/vnd.rar":          true,
+	"application/x-rar-compressed": true,
+	"application/pdf":              true,
+	"font/woff":                    true,
+	"font/woff2":                   true,
+	// unknown binary content rarely shrinks
+	"application/octet-stream": true,
+}
+
+// isCompressedType reports whether content of type mediaType gains nothing from compression
+func isCompressedType(mediaType string) bool {
+	switch {
+	case mediaType == "image/svg+xml", mediaType == "image/bmp":
+		return false
+	case strings.HasPrefix(mediaType, "image/"),
+		strings.HasPrefix(mediaType, "audio/"),
+		strings.HasPrefix(mediaType, "video/"):
+		return true
+	}
+	return compressedTypes[mediaType]
+}
+
+// acceptedEncodings returns the q-values of the content codings of an
+// Accept-Encoding header, codings with q=0 are refused
+func acceptedEncodings(header string) map[string]float64 {
+	accepted := make(map[string]float64)
+	for _, member := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(member, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			k, v, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if ok && strings.EqualFold(strings.TrimSpace(k), "q") {
+				var err error
+				if q, err = strconv.ParseFloat(strings.TrimSpace(v), 64); err != nil {
+					q = 0
+				}
+			}
+		}
+		if name == "x-gzip" {
+			name = "gzip"
+		}
+		accepted[name] = q
+	}
+	return accepted
+}
+
+// acceptsEncoding reports whether encoding is acceptable, explicitly or by *
+func acceptsEncoding(accepted map[string]float64, encoding string) (float64, bool) {
+	q, ok := accepted[encoding]
+	if !ok {
+		q, ok = accepted["*"]
+	}
+	return q, ok && q > 0
+}
+
+// negotiateEncoding picks gzip or deflate for an Accept-Encoding header,
+// gzip on a tie, "" when the response must not be compressed
+func negotiateEncoding(header string) string {
+	accepted := acceptedEncodings(header)
+	best, bestQ := "", 0.0
+	for _, encoding := range []string{"gzip", "deflate"} {
+		if q, ok := acceptsEncoding(accepted, encoding); ok && q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+var (
+	gzipWriters = sync.Pool{New: func() any { return gzip.NewWriter(io.Discard) }}
+	zlibWriters = sync.Pool{New: func() any { return zlib.NewWriter(io.Discard) }}
+)
+
+// compress compresses the responses of next that are large enough and of
+// a type that isn't compressed already. Range requests are passed through
+// untouched, their byte ranges refer to the identity content.
+func (s *Server) compress(next http.Handler) http.Handler {
+	minSize := int64Value(s.CompressMinSize)
+	if minSize < 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{
+			ResponseWriter: w,
+			encoding:       negotiateEncoding(r.Header.Get("Accept-Encoding")),
+			minSize:        minSize,
+			head:           r.Method == http.MethodHead,
+		}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// compressWriter decides when the header is written whether to compress
+type compressWriter struct {
+	http.ResponseWriter
+	encoding    string
+	minSize     int64
+	head        bool
+	wroteHeader bool
+	// nil when the body is written as is
+	enc  io.WriteCloser
+	pool *sync.Pool
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	// informational responses come before the final header
+	if cw.wroteHeader || status < 200 {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	cw.wroteHeader = true
+	if cw.shouldCompress(status) {
+		h := cw.Header()
+		h.Set("Content-Encoding", cw.encoding)
+		h.Del("Content-Length")
+		// the digests describe the identity content
+		h.Del("Content-Digest")
+		h.Del("Repr-Digest")
+		// the encoded bytes are not the same, only equivalent
+		if etag := h.Get("ETag"); strings.HasPrefix(etag, `"`) {
+			h.Set("ETag", "W/"+etag)
+		}
+		if !cw.head {
+			cw.startEncoder()
+		}
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *compressWriter) shouldCompress(status int) bool {
+	h := cw.Header()
+	if h.Get("Content-Encoding") != "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil || isCompressedType(mediaType) {
+		return false
+	}
+	// the response depends on Accept-Encoding even when sent as is
+	if !headerHasToken(h, "Vary", "Accept-Encoding") {
+		h.Add("Vary", "Accept-Encoding")
+	}
+	if cw.encoding == "" || status == http.StatusNoContent || status == http.StatusNotModified || status == http.StatusPartialContent {
+		return false
+	}
+	if size, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64); err == nil && size < cw.minSize {
+		return false
+	}
+	return true
+}
+
+func (cw *compressWriter) startEncoder() {
+	switch cw.encoding {
+	case "gzip":
+		gz := gzipWriters.Get().(*gzip.Writer)
+		gz.Reset(cw.ResponseWriter)
+		cw.enc, cw.pool = gz, &gzipWriters
+	case "deflate":
+		zw := zlibWriters.Get().(*zlib.Writer)
+		zw.Reset(cw.ResponseWriter)
+		cw.enc, cw.pool = zw, &zlibWriters
+	}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if !cw.wroteHeader {
+		// sniff like net/http would, the type decides about compression
+		if _, ok := cw.Header()["Content-Type"]; !ok {
+			cw.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.enc != nil {
+		return cw.enc.Write(p)
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+// ReadFrom hands a body sent as is to the underlying writer, so files are
+// still sent with sendfile
+func (cw *compressWriter) ReadFrom(r io.Reader) (int64, error) {
+	if !cw.wroteHeader {
+		if _, ok := cw.Header()["Content-Type"]; !ok {
+			// the first Write sniffs the type
+			return io.Copy(struct{ io.Writer }{cw}, r)
+		}
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.enc != nil {
+		return io.Copy(cw.enc, r)
+	}
+	if rf, ok := cw.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(cw.ResponseWriter, r)
+}
+
+// Flush sends the data compressed so far, streamed responses stay streamed
+func (cw *compressWriter) Flush() {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if f, ok := cw.enc.(interface{ Flush() error }); ok {
+		if err := f.Flush(); err != nil {
+			return
+		}
+	}
+	if err := http.NewResponseController(cw.ResponseWriter).Flush(); err != nil && err != http.ErrNotSupported {
+		logger.Warn(fmt.Sprintf("failed to flush response: %v", err))
+	}
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// close writes the end of the compressed stream
+func (cw *compressWriter) close() {
+	if cw.enc == nil {
+		return
+	}
+	if err := cw.enc.Close(); err != nil {
+		logger.Warn(fmt.Sprintf("failed to finish compressed response: %v", err))
+	}
+	// don't keep the connection referenced from the pool
+	cw.enc.(interface{ Reset(io.Writer) }).Reset(io.Discard)
+	cw.pool.Put(cw.enc)
+	cw.enc = nil
+}
+
+// headerHasToken reports whether a comma separated header of h lists token
+func headerHasToken(h http.Header, key, token string) bool {
+	for _, value := range h.Values(key) {
+		for _, t := range strings.Split(value, ",") {
+			if t = strings.TrimSpace(t); t == "*" || strings.EqualFold(t, token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// openPrecompressed opens the file at localPath for serving, or its gzip
+// sibling file.gz when the client accepts gzip. The returned info is the one
+// of the opened file; when it is the sibling, Content-Type and
+// Content-Encoding are set for the original.
+func (s *Server) openPrecompressed(w http.ResponseWriter, r *http.Request, localPath string, info os.FileInfo) (File, os.FileInfo, error) {
+	if gzPath, gzInfo, ok := s.precompressed(localPath, info); ok {
+		if !headerHasToken(w.Header(), "Vary", "Accept-Encoding") {
+			w.Header().Add("Vary", "Accept-Encoding")
+		}
+		if _, accepted := acceptsEncoding(acceptedEncodings(r.Header.Get("Accept-Encoding")), "gzip"); accepted {
+			if file, err := s.fs.Open(gzPath); err == nil {
+				if w.Header().Get("Content-Type") == "" {
+					w.Header().Set("Content-Type", detectMimeType(s.fs, localPath, info.Name()))
+				}
+				w.Header().Set("Content-Encoding", "gzip")
+				// ServeContent leaves it out for content coded responses
+				// unless they are partial
+				w.Header().Set("Content-Length", strconv.FormatInt(gzInfo.Size(), 10))
+				return file, gzInfo, nil
+			}
+		}
+	}
+	file, err := s.fs.Open(localPath)
+	return file, info, err
+}
+
+// precompressed returns the gzip sibling of localPath, a sibling older than
+// the file is stale and ignored
+func (s *Server) precompressed(localPath string, info os.FileInfo) (string, os.FileInfo, bool) {
+	gzPath, err := s.paths.ResolveName(filepath.Dir(localPath), filepath.Base(localPath)+".gz")
+	if err != nil {
+		return "", nil, false
+	}
+	gzInfo, err := s.fs.Stat(gzPath)
+	if err != nil || !gzInfo.Mode().IsRegular() || gzInfo.ModTime().Before(info.ModTime()) {
+		return "", nil, false
+	}
+	return gzPath, gzInfo, true
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// readFromRecorder records whether the body went through ReadFrom, like
+// *http.response does to use sendfile
+type readFromRecorder struct {
+	*httptest.ResponseRecorder
+	readFrom bool
+}
+
+func (r *readFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	r.readFrom = true
+	return io.Copy(r.ResponseRecorder, src)
+}
+
+func TestCompressWriterReadFrom(t *testing.T) {
+	body := strings.Repeat("compressible text ", 200)
+	tests := []struct {
+		name        string
+		encoding    string
+		contentType string
+		compressed  bool
+		readFrom    bool
+	}{
+		{name: "identity", encoding: "", contentType: "text/plain", readFrom: true},
+		{name: "compressed type", encoding: "gzip", contentType: "image/png", readFrom: true},
+		{name: "gzip", encoding: "gzip", contentType: "text/plain", compressed: true},
+		{name: "sniffed", encoding: "gzip", contentType: "", compressed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &readFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+			cw := &compressWriter{ResponseWriter: rec, encoding: tt.encoding, minSize: 1024}
+			if tt.contentType != "" {
+				cw.Header().Set("Content-Type", tt.contentType)
+			}
+			// hide WriterTo so io.Copy goes through ReadFrom
+			n, err := io.Copy(cw, struct{ io.Reader }{strings.NewReader(body)})
+			cw.close()
+			if err != nil || n != int64(len(body)) {
+				t.Fatalf("copy = %d, %v; want %d", n, err, len(body))
+			}
+			if rec.readFrom != tt.readFrom {
+				t.Errorf("underlying ReadFrom used = %v; want %v", rec.readFrom, tt.readFrom)
+			}
+
+			got := rec.Body.String()
+			if encoding := rec.Header().Get("Content-Encoding"); (encoding == "gzip") != tt.compressed {
+				t.Fatalf("Content-Encoding = %q; compressed want %v", encoding, tt.compressed)
+			}
+			if tt.compressed {
+				zr, err := gzip.NewReader(rec.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				b, err := io.ReadAll(zr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = string(b)
+			}
+			if got != body {
+				t.Fatalf("body differs, got %d bytes", len(got))
+			}
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d", rec.Code)
+			}
+		})
+	}
+}
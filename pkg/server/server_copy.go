@@ -0,0 +1,414 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	resp "httpserver/internal/response"
+	logger "httpserver/pkg/log"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// copies a file or a directory tree inside workDir, keeping modes and mtimes.
+// Files are cloned into the staging dir and placed like uploads, so the
+// naming strategy decides what happens on conflicts. A directory copied onto
+// an existing directory is merged, the strategy applying to each file.
+// query params:
+// - from: the path to copy
+// - to: the destination path
+// - naming / overwrite: conflict policy, like uploads
+func (s *Server) copyHandler(w http.ResponseWriter, r *http.Request) resp.Response {
+	from, err := s.paths.Resolve(r.FormValue("from"))
+	if err != nil {
+		logger.Error(fmt.Sprintf("invalid from: %v", err))
+		return pathErrorResponse(err)
+	}
+	to, err := s.paths.Resolve(r.FormValue("to"))
+	if err != nil {
+		logger.Error(fmt.Sprintf("invalid to: %v", err))
+		return pathErrorResponse(err)
+	}
+	strategy, err := s.namingStrategy(r)
+	if err != nil {
+		logger.Error(fmt.Sprintf("invalid naming strategy: %v", err))
+		return errorCodeResponse(http.StatusBadRequest, resp.CodeUploadInvalid, err)
+	}
+
+	srcInfo, err := s.fs.Stat(from)
+	if err != nil {
+		logger.Error(fmt.Sprintf("file not found: %v", err))
+		return errorCodeResponse(http.StatusNotFound, resp.CodeNotFound, errors.New("file not found"))
+	}
+	if from == to && (srcInfo.IsDir() || strategy == NamingOriginal || strategy == NamingOverwrite) {
+		logger.Error("source and destination are the same")
+		return errorCodeResponse(http.StatusBadRequest, resp.CodeMoveSamePath, errors.New("source and destination are the same"))
+	}
+	if srcInfo.IsDir() && within(from, to) {
+		logger.Error("cannot copy a directory into itself")
+		return errorCodeResponse(http.StatusBadRequest, resp.CodeMoveIntoItself, errors.New("cannot copy a directory into itself"))
+	}
+	if s.paths.IsRoot(to) && !srcInfo.IsDir() {
+		logger.Error("cannot copy a file onto work dir")
+		return errorCodeResponse(http.StatusForbidden, resp.CodeRootForbidden, errors.New("cannot copy a file onto work dir"))
+	}
+	if destInfo, err := s.fs.Stat(to); err == nil && destInfo.IsDir() != srcInfo.IsDir() {
+		logger.Error("destination is of another kind")
+		return errorCodeResponse(http.StatusConflict, resp.CodeFileExists, errors.New("cannot copy a directory onto a file or a file onto a directory"))
+	}
+
+	if !srcInfo.IsDir() {
+		if err := s.fs.MkdirAll(filepath.Dir(to), 0755); err != nil {
+			logger.Error(fmt.Sprintf("failed to make dir: %v", err))
+			return errorResponse(http.StatusInternalServerError, errors.New("failed to make dir"))
+		}
+		result := s.copyEntry(from, filepath.Dir(to), filepath.Base(to), srcInfo, strategy)
+		if result.Error != "" {
+			return errorCodeResponse(result.Status, result.Code, errors.New(result.Error))
+		}
+		return successResponse(http.StatusOK, "Copy successfully", []UploadResult{result})
+	}
+
+	results, err := s.copyDir(from, to, strategy)
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to copy %v: %v", from, err))
+		return errorResponse(http.StatusInternalServerError, errors.New("failed to copy"))
+	}
+	return resultsResponse(results, "Copy successfully")
+}
+
+// copyDir copies the tree at from into to, creating or merging dirs
+func (s *Server) copyDir(from, to string, strategy NamingStrategy) ([]UploadResult, error) {
+	root, err := s.paths.Root()
+	if err != nil {
+		return nil, err
+	}
+	toRel := s.paths.Rel(to)
+
+	var results []UploadResult
+	err = walkDir(s.fs, from, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if isStateDir(root, p) {
+			return filepath.SkipDir
+		}
+		rel, err := filepath.Rel(from, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			target, err := s.paths.Resolve(path.Join(toRel, rel))
+			if err != nil {
+				return err
+			}
+			if err := s.fs.MkdirAll(target, info.Mode().Perm()); err != nil {
+				return err
+			}
+			return nil
+		}
+
+		dir, err := s.paths.Resolve(path.Join(toRel, path.Dir(rel)))
+		if err != nil {
+			return err
+		}
+		results = append(results, s.copyEntry(p, dir, path.Base(rel), info, strategy))
+		return nil
+	})
+	if err != nil {
+		return results, err
+	}
+	return results, copyDirTimes(s.fs, from, to)
+}
+
+// copyEntry copies the file or symlink src into dir as name
+func (s *Server) copyEntry(src, dir, name string, info os.FileInfo, strategy NamingStrategy) UploadResult {
+	result := UploadResult{Filename: s.paths.Rel(src), Size: info.Size()}
+	fail := func(err error) UploadResult {
+		result.Status, result.Code, result.Error = entryError(err)
+		return result
+	}
+
+	if _, err := s.paths.ResolveName(dir, name); err != nil {
+		return fail(err)
+	}
+
+	if info.Mode()&fs.ModeSymlink != 0 {
+		link, err := s.copyLinkTarget(src, dir)
+		if err != nil {
+			return fail(err)
+		}
+		target, err := s.placeSymlink(link, dir, name, strategy)
+		if err != nil {
+			return fail(err)
+		}
+		result.Name = filepath.Base(target)
+		result.Path = s.paths.Rel(target)
+		result.Status = http.StatusOK
+		return result
+	}
+	if !info.Mode().IsRegular() {
+		return fail(fmt.Errorf("cannot copy special file %v", src))
+	}
+
+	staged, err := s.copyToStaging(src, info)
+	if err != nil {
+		return fail(err)
+	}
+	target, err := s.placeFile(staged, dir, name, strategy)
+	if err != nil {
+		s.fs.Remove(staged)
+		return fail(err)
+	}
+	syncDir(s.fs, dir)
+
+	result.Name = filepath.Base(target)
+	result.Path = s.paths.Rel(target)
+	result.Status = http.StatusOK
+	return result
+}
+
+// copyLinkTarget returns the target for a copy of the symlink src made in
+// dir. A relative target is kept if it still points inside workDir from dir,
+// otherwise it is rewritten relative to dir so the copy points to the same
+// file as src. Links pointing outside of workDir are rejected.
+func (s *Server) copyLinkTarget(src, dir string) (string, error) {
+	link, err := s.fs.Readlink(src)
+	if err != nil {
+		return "", err
+	}
+	root, err := s.paths.Root()
+	if err != nil {
+		return "", err
+	}
+	escape := &PathError{Code: resp.CodeSymlinkEscape, Path: s.paths.Rel(src), Err: ErrPathEscape}
+
+	if filepath.IsAbs(link) {
+		if !within(root, link) || isStateDir(root, link) {
+			return "", escape
+		}
+		return link, nil
+	}
+
+	srcDir, err := s.fs.EvalSymlinks(filepath.Dir(src))
+	if err != nil {
+		return "", err
+	}
+	orig := filepath.Join(srcDir, link)
+	if !within(root, orig) || isStateDir(root, orig) {
+		return "", escape
+	}
+	destDir, err := s.fs.EvalSymlinks(dir)
+	if err != nil {
+		return "", err
+	}
+	if copied := filepath.Join(destDir, link); within(root, copied) && !isStateDir(root, copied) {
+		return link, nil
+	}
+	return filepath.Rel(destDir, orig)
+}
+
+// placeSymlink creates a symlink to link in dir, named by strategy the way
+// placeFile names regular files. The hash strategy hashes the link target.
+func (s *Server) placeSymlink(link, dir, name string, strategy NamingStrategy) (string, error) {
+	added := quotaUsage{Bytes: int64(len(link)), Files: 1}
+	res, err := s.quota.reserve(filepath.Join(dir, name), added, "")
+	if err != nil {
+		return "", err
+	}
+	defer res.release()
+
+	switch strategy {
+	case NamingOverwrite:
+		dest := filepath.Join(dir, name)
+		var replaced quotaUsage
+		if info, err := s.fs.Lstat(dest); err == nil {
+			if info.IsDir() {
+				return "", ErrFileExists
+			}
+			// a replaced file kept as a version still counts
+			if !s.versions.keeps(info) {
+				replaced = quotaUsage{Bytes: info.Size(), Files: 1}
+			}
+		}
+		if err := s.versions.save(dest); err != nil {
+			return "", err
+		}
+		if err := s.fs.Remove(dest); err == nil {
+			s.quota.update(dest, quotaUsage{}.sub(replaced))
+		}
+		if err := s.fs.Symlink(link, dest); err != nil {
+			return "", err
+		}
+		s.quota.update(dest, added)
+		return dest, nil
+
+	case NamingHash:
+		sum := sha256.Sum256([]byte(link))
+		dest := filepath.Join(dir, hex.EncodeToString(sum[:])+filepath.Ext(name))
+		if existing, err := s.fs.Readlink(dest); err == nil && existing == link {
+			// same link already stored
+			return dest, nil
+		}
+		if err := s.fs.Symlink(link, dest); err != nil {
+			return "", err
+		}
+		s.quota.update(dest, added)
+		return dest, nil
+	}
+
+	name, err = strategyName(name, strategy)
+	if err != nil {
+		return "", err
+	}
+	for i := 0; i < maxSuffix; i++ {
+		dest := filepath.Join(dir, suffixName(name, i))
+		err := s.fs.Symlink(link, dest)
+		if err == nil {
+			s.quota.update(dest, added)
+			return dest, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return "", err
+		}
+		if strategy == NamingOriginal {
+			return "", ErrFileExists
+		}
+	}
+	return "", ErrFileExists
+}
+
+// copyToStaging copies the regular file src to a new staging file with its mode and mtime
+func (s *Server) copyToStaging(src string, info os.FileInfo) (string, error) {
+	in, err := s.fs.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	out, err := s.createStaging()
+	if err != nil {
+		return "", err
+	}
+	err = copyContent(out, in)
+	if err == nil {
+		err = out.Chmod(info.Mode().Perm())
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = s.fs.Chtimes(out.Name(), info.ModTime(), info.ModTime())
+	}
+	if err != nil {
+		s.fs.Remove(out.Name())
+		return "", err
+	}
+	return out.Name(), nil
+}
+
+// copyFile copies a regular file keeping its mode and mtime
+func copyFile(fsys Storage, src, dst string, info os.FileInfo) error {
+	in, err := fsys.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := fsys.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	err = copyContent(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fsys.Remove(dst)
+		return err
+	}
+	return fsys.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+// copyContent copies in to the empty file out, cloning the data when both
+// are on a disk supporting reflinks, otherwise *os.File.ReadFrom uses
+// copy_file_range/sendfile when the platform allows it
+func copyContent(out, in File) error {
+	outFile, ok1 := out.(*os.File)
+	inFile, ok2 := in.(*os.File)
+	if ok1 && ok2 && reflink(outFile, inFile) == nil {
+		return nil
+	}
+	_, err := io.Copy(out, in)
+	return err
+}
+
+// copyTree copies src to dst recursively, symlinks are recreated as links.
+// dst must not exist.
+func copyTree(fsys Storage, src, dst string) error {
+	if err := walkDir(fsys, src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case d.IsDir():
+			return fsys.Mkdir(target, info.Mode().Perm())
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := fsys.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return fsys.Symlink(link, target)
+		case info.Mode().IsRegular():
+			return copyFile(fsys, p, target, info)
+		default:
+			return fmt.Errorf("cannot copy special file %v", p)
+		}
+	}); err != nil {
+		return err
+	}
+	return copyDirTimes(fsys, src, dst)
+}
+
+// copyDirTimes sets the mtime of the dirs under dst to the ones of src,
+// done last since creating the children updates them
+func copyDirTimes(fsys Storage, src, dst string) error {
+	return walkDir(fsys, src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		return fsys.Chtimes(filepath.Join(dst, rel), info.ModTime(), info.ModTime())
+	})
+}
@@ -0,0 +1,20 @@
+//go:build linux
+
+package server
+
+import (
+	"os"
+	"syscall"
+)
+
+// FICLONE from linux/fs.h
+const ficlone = 0x40049409
+
+// reflink shares the extents of src with dst on filesystems supporting it (btrfs, xfs)
+func reflink(dst, src *os.File) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ficlone, src.Fd())
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
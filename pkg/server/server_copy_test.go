@@ -0,0 +1,113 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCopyOverwrite(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		// content of the files afterwards
+		want map[string]string
+		gone []string
+	}{
+		{
+			name: "file to new path", query: "from=x.txt&to=n/x.txt", status: http.StatusOK,
+			want: map[string]string{"x.txt": "x", "n/x.txt": "x"},
+		},
+		{
+			name: "file onto file", query: "from=x.txt&to=y.txt", status: http.StatusConflict,
+			want: map[string]string{"x.txt": "x", "y.txt": "y"},
+		},
+		{
+			name: "file replaces file", query: "from=x.txt&to=y.txt&overwrite=true", status: http.StatusOK,
+			want: map[string]string{"x.txt": "x", "y.txt": "x"},
+		},
+		{
+			name: "file beside file", query: "from=x.txt&to=y.txt&naming=suffix", status: http.StatusOK,
+			want: map[string]string{"y.txt": "y", "y (1).txt": "x"},
+		},
+		{
+			name: "same path", query: "from=x.txt&to=x.txt&overwrite=true", status: http.StatusBadRequest,
+			want: map[string]string{"x.txt": "x"}, gone: []string{"x (1).txt"},
+		},
+		{
+			name: "duplicate", query: "from=x.txt&to=x.txt&naming=suffix", status: http.StatusOK,
+			want: map[string]string{"x.txt": "x", "x (1).txt": "x"},
+		},
+		{
+			name: "file onto dir", query: "from=x.txt&to=d&overwrite=true", status: http.StatusConflict,
+			want: map[string]string{"d/g.txt": "g"},
+		},
+		{
+			name: "dir onto file", query: "from=d&to=x.txt&overwrite=true", status: http.StatusConflict,
+			want: map[string]string{"x.txt": "x"},
+		},
+		{
+			name: "dir to new path", query: "from=a&to=n", status: http.StatusOK,
+			want: map[string]string{"a/b/c/f.txt": "f", "n/b/c/f.txt": "f"},
+		},
+		{
+			name: "dir merged", query: "from=d&to=a/b", status: http.StatusOK,
+			want: map[string]string{"a/b/g.txt": "g", "a/b/c/f.txt": "f", "d/g.txt": "g"},
+		},
+		{
+			name: "dir merge conflict", query: "from=d&to=e", status: http.StatusMultiStatus,
+			want: map[string]string{"e/g.txt": "e", "e/h.txt": "h", "d/g.txt": "g"},
+		},
+		{
+			name: "dir merge overwrite", query: "from=d&to=e&overwrite=true", status: http.StatusOK,
+			want: map[string]string{"e/g.txt": "g", "e/h.txt": "h"},
+		},
+		{
+			name: "dir into itself", query: "from=a&to=a/b/n", status: http.StatusBadRequest,
+			want: map[string]string{"a/b/c/f.txt": "f"}, gone: []string{"a/b/n"},
+		},
+		{
+			name: "dir onto itself", query: "from=a&to=a&naming=suffix", status: http.StatusBadRequest,
+			want: map[string]string{"a/b/c/f.txt": "f"}, gone: []string{"a/b/c/f (1).txt"},
+		},
+		{
+			// the content of the dir is merged into its parent
+			name: "dir onto its parent", query: "from=a/b/c&to=a/b", status: http.StatusOK,
+			want: map[string]string{"a/b/c/f.txt": "f", "a/b/f.txt": "f"},
+		},
+		{
+			name: "file onto an ancestor", query: "from=a/b/c/f.txt&to=a&overwrite=true", status: http.StatusConflict,
+			want: map[string]string{"a/b/c/f.txt": "f"},
+		},
+		{
+			name: "file onto work dir", query: "from=x.txt&to=&overwrite=true", status: http.StatusForbidden,
+			want: map[string]string{"x.txt": "x"},
+		},
+		{
+			name: "missing", query: "from=n.txt&to=m.txt", status: http.StatusNotFound,
+			gone: []string{"m.txt"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachStorage(t, ServerConfig{}, func(t *testing.T, ts *testServer) {
+				ts.upload("a/b/c", map[string]string{"f.txt": "f"}, "", http.StatusOK)
+				ts.upload("d", map[string]string{"g.txt": "g"}, "", http.StatusOK)
+				ts.upload("e", map[string]string{"g.txt": "e", "h.txt": "h"}, "", http.StatusOK)
+				ts.upload("", map[string]string{"x.txt": "x", "y.txt": "y"}, "", http.StatusOK)
+
+				ts.call("POST", "/copy?"+tt.query, tt.status, nil)
+				for path, want := range tt.want {
+					if got := ts.content(path); got != want {
+						t.Errorf("%s = %q; want %q", path, got, want)
+					}
+				}
+				for _, path := range tt.gone {
+					if ts.exists(path) {
+						t.Errorf("%s exists", path)
+					}
+				}
+			})
+		})
+	}
+}
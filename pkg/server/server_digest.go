@@ -0,0 +1,223 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	logger "httpserver/pkg/log"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// integrity digests as defined by RFC 9530, only the active algorithms of the
+// Hash Algorithms for HTTP Digest Fields registry are supported
+var digestAlgorithms = map[string]func() hash.Hash{
+	"sha-256": sha256.New,
+	"sha-512": sha512.New,
+}
+
+// sha-256 is always computed, it is the digest returned to clients and cached for downloads
+const defaultDigestAlgorithm = "sha-256"
+
+const digestStateDir = "digests"
+
+var ErrDigestMismatch = errors.New("digest mismatch")
+
+// parseDigestHeader parses a digest field value like
+// `sha-256=:base64:, sha-512=:base64:`, unknown algorithms are ignored
+func parseDigestHeader(value string) (map[string][]byte, error) {
+	digests := make(map[string][]byte)
+	if strings.TrimSpace(value) == "" {
+		return digests, nil
+	}
+	for _, member := range strings.Split(value, ",") {
+		alg, encoded, ok := strings.Cut(strings.TrimSpace(member), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid digest: %q", member)
+		}
+		alg = strings.ToLower(alg)
+		if _, ok := digestAlgorithms[alg]; !ok {
+			continue
+		}
+		if len(encoded) < 2 || encoded[0] != ':' || encoded[len(encoded)-1] != ':' {
+			return nil, fmt.Errorf("invalid digest value for %v", alg)
+		}
+		sum, err := base64.StdEncoding.DecodeString(encoded[1 : len(encoded)-1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid digest value for %v", alg)
+		}
+		digests[alg] = sum
+	}
+	return digests, nil
+}
+
+// headerDigests merges the Content-Digest and Repr-Digest fields of h.
+// Uploads are never content coded, so both describe the same bytes.
+func headerDigests(h interface{ Get(string) string }) (map[string][]byte, error) {
+	digests, err := parseDigestHeader(h.Get("Content-Digest"))
+	if err != nil {
+		return nil, err
+	}
+	repr, err := parseDigestHeader(h.Get("Repr-Digest"))
+	if err != nil {
+		return nil, err
+	}
+	for alg, sum := range repr {
+		if other, ok := digests[alg]; ok && !bytes.Equal(other, sum) {
+			return nil, fmt.Errorf("conflicting %v digests", alg)
+		}
+		digests[alg] = sum
+	}
+	return digests, nil
+}
+
+// formatDigestHeader formats sums as a digest field value
+func formatDigestHeader(sums map[string][]byte) string {
+	algs := make([]string, 0, len(sums))
+	for alg := range sums {
+		algs = append(algs, alg)
+	}
+	sort.Strings(algs)
+
+	members := make([]string, 0, len(algs))
+	for _, alg := range algs {
+		members = append(members, alg+"=:"+base64.StdEncoding.EncodeToString(sums[alg])+":")
+	}
+	return strings.Join(members, ", ")
+}
+
+// digester computes the default algorithm plus every algorithm of want
+// while the data is written through it
+type digester struct {
+	hashes map[string]hash.Hash
+}
+
+func newDigester(want map[string][]byte) *digester {
+	d := &digester{hashes: map[string]hash.Hash{defaultDigestAlgorithm: digestAlgorithms[defaultDigestAlgorithm]()}}
+	for alg := range want {
+		d.hashes[alg] = digestAlgorithms[alg]()
+	}
+	return d
+}
+
+func (d *digester) Write(p []byte) (int, error) {
+	for _, h := range d.hashes {
+		h.Write(p)
+	}
+	return len(p), nil
+}
+
+func (d *digester) Sums() map[string][]byte {
+	sums := make(map[string][]byte, len(d.hashes))
+	for alg, h := range d.hashes {
+		sums[alg] = h.Sum(nil)
+	}
+	return sums
+}
+
+// verify compares the computed sums with the expected ones
+func (d *digester) verify(want map[string][]byte) error {
+	sums := d.Sums()
+	for alg, sum := range want {
+		if !bytes.Equal(sums[alg], sum) {
+			return fmt.Errorf("%w: %v", ErrDigestMismatch, alg)
+		}
+	}
+	return nil
+}
+
+// hexDigests converts sums to the hex form used in json payloads
+func hexDigests(sums map[string][]byte) map[string]string {
+	out := make(map[string]string, len(sums))
+	for alg, sum := range sums {
+		out[alg] = hex.EncodeToString(sum)
+	}
+	return out
+}
+
+// digestEntry is the cached digest of a file, valid while size and mtime match
+type digestEntry struct {
+	Size    int64             `json:"size"`
+	ModTime int64             `json:"mtime"`
+	Sums    map[string][]byte `json:"sums"`
+}
+
+// digestCachePath returns the cache file of local, keyed by its path inside the work dir
+func (s *Server) digestCachePath(local string) (string, error) {
+	dir, err := s.paths.StateDir(digestStateDir)
+	if err != nil {
+		return "", err
+	}
+	key := sha256.Sum256([]byte(s.paths.Rel(local)))
+	return filepath.Join(dir, hex.EncodeToString(key[:])+".json"), nil
+}
+
+// storeDigests caches the sums of the file at local
+func (s *Server) storeDigests(local string, sums map[string][]byte) {
+	info, err := s.fs.Stat(local)
+	if err != nil {
+		return
+	}
+	cachePath, err := s.digestCachePath(local)
+	if err != nil {
+		logger.Warn(fmt.Sprintf("failed to open digest cache: %v", err))
+		return
+	}
+	b, err := json.Marshal(digestEntry{Size: info.Size(), ModTime: info.ModTime().UnixNano(), Sums: sums})
+	if err != nil {
+		return
+	}
+	if err := writeFile(s.fs, cachePath, b, 0644); err != nil {
+		logger.Warn(fmt.Sprintf("failed to write digest cache: %v", err))
+	}
+}
+
+// fileDigests returns the cached sums of local, computing them when compute is set
+func (s *Server) fileDigests(local string, info os.FileInfo, compute bool) map[string][]byte {
+	cachePath, err := s.digestCachePath(local)
+	if err != nil {
+		return nil
+	}
+	if b, err := readFile(s.fs, cachePath); err == nil {
+		entry := digestEntry{}
+		if json.Unmarshal(b, &entry) == nil && entry.Size == info.Size() && entry.ModTime == info.ModTime().UnixNano() {
+			return entry.Sums
+		}
+	}
+	if !compute {
+		return nil
+	}
+
+	f, err := s.fs.Open(local)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	d := newDigester(nil)
+	if _, err := io.Copy(d, f); err != nil {
+		logger.Warn(fmt.Sprintf("failed to hash file: %v", err))
+		return nil
+	}
+	sums := d.Sums()
+	s.storeDigests(local, sums)
+	return sums
+}
+
+// setReprDigest adds the Repr-Digest field to a download when the digest is
+// cached, or when the client asked for it with Want-Repr-Digest
+func (s *Server) setReprDigest(w http.ResponseWriter, r *http.Request, local string, info os.FileInfo) {
+	sums := s.fileDigests(local, info, r.Header.Get("Want-Repr-Digest") != "")
+	if len(sums) > 0 {
+		w.Header().Set("Repr-Digest", formatDigestHeader(sums))
+	}
+}
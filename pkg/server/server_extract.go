@@ -0,0 +1,451 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	resp "httpserver/internal/response"
+	logger "httpserver/pkg/log"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrArchiveFormat   = errors.New("unsupported archive format")
+	ErrArchiveTooLarge = errors.New("archive expands beyond the allowed size")
+	ErrArchiveTooMany  = errors.New("archive contains too many entries")
+	ErrArchiveLink     = errors.New("links are not extracted")
+)
+
+// ArchiveError is returned when an archive can't be extracted as a whole
+type ArchiveError struct {
+	Code int
+	Err  error
+}
+
+func (e *ArchiveError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ArchiveError) Unwrap() error {
+	return e.Err
+}
+
+// extractLimits defends against archive bombs. Sizes are counted on the
+// bytes actually written, headers claiming a size are never trusted.
+type extractLimits struct {
+	// max total bytes extracted
+	maxBytes int64
+	// max total bytes extracted per archive byte
+	maxRatio int64
+	maxFiles int
+}
+
+func (s *Server) extractLimits() extractLimits {
+	return extractLimits{
+		maxBytes: s.MaxUploadSize * int64(s.ExtractMaxRatio),
+		maxRatio: int64(s.ExtractMaxRatio),
+		maxFiles: s.ExtractMaxFiles,
+	}
+}
+
+// extractCounter counts the bytes extracted from one archive
+type extractCounter struct {
+	limits      extractLimits
+	archiveSize int64
+	total       int64
+}
+
+func (c *extractCounter) copy(dst io.Writer, src io.Reader) error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			c.total += int64(n)
+			if c.limits.maxBytes > 0 && c.total > c.limits.maxBytes {
+				return &ArchiveError{Code: resp.CodeArchiveTooLarge, Err: ErrArchiveTooLarge}
+			}
+			if c.limits.maxRatio > 0 && c.total > c.archiveSize*c.limits.maxRatio {
+				return &ArchiveError{Code: resp.CodeArchiveTooLarge, Err: ErrArchiveTooLarge}
+			}
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return &ArchiveError{Code: resp.CodeArchiveInvalid, Err: err}
+		}
+	}
+}
+
+// stagedEntry is an archive entry already extracted to the staging dir
+type stagedEntry struct {
+	// clean slash separated path inside the archive
+	name    string
+	isDir   bool
+	staged  string
+	modTime time.Time
+	// set when the entry is skipped
+	err error
+}
+
+// detectArchive sniffs the format from the first bytes of the archive
+func detectArchive(f File) (string, error) {
+	head := make([]byte, 512)
+	n, err := f.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	head = head[:n]
+	switch {
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")), bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		return archiveZip, nil
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		return archiveTarGz, nil
+	case len(head) >= 262 && string(head[257:262]) == "ustar":
+		return archiveTar, nil
+	}
+	return "", &ArchiveError{Code: resp.CodeArchiveInvalid, Err: ErrArchiveFormat}
+}
+
+// extractArchive unpacks the zip, tar or tar.gz file at archivePath into
+// destDir. The whole archive is first extracted into the staging dir, so a
+// hostile archive is rejected before anything shows up in destDir. Entries are
+// then placed one by one following strategy, like uploaded files.
+func (s *Server) extractArchive(archivePath, destDir string, strategy NamingStrategy) ([]UploadResult, error) {
+	f, err := s.fs.Open(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	format, err := detectArchive(f)
+	if err != nil {
+		return nil, err
+	}
+
+	stagingDir, err := s.paths.StateDir(stagingStateDir)
+	if err != nil {
+		return nil, err
+	}
+	stageDir, err := s.fs.MkdirTemp(stagingDir, "extract-*")
+	if err != nil {
+		return nil, err
+	}
+	defer s.fs.RemoveAll(stageDir)
+
+	// the staged entries must fit at destDir, replaced files are not
+	// subtracted until the entries are placed
+	res, err := s.quota.reserve(destDir, quotaUsage{}, "")
+	if err != nil {
+		return nil, err
+	}
+	defer res.release()
+
+	x := &archiveExtractor{
+		fs:       s.fs,
+		stageDir: stageDir,
+		counter:  &extractCounter{limits: s.extractLimits(), archiveSize: info.Size()},
+		res:      res,
+	}
+	switch format {
+	case archiveZip:
+		err = x.zip(f, info.Size())
+	case archiveTarGz:
+		var gz *gzip.Reader
+		gz, err = gzip.NewReader(bufio.NewReader(f))
+		if err != nil {
+			return nil, &ArchiveError{Code: resp.CodeArchiveInvalid, Err: err}
+		}
+		err = x.tar(gz)
+	default:
+		err = x.tar(f)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// placing the entries accounts for them one by one
+	res.release()
+	return s.placeExtracted(x.entries, destDir, strategy), nil
+}
+
+type archiveExtractor struct {
+	fs       Storage
+	stageDir string
+	counter  *extractCounter
+	// room held for the staged content
+	res     *quotaReservation
+	entries []stagedEntry
+}
+
+// entry validates an archive entry name, rejecting the whole archive on a
+// path escaping the destination (zip slip)
+func (x *archiveExtractor) entry(name string) (string, error) {
+	if len(x.entries) >= x.counter.limits.maxFiles && x.counter.limits.maxFiles > 0 {
+		return "", &ArchiveError{Code: resp.CodeArchiveTooLarge, Err: ErrArchiveTooMany}
+	}
+	rel, err := cleanRelPath(name)
+	if err != nil {
+		return "", &ArchiveError{Code: resp.CodeArchiveUnsafe, Err: err}
+	}
+	return rel, nil
+}
+
+// stage extracts the content of one file entry
+func (x *archiveExtractor) stage(rel string, modTime time.Time, r io.Reader) error {
+	if err := x.res.grow(quotaUsage{Files: 1}); err != nil {
+		return err
+	}
+	staged := filepath.Join(x.stageDir, strconv.Itoa(len(x.entries)))
+	out, err := x.fs.OpenFile(staged, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	err = x.counter.copy(&quotaWriter{w: out, res: x.res}, r)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	x.entries = append(x.entries, stagedEntry{name: rel, staged: staged, modTime: modTime})
+	return nil
+}
+
+func (x *archiveExtractor) zip(f File, size int64) error {
+	zr, err := zip.NewReader(f, size)
+	if err != nil {
+		return &ArchiveError{Code: resp.CodeArchiveInvalid, Err: err}
+	}
+	for _, zf := range zr.File {
+		rel, err := x.entry(zf.Name)
+		if err != nil {
+			return err
+		}
+		if rel == "" {
+			continue
+		}
+		mode := zf.Mode()
+		switch {
+		case mode.IsDir():
+			x.entries = append(x.entries, stagedEntry{name: rel, isDir: true, modTime: zf.Modified})
+		case mode.IsRegular():
+			rc, err := zf.Open()
+			if err != nil {
+				return &ArchiveError{Code: resp.CodeArchiveInvalid, Err: err}
+			}
+			err = x.stage(rel, zf.Modified, rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+		default:
+			x.entries = append(x.entries, stagedEntry{name: rel, err: ErrArchiveLink})
+		}
+	}
+	return nil
+}
+
+func (x *archiveExtractor) tar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return &ArchiveError{Code: resp.CodeArchiveInvalid, Err: err}
+		}
+		rel, err := x.entry(h.Name)
+		if err != nil {
+			return err
+		}
+		if rel == "" {
+			continue
+		}
+		switch h.Typeflag {
+		case tar.TypeDir:
+			x.entries = append(x.entries, stagedEntry{name: rel, isDir: true, modTime: h.ModTime})
+		case tar.TypeReg:
+			if err := x.stage(rel, h.ModTime, tr); err != nil {
+				return err
+			}
+		case tar.TypeXGlobalHeader:
+			continue
+		default:
+			// symlinks, hard links, devices and fifos
+			x.entries = append(x.entries, stagedEntry{name: rel, err: ErrArchiveLink})
+		}
+	}
+}
+
+// placeExtracted moves the staged entries into destDir
+func (s *Server) placeExtracted(entries []stagedEntry, destDir string, strategy NamingStrategy) []UploadResult {
+	destRel := s.paths.Rel(destDir)
+	results := make([]UploadResult, 0, len(entries))
+	for _, e := range entries {
+		if e.isDir {
+			continue
+		}
+		result := UploadResult{Filename: e.name}
+		if e.err != nil {
+			result.Status = http.StatusUnprocessableEntity
+			result.Error = e.err.Error()
+			result.Code = resp.CodeArchiveUnsafe
+			results = append(results, result)
+			continue
+		}
+
+		dir, err := s.paths.Resolve(path.Join(destRel, path.Dir(e.name)))
+		if err == nil {
+			err = s.fs.MkdirAll(dir, 0755)
+		}
+		var target string
+		if err == nil {
+			target, err = s.paths.ResolveName(dir, path.Base(e.name))
+		}
+		if err == nil {
+			if err = s.fs.Chtimes(e.staged, e.modTime, e.modTime); err != nil {
+				logger.Warn(fmt.Sprintf("failed to keep mtime of %v: %v", e.name, err))
+			}
+			var info os.FileInfo
+			if info, err = s.fs.Stat(e.staged); err == nil {
+				result.Size = info.Size()
+			}
+			target, err = s.placeFile(e.staged, dir, path.Base(e.name), strategy)
+		}
+		if err != nil {
+			result.Status, result.Code, result.Error = entryError(err)
+			results = append(results, result)
+			continue
+		}
+
+		result.Name = filepath.Base(target)
+		result.Path = s.paths.Rel(target)
+		result.Status = http.StatusOK
+		results = append(results, result)
+	}
+
+	// directory entries only matter for empty dirs
+	for _, e := range entries {
+		if !e.isDir {
+			continue
+		}
+		if dir, err := s.paths.Resolve(path.Join(destRel, e.name)); err == nil {
+			if err := s.fs.MkdirAll(dir, 0755); err != nil {
+				logger.Warn(fmt.Sprintf("failed to make dir %v: %v", e.name, err))
+			}
+		}
+	}
+	return results
+}
+
+func entryError(err error) (int, int, string) {
+	var pathErr *PathError
+	switch {
+	case errors.As(err, &pathErr):
+		return pathErr.Status(), pathErr.Code, pathErr.Error()
+	case errors.Is(err, ErrFileExists), errors.Is(err, os.ErrExist):
+		return http.StatusConflict, resp.CodeFileExists, ErrFileExists.Error()
+	case errors.Is(err, ErrQuotaExceeded):
+		return http.StatusInsufficientStorage, resp.CodeQuotaExceeded, err.Error()
+	default:
+		logger.Error(fmt.Sprintf("failed to store entry: %v", err))
+		return http.StatusInternalServerError, resp.CodeNone, "failed to store entry"
+	}
+}
+
+// archiveErrorResponse converts an error returned by extractArchive to a response
+func archiveErrorResponse(err error) resp.Response {
+	if errors.Is(err, ErrQuotaExceeded) {
+		return quotaErrorResponse(err)
+	}
+	var archiveErr *ArchiveError
+	if errors.As(err, &archiveErr) {
+		status := http.StatusBadRequest
+		if archiveErr.Code == resp.CodeArchiveTooLarge {
+			status = http.StatusRequestEntityTooLarge
+		}
+		return errorCodeResponse(status, archiveErr.Code, archiveErr)
+	}
+	logger.Error(fmt.Sprintf("failed to extract archive: %v", err))
+	return errorResponse(http.StatusInternalServerError, errors.New("failed to extract archive"))
+}
+
+// resultsResponse reports per entry results like a multi file upload,
+// 200 when every entry succeeded, 207 otherwise
+func resultsResponse(results []UploadResult, message string) resp.Response {
+	failed := 0
+	for _, result := range results {
+		if result.Error != "" {
+			failed++
+		}
+	}
+	if failed == 0 {
+		return successResponse(http.StatusOK, message, results)
+	}
+	return successResponse(http.StatusMultiStatus, fmt.Sprintf("%d of %d entries failed", failed, len(results)), results)
+}
+
+// extracts an archive already stored in the work dir
+// query params:
+// - path: the archive to extract
+// - distPath: target dir, default to the dir of the archive
+// - naming / overwrite: conflict policy, like uploads
+func (s *Server) extractHandler(w http.ResponseWriter, r *http.Request) resp.Response {
+	archivePath, err := s.paths.Resolve(r.FormValue("path"))
+	if err != nil {
+		logger.Error(fmt.Sprintf("invalid path: %v", err))
+		return pathErrorResponse(err)
+	}
+	info, err := s.fs.Stat(archivePath)
+	if err != nil {
+		logger.Error(fmt.Sprintf("file not found: %v", err))
+		return errorResponse(http.StatusNotFound, errors.New("file not found"))
+	}
+	if info.IsDir() {
+		logger.Error("cannot extract a directory")
+		return errorResponse(http.StatusBadRequest, errors.New("cannot extract a directory"))
+	}
+
+	strategy, err := s.namingStrategy(r)
+	if err != nil {
+		logger.Error(fmt.Sprintf("invalid naming strategy: %v", err))
+		return errorCodeResponse(http.StatusBadRequest, resp.CodeUploadInvalid, err)
+	}
+
+	destDir := filepath.Dir(archivePath)
+	if distPath := r.FormValue("distPath"); distPath != "" {
+		if destDir, err = s.paths.Resolve(distPath); err != nil {
+			logger.Error(fmt.Sprintf("invalid distPath: %v", err))
+			return pathErrorResponse(err)
+		}
+	}
+
+	results, err := s.extractArchive(archivePath, destDir, strategy)
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to extract %v: %v", archivePath, err))
+		return archiveErrorResponse(err)
+	}
+	return resultsResponse(results, "Archive extracted successfully")
+}
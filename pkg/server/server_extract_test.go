@@ -0,0 +1,222 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	resp "httpserver/internal/response"
+	"net/http"
+	"path"
+	"strings"
+	"testing"
+)
+
+type testEntry struct {
+	name, content string
+	// symlink to content
+	link bool
+}
+
+func makeZip(t *testing.T, entries []testEntry) string {
+	t.Helper()
+	var b bytes.Buffer
+	zw := zip.NewWriter(&b)
+	for _, e := range entries {
+		h := &zip.FileHeader{Name: e.name, Method: zip.Deflate}
+		if e.link {
+			h.SetMode(0777 | 1<<27)
+		}
+		w, err := zw.CreateHeader(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(e.content))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+func makeTar(t *testing.T, entries []testEntry, compress bool) string {
+	t.Helper()
+	var b bytes.Buffer
+	var gz *gzip.Writer
+	tw := tar.NewWriter(&b)
+	if compress {
+		gz = gzip.NewWriter(&b)
+		tw = tar.NewWriter(gz)
+	}
+	for _, e := range entries {
+		h := &tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.content)), Typeflag: tar.TypeReg}
+		if e.link {
+			h = &tar.Header{Name: e.name, Linkname: e.content, Typeflag: tar.TypeSymlink}
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if !e.link {
+			tw.Write([]byte(e.content))
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if gz != nil {
+		gz.Close()
+	}
+	return b.String()
+}
+
+// files lists the files under dir recursively
+func (ts *testServer) files(dir string) []string {
+	ts.t.Helper()
+	local, err := ts.s.paths.Resolve(dir)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	entries, err := ts.s.fs.ReadDir(local)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	var files []string
+	for _, e := range entries {
+		if e.IsDir() {
+			files = append(files, ts.files(path.Join(dir, e.Name()))...)
+			continue
+		}
+		files = append(files, path.Join(dir, e.Name()))
+	}
+	return files
+}
+
+func TestExtractLimits(t *testing.T) {
+	valid := []testEntry{{name: "a.txt", content: "a"}, {name: "d/b.txt", content: "b"}}
+	tests := []struct {
+		name      string
+		archive   string
+		maxRatio  int
+		maxFiles  int
+		query     string
+		status    int
+		errorCode int
+		// stored under out, path to content
+		want map[string]string
+		// per entry status of a 207
+		statuses []int
+	}{
+		{name: "zip", archive: makeZip(t, valid), status: http.StatusOK, want: map[string]string{"a.txt": "a", "d/b.txt": "b"}},
+		{name: "tar", archive: makeTar(t, valid, false), status: http.StatusOK, want: map[string]string{"a.txt": "a", "d/b.txt": "b"}},
+		{name: "tar.gz", archive: makeTar(t, valid, true), status: http.StatusOK, want: map[string]string{"a.txt": "a", "d/b.txt": "b"}},
+		{name: "not an archive", archive: "plain text", status: http.StatusBadRequest, errorCode: resp.CodeArchiveInvalid},
+		{
+			name:     "zip bomb",
+			archive:  makeZip(t, []testEntry{{name: "zeros", content: strings.Repeat("\x00", 1<<20)}}),
+			maxRatio: 10, status: http.StatusRequestEntityTooLarge, errorCode: resp.CodeArchiveTooLarge,
+		},
+		{
+			name:     "tar.gz bomb",
+			archive:  makeTar(t, []testEntry{{name: "zeros", content: strings.Repeat("\x00", 1<<20)}}, true),
+			maxRatio: 10, status: http.StatusRequestEntityTooLarge, errorCode: resp.CodeArchiveTooLarge,
+		},
+		{
+			name:     "within ratio",
+			archive:  makeZip(t, []testEntry{{name: "zeros", content: strings.Repeat("\x00", 1<<10)}}),
+			maxRatio: 10, status: http.StatusOK, want: map[string]string{"zeros": strings.Repeat("\x00", 1<<10)},
+		},
+		{
+			name:     "too many files",
+			archive:  makeZip(t, append(valid, testEntry{name: "c.txt", content: "c"})),
+			maxFiles: 2, status: http.StatusRequestEntityTooLarge, errorCode: resp.CodeArchiveTooLarge,
+		},
+		{name: "max files", archive: makeZip(t, valid), maxFiles: 2, status: http.StatusOK, want: map[string]string{"a.txt": "a", "d/b.txt": "b"}},
+		{
+			name:    "zip slip",
+			archive: makeZip(t, append(valid, testEntry{name: "../evil.txt", content: "evil"})),
+			status:  http.StatusBadRequest, errorCode: resp.CodeArchiveUnsafe,
+		},
+		{
+			name:    "tar slip",
+			archive: makeTar(t, append(valid, testEntry{name: "d/../../evil.txt", content: "evil"}), false),
+			status:  http.StatusBadRequest, errorCode: resp.CodeArchiveUnsafe,
+		},
+		{
+			name:    "backslash slip",
+			archive: makeZip(t, append(valid, testEntry{name: `..\evil.txt`, content: "evil"})),
+			status:  http.StatusBadRequest, errorCode: resp.CodeArchiveUnsafe,
+		},
+		{
+			name:    "state dir",
+			archive: makeTar(t, append(valid, testEntry{name: stateDirName + "/evil.txt", content: "evil"}), false),
+			status:  http.StatusBadRequest, errorCode: resp.CodeArchiveUnsafe,
+		},
+		{
+			// kept under the destination
+			name:    "absolute",
+			archive: makeTar(t, []testEntry{{name: "/etc/evil.txt", content: "evil"}}, false),
+			status:  http.StatusOK, want: map[string]string{"etc/evil.txt": "evil"},
+		},
+		{
+			name:    "symlink",
+			archive: makeTar(t, append(valid, testEntry{name: "link", content: "/etc/passwd", link: true}), false),
+			status:  http.StatusMultiStatus, want: map[string]string{"a.txt": "a", "d/b.txt": "b"},
+			statuses: []int{200, 200, http.StatusUnprocessableEntity},
+		},
+		{
+			name:    "zip symlink",
+			archive: makeZip(t, append(valid, testEntry{name: "link", content: "/etc/passwd", link: true})),
+			status:  http.StatusMultiStatus, want: map[string]string{"a.txt": "a", "d/b.txt": "b"},
+			statuses: []int{200, 200, http.StatusUnprocessableEntity},
+		},
+		{
+			name:    "conflict",
+			archive: makeZip(t, []testEntry{{name: "old.txt", content: "new"}, {name: "a.txt", content: "a"}}),
+			status:  http.StatusMultiStatus, want: map[string]string{"old.txt": "old", "a.txt": "a"},
+			statuses: []int{http.StatusConflict, 200},
+		},
+		{
+			name:    "conflict suffix",
+			archive: makeZip(t, []testEntry{{name: "old.txt", content: "new"}}),
+			query:   "&naming=suffix", status: http.StatusOK, want: map[string]string{"old.txt": "old", "old (1).txt": "new"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := ServerConfig{ExtractMaxRatio: tt.maxRatio, ExtractMaxFiles: tt.maxFiles}
+			forEachStorage(t, config, func(t *testing.T, ts *testServer) {
+				ts.upload("", map[string]string{"archive": tt.archive}, "", http.StatusOK)
+				ts.upload("out", map[string]string{"old.txt": "old"}, "", http.StatusOK)
+
+				var results []UploadResult
+				target := "/extract?path=archive&distPath=out" + tt.query
+				res := ts.call("POST", target, tt.status, &results)
+				if res.ErrorCode != tt.errorCode {
+					t.Fatalf("error code %d; want %d", res.ErrorCode, tt.errorCode)
+				}
+				for i, status := range tt.statuses {
+					if i >= len(results) || results[i].Status != status {
+						t.Fatalf("results %+v; want statuses %v", results, tt.statuses)
+					}
+				}
+
+				// a rejected archive leaves nothing behind
+				want := map[string]string{"old.txt": "old"}
+				for name, content := range tt.want {
+					want[name] = content
+				}
+				if files := ts.files("out"); len(files) != len(want) {
+					t.Fatalf("extracted %q; want %v", files, want)
+				}
+				for name, content := range want {
+					if got := ts.content("out/" + name); got != content {
+						t.Fatalf("%s = %q; want %q", name, got, content)
+					}
+				}
+				if ts.exists("evil.txt") {
+					t.Fatal("entry escaped the destination")
+				}
+			})
+		})
+	}
+}
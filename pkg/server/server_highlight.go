@@ -0,0 +1,288 @@
+package server
+
+import (
+	"html/template"
+	"path/filepath"
+	"strings"
+)
+
+// highlightLang describes the tokens of a language family well enough to
+// color comments, strings, numbers and keywords of a preview. It is not a
+// parser, unusual constructs are just left plain.
+type highlightLang struct {
+	lineComments  []string
+	blockComments [][2]string
+	// quote characters
+	quotes string
+	// """ and ''' strings
+	tripleQuotes bool
+	keywords     map[string]bool
+	// keywords match in any case
+	foldCase bool
+}
+
+// words builds a keyword set
+func words(s string) map[string]bool {
+	m := make(map[string]bool)
+	for _, w := range strings.Fields(s) {
+		m[w] = true
+	}
+	return m
+}
+
+var (
+	langGo = &highlightLang{
+		lineComments:  []string{"//"},
+		blockComments: [][2]string{{"/*", "*/"}},
+		quotes:        "\"'`",
+		keywords: words(`break case chan const continue default defer else fallthrough for func go goto if
+			import interface map package range return select struct switch type var
+			nil true false iota`),
+	}
+	langC = &highlightLang{
+		lineComments:  []string{"//"},
+		blockComments: [][2]string{{"/*", "*/"}},
+		quotes:        "\"'",
+		keywords: words(`auto break case char class const continue default delete do double else enum
+			extern final float for fn if impl import int let long match mod mut namespace new null
+			nullptr package private protected pub public return short signed sizeof static struct
+			super switch template this throw throws try typedef union unsigned use using virtual void
+			volatile while true false boolean byte extends implements interface catch finally`),
+	}
+	langJS = &highlightLang{
+		lineComments:  []string{"//"},
+		blockComments: [][2]string{{"/*", "*/"}},
+		quotes:        "\"'`",
+		keywords: words(`async await break case catch class const continue debugger default delete do
+			else export extends finally for from function if import in instanceof let new of return
+			static super switch this throw try typeof var void while yield null undefined true false
+			interface type enum implements`),
+	}
+	langPython = &highlightLang{
+		lineComments: []string{"#"},
+		quotes:       "\"'",
+		tripleQuotes: true,
+		keywords: words(`and as assert async await break class continue def del elif else except
+			finally for from global if import in is lambda nonlocal not or pass raise return try
+			while with yield None True False self`),
+	}
+	langShell = &highlightLang{
+		lineComments: []string{"#"},
+		quotes:       "\"'",
+		keywords: words(`case do done elif else esac export fi for function if in local read
+			return select then until while echo set unset`),
+	}
+	langSQL = &highlightLang{
+		lineComments:  []string{"--"},
+		blockComments: [][2]string{{"/*", "*/"}},
+		quotes:        "\"'",
+		foldCase:      true,
+		keywords: words(`select from where and or not insert into values update set delete create
+			table drop alter index primary key foreign references join left right inner outer on
+			group by order having limit offset as distinct null is in like between union all case
+			when then else end`),
+	}
+	langMarkup = &highlightLang{
+		blockComments: [][2]string{{"<!--", "-->"}},
+		quotes:        "\"",
+	}
+	langCSS = &highlightLang{
+		blockComments: [][2]string{{"/*", "*/"}},
+		quotes:        "\"'",
+	}
+	langConfig = &highlightLang{
+		lineComments: []string{"#", ";"},
+		quotes:       "\"'",
+		keywords:     words(`true false null yes no on off`),
+	}
+	langJSON = &highlightLang{
+		quotes:   "\"",
+		keywords: words(`true false null`),
+	}
+)
+
+// highlightLangs maps file extensions to their language
+var highlightLangs = map[string]*highlightLang{
+	".go":   langGo,
+	".c":    langC,
+	".h":    langC,
+	".cc":   langC,
+	".cpp":  langC,
+	".hpp":  langC,
+	".java": langC,
+	".kt":   langC,
+	".cs":   langC,
+	".rs":   langC,
+	".js":   langJS,
+	".mjs":  langJS,
+	".ts":   langJS,
+	".jsx":  langJS,
+	".tsx":  langJS,
+	".py":   langPython,
+	".sh":   langShell,
+	".bash": langShell,
+	".sql":  langSQL,
+	".html": langMarkup,
+	".htm":  langMarkup,
+	".xml":  langMarkup,
+	".css":  langCSS,
+	".yaml": langConfig,
+	".yml":  langConfig,
+	".toml": langConfig,
+	".ini":  langConfig,
+	".conf": langConfig,
+	".json": langJSON,
+}
+
+// highlight returns the lines of src as HTML, tokens wrapped in spans of
+// class c (comment), s (string), n (number) or k (keyword) for the language
+// of name. Files of unknown languages are only escaped.
+func highlight(name, src string) []template.HTML {
+	lang := highlightLangs[strings.ToLower(filepath.Ext(name))]
+	h := &highlighter{}
+	if lang == nil {
+		h.emit("", src)
+	} else {
+		h.run(lang, src)
+	}
+	h.endLine()
+	return h.lines
+}
+
+type highlighter struct {
+	lines []template.HTML
+	line  strings.Builder
+}
+
+// emit writes text as a token of class, a token spanning lines is closed
+// and reopened so every line stands on its own
+func (h *highlighter) emit(class, text string) {
+	for {
+		part, rest, more := strings.Cut(text, "\n")
+		if part != "" {
+			if class != "" {
+				h.line.WriteString(`<span class="` + class + `">`)
+			}
+			h.line.WriteString(template.HTMLEscapeString(part))
+			if class != "" {
+				h.line.WriteString("</span>")
+			}
+		}
+		if !more {
+			return
+		}
+		h.endLine()
+		text = rest
+	}
+}
+
+func (h *highlighter) endLine() {
+	h.lines = append(h.lines, template.HTML(h.line.String()))
+	h.line.Reset()
+}
+
+func (h *highlighter) run(lang *highlightLang, src string) {
+	plain := 0
+	flush := func(i int) {
+		if plain < i {
+			h.emit("", src[plain:i])
+		}
+	}
+	for i := 0; i < len(src); {
+		rest := src[i:]
+		class, n := lang.token(rest)
+		if n == 0 {
+			// identifiers and numbers are consumed whole, anything else by the byte
+			if isIdentByte(rest[0]) {
+				n = 1
+				for n < len(rest) && (isIdentByte(rest[n]) || isDigit(rest[n])) {
+					n++
+				}
+			} else if isDigit(rest[0]) {
+				class, n = "n", 1
+				for n < len(rest) && (isIdentByte(rest[n]) || isDigit(rest[n]) || rest[n] == '.') {
+					n++
+				}
+			} else {
+				i++
+				continue
+			}
+		}
+		if class == "" {
+			word := rest[:n]
+			if lang.foldCase {
+				word = strings.ToLower(word)
+			}
+			if lang.keywords[word] {
+				class = "k"
+			}
+		}
+		if class == "" {
+			i += n
+			continue
+		}
+		flush(i)
+		h.emit(class, rest[:n])
+		i += n
+		plain = i
+	}
+	flush(len(src))
+}
+
+// token returns the length of the comment or string starting rest, 0 if none
+func (lang *highlightLang) token(rest string) (string, int) {
+	for _, c := range lang.lineComments {
+		if strings.HasPrefix(rest, c) {
+			n := strings.IndexByte(rest, '\n')
+			if n < 0 {
+				n = len(rest)
+			}
+			return "c", n
+		}
+	}
+	for _, c := range lang.blockComments {
+		if strings.HasPrefix(rest, c[0]) {
+			n := strings.Index(rest[len(c[0]):], c[1])
+			if n < 0 {
+				return "c", len(rest)
+			}
+			return "c", len(c[0]) + n + len(c[1])
+		}
+	}
+	if strings.IndexByte(lang.quotes, rest[0]) < 0 {
+		return "", 0
+	}
+	q := rest[0]
+	if lang.tripleQuotes && strings.HasPrefix(rest, strings.Repeat(string(q), 3)) {
+		delim := rest[:3]
+		n := strings.Index(rest[3:], delim)
+		if n < 0 {
+			return "s", len(rest)
+		}
+		return "s", 3 + n + 3
+	}
+	for n := 1; n < len(rest); n++ {
+		switch rest[n] {
+		case '\\':
+			n++
+		case q:
+			return "s", n + 1
+		case '\n':
+			// only backquoted strings span lines
+			if q != '`' {
+				return "s", n
+			}
+		}
+	}
+	return "s", len(rest)
+}
+
+// isIdentByte reports whether c can start an identifier, bytes of non-ASCII
+// characters included so they are never split
+func isIdentByte(c byte) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c >= 0x80
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
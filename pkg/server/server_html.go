@@ -1,14 +1,13 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	"html/template"
 	logger "httpserver/pkg/log"
 	"httpserver/pkg/utils"
-	"io"
 	"log"
 	"net/http"
-	"os"
 	"path/filepath"
 	"sort"
 	"strings"
@@ -20,15 +19,25 @@ type FileItem struct {
 	Name  string
 	Href  string
 	IsDir bool
+	// a JPEG, PNG or GIF shown as a thumbnail in the grid view
+	IsImage bool
+	// number of kept previous contents
+	Versions int
 }
 
 type PageData struct {
 	Path  string
 	Items []FileItem
+	// README of the directory shown below the list
+	ReadmeName string
+	Readme     template.HTML
 }
 
 // 修改模板路径
-var dirTemplate *template.Template
+var (
+	dirTemplate     *template.Template
+	previewTemplate *template.Template
+)
 
 func init() {
 	rootDir, err := utils.GetProjectRoot()
@@ -37,14 +46,24 @@ func init() {
 	}
 
 	dirTemplate = template.Must(template.ParseFiles(filepath.Join(rootDir, "index.html")))
+	previewTemplate = template.Must(template.ParseFiles(filepath.Join(rootDir, "preview.html")))
 }
 
 func (s *Server) BrowserGetHandler(w http.ResponseWriter, r *http.Request) {
-	reqPath := mux.Vars(r)["path"]
-	reqPath = strings.TrimPrefix(reqPath, "/")
-	localPath := filepath.Join(s.WorkDir, reqPath)
+	localPath, err := s.paths.Resolve(mux.Vars(r)["path"])
+	if err != nil {
+		logger.Error(fmt.Sprintf("invalid path: %v", err))
+		var pathErr *PathError
+		if errors.As(err, &pathErr) {
+			http.Error(w, pathErr.Error(), pathErr.Status())
+		} else {
+			http.Error(w, "failed to resolve path", http.StatusInternalServerError)
+		}
+		return
+	}
+	reqPath := s.paths.Rel(localPath)
 
-	info, err := os.Stat(localPath)
+	info, err := s.fs.Stat(localPath)
 	if err != nil {
 		logger.Error(fmt.Sprintf("file not exit or no auth: %v", err))
 		http.Error(w, "file not exit or no auth", http.StatusBadRequest)
@@ -52,7 +71,7 @@ func (s *Server) BrowserGetHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if info.IsDir() {
-		files, err := os.ReadDir(localPath)
+		files, err := s.fs.ReadDir(localPath)
 		if err != nil {
 			logger.Error(fmt.Sprintf("failed to open directory: %v", err))
 			http.Error(w, "failed to open directory", http.StatusBadRequest)
@@ -77,6 +96,9 @@ func (s *Server) BrowserGetHandler(w http.ResponseWriter, r *http.Request) {
 
 		for _, f := range files {
 			name := f.Name()
+			if reqPath == "" && name == stateDirName {
+				continue
+			}
 			var href string
 			if reqPath == "" {
 				href = "/" + name
@@ -84,20 +106,29 @@ func (s *Server) BrowserGetHandler(w http.ResponseWriter, r *http.Request) {
 				href = "/" + filepath.Join(reqPath, name)
 			}
 			href = strings.ReplaceAll(href, "\\", "/")
-			items = append(items, FileItem{
+			item := FileItem{
 				Name:  name,
 				Href:  href,
 				IsDir: f.IsDir(),
-			})
+			}
+			if !item.IsDir {
+				item.IsImage = isImageName(name)
+				item.Versions = s.versions.count(filepath.Join(localPath, name))
+			}
+			items = append(items, item)
 		}
 
 		sort.Slice(items, func(i, j int) bool {
 			return items[i].IsDir && !items[j].IsDir
 		})
 
+		readmeName, readme := s.readme(localPath, files)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 		err = dirTemplate.Execute(w, PageData{
-			Path:  reqPath,
-			Items: items,
+			Path:       reqPath,
+			Items:      items,
+			ReadmeName: readmeName,
+			Readme:     readme,
 		})
 		if err != nil {
 			logger.Error(fmt.Sprintf("failed to execute template: %v", err))
@@ -105,19 +136,6 @@ func (s *Server) BrowserGetHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	} else {
-		// 提供文件下载
-		w.Header().Set("Content-Disposition", "attachment;")
-		file, err := os.Open(localPath)
-		if err != nil {
-			logger.Error(fmt.Sprintf("failed to open file: %v", err))
-			http.Error(w, "failed to open file", http.StatusInternalServerError)
-			return
-		}
-		_, err = io.Copy(w, file)
-		if err != nil {
-			logger.Error(fmt.Sprintf("failed to copy file: %v", err))
-			http.Error(w, "failed to write file", http.StatusInternalServerError)
-			return
-		}
+		s.serveBrowserFile(w, r, localPath, info)
 	}
 }
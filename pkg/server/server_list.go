@@ -0,0 +1,339 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	resp "httpserver/internal/response"
+	logger "httpserver/pkg/log"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// FileEntry is the metadata of a file or directory
+type FileEntry struct {
+	Name string `json:"name"`
+	// path relative to workDir
+	Path    string    `json:"path"`
+	IsDir   bool      `json:"is_dir"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	// unix permission string, e.g. "-rw-r--r--"
+	Mode     string `json:"mode"`
+	MimeType string `json:"mime_type,omitempty"`
+	// set for symlinks to the path of their target relative to workDir, size
+	// and type then describe the target
+	SymlinkTarget string `json:"symlink_target,omitempty"`
+	// set for symlinks whose target is missing or outside the work dir
+	SymlinkExternal bool `json:"symlink_external,omitempty"`
+	// number of entries of a directory
+	ChildCount *int `json:"child_count,omitempty"`
+}
+
+// ListResult is a page of a directory listing
+type ListResult struct {
+	// path relative to workDir
+	Path    string      `json:"path"`
+	Entries []FileEntry `json:"entries"`
+	// number of entries matching the filter, all pages included
+	Total int `json:"total"`
+	// pass as cursor to get the next page, empty on the last page
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// fileEntry builds the metadata of local, info comes from os.Lstat
+func (s *Server) fileEntry(local string, info os.FileInfo) FileEntry {
+	entry := FileEntry{
+		Name:    info.Name(),
+		Path:    s.paths.Rel(local),
+		IsDir:   info.IsDir(),
+		Size:    info.Size(),
+		ModTime: info.ModTime().UTC(),
+		Mode:    info.Mode().String(),
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		// only describe targets inside the work dir, the raw link may hold
+		// paths of the host
+		target, ok := s.symlinkTarget(local)
+		if !ok {
+			entry.SymlinkExternal = true
+			return entry
+		}
+		entry.SymlinkTarget = target
+		if targetInfo, err := s.fs.Stat(local); err == nil {
+			entry.IsDir = targetInfo.IsDir()
+			entry.Size = targetInfo.Size()
+			entry.ModTime = targetInfo.ModTime().UTC()
+		}
+	}
+
+	if entry.IsDir {
+		entry.Size = 0
+		if children, err := s.fs.ReadDir(local); err == nil {
+			count := len(children)
+			if s.paths.IsRoot(local) {
+				for _, c := range children {
+					if c.Name() == stateDirName {
+						count--
+					}
+				}
+			}
+			entry.ChildCount = &count
+		}
+	} else {
+		entry.MimeType = detectMimeType(s.fs, local, entry.Name)
+	}
+	return entry
+}
+
+// symlinkTarget returns the path of what the link at local points to relative
+// to root, false when it is missing, outside root or in the state dir
+func (s *Server) symlinkTarget(local string) (string, bool) {
+	root, err := s.paths.Root()
+	if err != nil {
+		return "", false
+	}
+	real, err := s.fs.EvalSymlinks(local)
+	if err != nil || !within(root, real) || isStateDir(root, real) {
+		return "", false
+	}
+	return s.paths.Rel(real), true
+}
+
+// detectMimeType guesses the type from the extension, then from the content
+func detectMimeType(fsys Storage, local, name string) string {
+	if t := mime.TypeByExtension(filepath.Ext(name)); t != "" {
+		return t
+	}
+	f, err := fsys.Open(local)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return ""
+	}
+	return http.DetectContentType(buf[:n])
+}
+
+// listItem is a directory entry being sorted
+type listItem struct {
+	name    string
+	isDir   bool
+	size    int64
+	modTime int64
+}
+
+// listCursor remembers the last entry of a page, the next page starts right
+// after it in the same order, so concurrent changes don't shift pages
+type listCursor struct {
+	Sort    string `json:"s"`
+	Desc    bool   `json:"d"`
+	Name    string `json:"n"`
+	IsDir   bool   `json:"dir"`
+	Size    int64  `json:"sz"`
+	ModTime int64  `json:"mt"`
+}
+
+func encodeListCursor(c listCursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeListCursor(s string) (listCursor, error) {
+	c := listCursor{}
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(b, &c)
+	return c, err
+}
+
+// listLess orders directories first, then by field, then by name
+func listLess(field string, desc bool) func(a, b listItem) bool {
+	return func(a, b listItem) bool {
+		if a.isDir != b.isDir {
+			return a.isDir
+		}
+		var cmp int
+		switch field {
+		case "size":
+			cmp = compareInt(a.size, b.size)
+		case "mtime":
+			cmp = compareInt(a.modTime, b.modTime)
+		}
+		if cmp == 0 {
+			cmp = strings.Compare(a.name, b.name)
+		}
+		if desc {
+			return cmp > 0
+		}
+		return cmp < 0
+	}
+}
+
+func compareInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// lists a directory as json
+// query params:
+// - path: the directory to list, default to workDir
+// - sort: name (default), size or mtime, directories always come first
+// - order: asc (default) or desc
+// - glob: only entries whose name matches, e.g. "*.tar.gz"
+// - limit: page size, default 100, at most 1000
+// - cursor: next_cursor of the previous page
+func (s *Server) listHandler(w http.ResponseWriter, r *http.Request) resp.Response {
+	q := r.URL.Query()
+	localPath, err := s.paths.Resolve(q.Get("path"))
+	if err != nil {
+		logger.Error(fmt.Sprintf("invalid path: %v", err))
+		return pathErrorResponse(err)
+	}
+
+	field := q.Get("sort")
+	if field == "" {
+		field = "name"
+	}
+	if field != "name" && field != "size" && field != "mtime" {
+		logger.Error(fmt.Sprintf("invalid sort: %q", field))
+		return errorResponse(http.StatusBadRequest, fmt.Errorf("invalid sort: %q", field))
+	}
+	var desc bool
+	switch q.Get("order") {
+	case "", "asc":
+	case "desc":
+		desc = true
+	default:
+		logger.Error(fmt.Sprintf("invalid order: %q", q.Get("order")))
+		return errorResponse(http.StatusBadRequest, fmt.Errorf("invalid order: %q", q.Get("order")))
+	}
+	glob := q.Get("glob")
+	if _, err := path.Match(glob, ""); err != nil {
+		logger.Error(fmt.Sprintf("invalid glob: %q", glob))
+		return errorResponse(http.StatusBadRequest, fmt.Errorf("invalid glob: %q", glob))
+	}
+	limit := defaultListLimit
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			logger.Error(fmt.Sprintf("invalid limit: %q", v))
+			return errorResponse(http.StatusBadRequest, fmt.Errorf("invalid limit: %q", v))
+		}
+		limit = min(limit, maxListLimit)
+	}
+	var cursor *listCursor
+	if v := q.Get("cursor"); v != "" {
+		c, err := decodeListCursor(v)
+		if err != nil || c.Sort != field || c.Desc != desc {
+			logger.Error(fmt.Sprintf("invalid cursor: %q", v))
+			return errorResponse(http.StatusBadRequest, errors.New("invalid cursor"))
+		}
+		cursor = &c
+	}
+
+	info, err := s.fs.Stat(localPath)
+	if err != nil {
+		logger.Error(fmt.Sprintf("file not found: %v", err))
+		return errorCodeResponse(http.StatusNotFound, resp.CodeNotFound, errors.New("file not found"))
+	}
+	if !info.IsDir() {
+		logger.Error("not a directory")
+		return errorResponse(http.StatusBadRequest, errors.New("not a directory"))
+	}
+
+	dirEntries, err := s.fs.ReadDir(localPath)
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to open directory: %v", err))
+		return errorResponse(http.StatusInternalServerError, errors.New("failed to open directory"))
+	}
+
+	isRoot := s.paths.IsRoot(localPath)
+	items := make([]listItem, 0, len(dirEntries))
+	for _, d := range dirEntries {
+		if isRoot && d.Name() == stateDirName {
+			continue
+		}
+		if glob != "" {
+			if ok, _ := path.Match(glob, d.Name()); !ok {
+				continue
+			}
+		}
+		item := listItem{name: d.Name(), isDir: d.IsDir()}
+		if field != "name" || d.Type()&os.ModeSymlink != 0 {
+			local := filepath.Join(localPath, d.Name())
+			fi, err := d.Info()
+			// symlinks sort like their target when it is inside the work dir
+			if _, rerr := s.paths.Resolve(s.paths.Rel(local)); rerr == nil && d.Type()&os.ModeSymlink != 0 {
+				if target, serr := s.fs.Stat(local); serr == nil {
+					fi, err = target, nil
+				}
+			}
+			if err != nil {
+				continue
+			}
+			item.isDir = fi.IsDir()
+			item.size = fi.Size()
+			item.modTime = fi.ModTime().UnixNano()
+		}
+		items = append(items, item)
+	}
+
+	less := listLess(field, desc)
+	sort.Slice(items, func(i, j int) bool { return less(items[i], items[j]) })
+
+	start := 0
+	if cursor != nil {
+		last := listItem{name: cursor.Name, isDir: cursor.IsDir, size: cursor.Size, modTime: cursor.ModTime}
+		start = sort.Search(len(items), func(i int) bool { return less(last, items[i]) })
+	}
+	end := min(start+limit, len(items))
+
+	result := ListResult{
+		Path:    s.paths.Rel(localPath),
+		Entries: make([]FileEntry, 0, end-start),
+		Total:   len(items),
+	}
+	for _, item := range items[start:end] {
+		local := filepath.Join(localPath, item.name)
+		fi, err := s.fs.Lstat(local)
+		if err != nil {
+			// removed meanwhile
+			continue
+		}
+		result.Entries = append(result.Entries, s.fileEntry(local, fi))
+	}
+	if end < len(items) {
+		last := items[end-1]
+		result.NextCursor = encodeListCursor(listCursor{
+			Sort: field, Desc: desc,
+			Name: last.name, IsDir: last.isDir, Size: last.size, ModTime: last.modTime,
+		})
+	}
+
+	return successResponse(http.StatusOK, "List successfully", result)
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestListSymlinkTargets(t *testing.T) {
+	tests := []struct {
+		name string
+		// link target, absolute ones are joined to root or its parent
+		target   string
+		outside  bool
+		want     string
+		external bool
+	}{
+		{name: "relative", target: filepath.Join("..", "f.txt"), want: "f.txt"},
+		{name: "absolute inside", target: filepath.Join("d", "f.txt"), want: "d/f.txt"},
+		{name: "outside", target: "secret.txt", outside: true, external: true},
+		{name: "dangling", target: "missing.txt", external: true},
+		{name: "state dir", target: stateDirName, external: true},
+	}
+	forEachStorage(t, ServerConfig{}, func(t *testing.T, ts *testServer) {
+		root, _ := ts.s.paths.Root()
+		outside := filepath.Join(filepath.Dir(root), "secret.txt")
+		if err := writeFile(ts.s.fs, outside, []byte("secret"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		ts.upload("", map[string]string{"f.txt": "f"}, "", http.StatusOK)
+		ts.upload("d", map[string]string{"f.txt": "f"}, "", http.StatusOK)
+		ts.s.paths.StateDir("x")
+		for _, tt := range tests {
+			target := tt.target
+			switch {
+			case tt.outside:
+				target = outside
+			case tt.name != "relative":
+				target = filepath.Join(root, target)
+			}
+			if err := ts.s.fs.Symlink(target, filepath.Join(root, "d", tt.name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		w := ts.do("GET", "/list?path=d", nil, "")
+		if body := w.Body.String(); strings.Contains(body, outside) || strings.Contains(body, root) {
+			t.Fatalf("listing leaks host paths: %s", body)
+		}
+		var list ListResult
+		ts.decode(w, "GET", "/list?path=d", http.StatusOK, &list)
+		entries := make(map[string]FileEntry)
+		for _, e := range list.Entries {
+			entries[e.Name] = e
+		}
+		for _, tt := range tests {
+			e := entries[tt.name]
+			if e.SymlinkTarget != tt.want || e.SymlinkExternal != tt.external {
+				t.Errorf("%s: target %q, external %v; want %q, %v", tt.name, e.SymlinkTarget, e.SymlinkExternal, tt.want, tt.external)
+			}
+		}
+	})
+}
@@ -0,0 +1,596 @@
+package server
+
+import (
+	"fmt"
+	"html/template"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// renderMarkdown converts the common subset of Markdown used in READMEs to
+// HTML: ATX headings, paragraphs, emphasis, code spans and fenced or
+// indented code blocks, block quotes, nested lists, rules, links, images and
+// GFM tables. Raw HTML is not supported, all text is escaped and links may
+// only be http, https, mailto or relative, so an uploaded README can't run
+// scripts. Relative links are resolved against base, the URL of the dir.
+func renderMarkdown(src, base string) template.HTML {
+	src = strings.ReplaceAll(src, "\r\n", "\n")
+	// NUL marks hard line breaks while rendering
+	src = strings.ReplaceAll(src, "\x00", "")
+	src = strings.ReplaceAll(src, "\t", "    ")
+	r := &markdownRenderer{base: base}
+	r.blocks(strings.Split(src, "\n"))
+	return template.HTML(r.b.String())
+}
+
+type markdownRenderer struct {
+	b    strings.Builder
+	base string
+	// nesting of the blocks and spans being rendered
+	depth int
+}
+
+// mdMaxNesting bounds nested quotes, lists and spans, deeper ones are left as
+// text so a crafted README can't make rendering quadratic
+const mdMaxNesting = 16
+
+var (
+	mdHeading   = regexp.MustCompile(`^ {0,3}(#{1,6})(?:[ ]+(.*?))?(?:[ ]+#+)?[ ]*$`)
+	mdRule      = regexp.MustCompile(`^ {0,3}(?:(?:-[ ]*){3,}|(?:\*[ ]*){3,}|(?:_[ ]*){3,})$`)
+	mdFence     = regexp.MustCompile("^( {0,3})(`{3,}|~{3,})[ ]*([^`\\s]*)")
+	mdListItem  = regexp.MustCompile(`^( {0,3})([-*+]|\d{1,9}[.)])( +|$)`)
+	mdTableSep  = regexp.MustCompile(`^ {0,3}\|?[ ]*:?-+:?[ ]*(?:\|[ ]*:?-+:?[ ]*)*\|?[ ]*$`)
+	mdHardBreak = regexp.MustCompile(`(?: {2,}|\\)\n`)
+)
+
+func isBlank(line string) bool {
+	return strings.TrimSpace(line) == ""
+}
+
+// startsBlock reports whether line interrupts a paragraph
+func startsBlock(line string) bool {
+	return mdHeading.MatchString(line) || mdRule.MatchString(line) || mdFence.MatchString(line) ||
+		strings.HasPrefix(strings.TrimLeft(line, " "), ">") || mdListItem.MatchString(line)
+}
+
+func (r *markdownRenderer) blocks(lines []string) {
+	if r.depth >= mdMaxNesting {
+		r.b.WriteString("<p>" + template.HTMLEscapeString(strings.Join(lines, "\n")) + "</p>\n")
+		return
+	}
+	r.depth++
+	defer func() { r.depth-- }()
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		switch {
+		case isBlank(line):
+			i++
+		case mdFence.MatchString(line):
+			i = r.fencedCode(lines, i)
+		case mdHeading.MatchString(line):
+			m := mdHeading.FindStringSubmatch(line)
+			fmt.Fprintf(&r.b, "<h%d>%s</h%d>\n", len(m[1]), r.inline(m[2]), len(m[1]))
+			i++
+		case mdRule.MatchString(line):
+			r.b.WriteString("<hr>\n")
+			i++
+		case strings.HasPrefix(strings.TrimLeft(line, " "), ">"):
+			i = r.blockquote(lines, i)
+		case mdListItem.MatchString(line):
+			i = r.list(lines, i)
+		case strings.HasPrefix(line, "    "):
+			i = r.indentedCode(lines, i)
+		case strings.Contains(line, "|") && i+1 < len(lines) && mdTableSep.MatchString(lines[i+1]) && strings.Contains(lines[i+1], "-"):
+			i = r.table(lines, i)
+		default:
+			i = r.paragraph(lines, i)
+		}
+	}
+}
+
+func (r *markdownRenderer) fencedCode(lines []string, i int) int {
+	m := mdFence.FindStringSubmatch(lines[i])
+	indent, fence, lang := len(m[1]), m[2], m[3]
+	var code []string
+	for i++; i < len(lines); i++ {
+		trimmed := strings.TrimSpace(lines[i])
+		if strings.HasPrefix(trimmed, fence) && strings.Trim(trimmed, fence[:1]) == "" {
+			i++
+			break
+		}
+		// the content loses up to the indent of the fence
+		line := lines[i]
+		for n := 0; n < indent && strings.HasPrefix(line, " "); n++ {
+			line = line[1:]
+		}
+		code = append(code, line)
+	}
+	r.code(code, lang)
+	return i
+}
+
+func (r *markdownRenderer) indentedCode(lines []string, i int) int {
+	var code []string
+	for ; i < len(lines); i++ {
+		if strings.HasPrefix(lines[i], "    ") {
+			code = append(code, lines[i][4:])
+		} else if isBlank(lines[i]) {
+			code = append(code, "")
+		} else {
+			break
+		}
+	}
+	// trailing blank lines belong to no block
+	for len(code) > 0 && code[len(code)-1] == "" {
+		code = code[:len(code)-1]
+	}
+	r.code(code, "")
+	return i
+}
+
+func (r *markdownRenderer) code(lines []string, lang string) {
+	r.b.WriteString("<pre><code")
+	if lang != "" {
+		r.b.WriteString(` class="language-` + template.HTMLEscapeString(lang) + `"`)
+	}
+	r.b.WriteString(">")
+	for _, line := range lines {
+		r.b.WriteString(template.HTMLEscapeString(line) + "\n")
+	}
+	r.b.WriteString("</code></pre>\n")
+}
+
+func (r *markdownRenderer) blockquote(lines []string, i int) int {
+	var inner []string
+	for ; i < len(lines); i++ {
+		line := strings.TrimLeft(lines[i], " ")
+		if !strings.HasPrefix(line, ">") {
+			// lazy continuation of a paragraph
+			if isBlank(lines[i]) || startsBlock(lines[i]) || len(inner) == 0 || isBlank(inner[len(inner)-1]) {
+				break
+			}
+			inner = append(inner, lines[i])
+			continue
+		}
+		line = strings.TrimPrefix(line[1:], " ")
+		inner = append(inner, line)
+	}
+	r.b.WriteString("<blockquote>\n")
+	r.blocks(inner)
+	r.b.WriteString("</blockquote>\n")
+	return i
+}
+
+func (r *markdownRenderer) list(lines []string, i int) int {
+	m := mdListItem.FindStringSubmatch(lines[i])
+	indent := len(m[1])
+	ordered := m[2][0] >= '0' && m[2][0] <= '9'
+	delim := m[2][len(m[2])-1]
+
+	tag := "ul"
+	if ordered {
+		tag = "ol"
+		if start, _ := strconv.Atoi(m[2][:len(m[2])-1]); start != 1 {
+			fmt.Fprintf(&r.b, "<ol start=\"%d\">\n", start)
+		} else {
+			r.b.WriteString("<ol>\n")
+		}
+	} else {
+		r.b.WriteString("<ul>\n")
+	}
+
+	for i < len(lines) {
+		m := mdListItem.FindStringSubmatch(lines[i])
+		if m == nil || len(m[1]) != indent || (m[2][0] >= '0' && m[2][0] <= '9') != ordered || m[2][len(m[2])-1] != delim {
+			break
+		}
+		// the content of the item is aligned after the marker
+		contentIndent := len(m[0])
+		if m[3] == "" || len(m[3]) > 4 {
+			contentIndent = len(m[1]) + len(m[2]) + 1
+		}
+		item := []string{lines[i][len(m[0]):]}
+		if len(m[3]) > 4 {
+			item[0] = strings.Repeat(" ", len(m[3])-1) + item[0]
+		}
+		for i++; i < len(lines); i++ {
+			line := lines[i]
+			if isBlank(line) {
+				// the item goes on when indented content follows
+				if i+1 < len(lines) && leadingSpaces(lines[i+1]) >= contentIndent {
+					item = append(item, "")
+					continue
+				}
+				break
+			}
+			if n := leadingSpaces(line); n >= contentIndent {
+				item = append(item, line[contentIndent:])
+				continue
+			}
+			// lazy continuation of the item text
+			if !startsBlock(line) && !isBlank(item[len(item)-1]) {
+				item = append(item, strings.TrimLeft(line, " "))
+				continue
+			}
+			break
+		}
+		r.listItem(item)
+		// a blank line between items
+		if i < len(lines) && isBlank(lines[i]) && i+1 < len(lines) && mdListItem.MatchString(lines[i+1]) {
+			i++
+		}
+	}
+	r.b.WriteString("</" + tag + ">\n")
+	return i
+}
+
+// listItem renders the leading text of an item inline, as in a tight list,
+// and what follows it, like a nested list, as blocks
+func (r *markdownRenderer) listItem(item []string) {
+	r.b.WriteString("<li>")
+	n := 0
+	for n < len(item) && !isBlank(item[n]) && (n == 0 || !startsBlock(item[n])) {
+		n++
+	}
+	if n > 0 && !mdFence.MatchString(item[0]) && !startsBlock(item[0]) {
+		r.b.WriteString(r.inline(strings.Join(item[:n], "\n")))
+		item = item[n:]
+	}
+	if len(item) > 0 {
+		r.b.WriteString("\n")
+		r.blocks(item)
+	}
+	r.b.WriteString("</li>\n")
+}
+
+func leadingSpaces(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+func (r *markdownRenderer) table(lines []string, i int) int {
+	header := splitTableRow(lines[i])
+	var align []string
+	for _, cell := range splitTableRow(lines[i+1]) {
+		switch {
+		case strings.HasPrefix(cell, ":") && strings.HasSuffix(cell, ":"):
+			align = append(align, "center")
+		case strings.HasSuffix(cell, ":"):
+			align = append(align, "right")
+		case strings.HasPrefix(cell, ":"):
+			align = append(align, "left")
+		default:
+			align = append(align, "")
+		}
+	}
+	row := func(cells []string, tag string) {
+		r.b.WriteString("<tr>")
+		for n := range align {
+			cell := ""
+			if n < len(cells) {
+				cell = cells[n]
+			}
+			if align[n] != "" {
+				fmt.Fprintf(&r.b, `<%s style="text-align: %s">`, tag, align[n])
+			} else {
+				r.b.WriteString("<" + tag + ">")
+			}
+			r.b.WriteString(r.inline(cell) + "</" + tag + ">")
+		}
+		r.b.WriteString("</tr>\n")
+	}
+
+	r.b.WriteString("<table>\n<thead>\n")
+	row(header, "th")
+	r.b.WriteString("</thead>\n<tbody>\n")
+	for i += 2; i < len(lines) && !isBlank(lines[i]) && strings.Contains(lines[i], "|"); i++ {
+		row(splitTableRow(lines[i]), "td")
+	}
+	r.b.WriteString("</tbody>\n</table>\n")
+	return i
+}
+
+// splitTableRow returns the trimmed cells of a table row, \| is a literal pipe
+func splitTableRow(line string) []string {
+	line = strings.TrimSpace(line)
+	line = strings.TrimPrefix(line, "|")
+	if strings.HasSuffix(line, "|") && !strings.HasSuffix(line, `\|`) {
+		line = line[:len(line)-1]
+	}
+	var cells []string
+	var cell strings.Builder
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && i+1 < len(line) && line[i+1] == '|':
+			cell.WriteByte('|')
+			i++
+		case line[i] == '|':
+			cells = append(cells, strings.TrimSpace(cell.String()))
+			cell.Reset()
+		default:
+			cell.WriteByte(line[i])
+		}
+	}
+	return append(cells, strings.TrimSpace(cell.String()))
+}
+
+func (r *markdownRenderer) paragraph(lines []string, i int) int {
+	start := i
+	for i++; i < len(lines) && !isBlank(lines[i]) && !startsBlock(lines[i]); i++ {
+		// a table starts at its header row
+		if strings.Contains(lines[i], "|") && i+1 < len(lines) && mdTableSep.MatchString(lines[i+1]) {
+			break
+		}
+	}
+	text := strings.TrimSpace(strings.Join(lines[start:i], "\n"))
+	r.b.WriteString("<p>" + r.inline(text) + "</p>\n")
+	return i
+}
+
+// spans is what inline learns about a text while rendering it: the closers
+// of brackets and parentheses are found in one pass and delimiters without a
+// closer are remembered, so each opener is matched without rescanning the text
+type spans struct {
+	text string
+	// closers[i] is the index of the ] or ) closing the [ or ( at i, -1 if none
+	closers []int
+	// emphasis and code span delimiters with no closer left in the text
+	unclosed map[string]bool
+}
+
+// closer returns the index of the bracket closing the one at i, -1 if none
+func (s *spans) closer(i int) int {
+	if s.closers == nil {
+		s.closers = make([]int, len(s.text))
+		for j := range s.closers {
+			s.closers[j] = -1
+		}
+		var brackets, parens []int
+		for j := 0; j < len(s.text); j++ {
+			switch s.text[j] {
+			case '\\':
+				j++
+			case '[':
+				brackets = append(brackets, j)
+			case '(':
+				parens = append(parens, j)
+			case ']':
+				if n := len(brackets); n > 0 {
+					s.closers[brackets[n-1]] = j
+					brackets = brackets[:n-1]
+				}
+			case ')':
+				if n := len(parens); n > 0 {
+					s.closers[parens[n-1]] = j
+					parens = parens[:n-1]
+				}
+			}
+		}
+	}
+	return s.closers[i]
+}
+
+// inline renders the spans of text
+func (r *markdownRenderer) inline(text string) string {
+	text = mdHardBreak.ReplaceAllString(text, "\x00")
+	if r.depth >= mdMaxNesting {
+		return strings.ReplaceAll(template.HTMLEscapeString(text), "\x00", "<br>\n")
+	}
+	r.depth++
+	defer func() { r.depth-- }()
+	s := &spans{text: text, unclosed: make(map[string]bool)}
+	var b strings.Builder
+	for i := 0; i < len(text); {
+		c := text[i]
+		switch {
+		case c == 0:
+			b.WriteString("<br>\n")
+			i++
+			continue
+		case c == '\\' && i+1 < len(text) && isMarkdownPunct(text[i+1]):
+			b.WriteString(template.HTMLEscapeString(text[i+1 : i+2]))
+			i += 2
+			continue
+		case c == '`':
+			ticks := len(text[i:]) - len(strings.TrimLeft(text[i:], "`"))
+			if delim := text[i : i+ticks]; !s.unclosed[delim] {
+				if n, html := codeSpan(text[i:]); n > 0 {
+					b.WriteString(html)
+					i += n
+					continue
+				}
+				s.unclosed[delim] = true
+			}
+			// an unclosed run of backquotes is text
+			b.WriteString(text[i : i+ticks])
+			i += ticks
+			continue
+		case c == '!' && strings.HasPrefix(text[i+1:], "["):
+			if n, label, dest := s.linkAt(i + 1); n > 0 {
+				if href, ok := r.safeURL(dest); ok {
+					fmt.Fprintf(&b, `<img src="%s" alt="%s">`, template.HTMLEscapeString(href), template.HTMLEscapeString(label))
+				} else {
+					b.WriteString(template.HTMLEscapeString(label))
+				}
+				i += 1 + n
+				continue
+			}
+		case c == '[':
+			if n, label, dest := s.linkAt(i); n > 0 {
+				if href, ok := r.safeURL(dest); ok {
+					fmt.Fprintf(&b, `<a href="%s">%s</a>`, template.HTMLEscapeString(href), r.inline(label))
+				} else {
+					b.WriteString(r.inline(label))
+				}
+				i += n
+				continue
+			}
+		case c == '<':
+			// the autolink ends at the first byte it can't contain
+			if end := strings.IndexAny(text[i+1:], "> \n<"); end > 0 && text[i+1+end] == '>' {
+				dest := text[i+1 : i+1+end]
+				if hasLinkScheme(dest) {
+					if href, ok := r.safeURL(dest); ok {
+						fmt.Fprintf(&b, `<a href="%s">%s</a>`, template.HTMLEscapeString(href), template.HTMLEscapeString(dest))
+						i += end + 2
+						continue
+					}
+				}
+			}
+		case c == 'h' && (i == 0 || !isWordByte(text[i-1])) && (strings.HasPrefix(text[i:], "http://") || strings.HasPrefix(text[i:], "https://")):
+			// bare URLs are linked too, without trailing punctuation
+			n := strings.IndexAny(text[i:], " \n\x00<")
+			if n < 0 {
+				n = len(text) - i
+			}
+			n = len(strings.TrimRight(text[i:i+n], ".,:;!?)'\""))
+			dest := text[i : i+n]
+			fmt.Fprintf(&b, `<a href="%s">%s</a>`, template.HTMLEscapeString(dest), template.HTMLEscapeString(dest))
+			i += n
+			continue
+		case c == '*' || c == '_' || c == '~':
+			if n, html := r.emphasis(s, i); n > 0 {
+				b.WriteString(html)
+				i += n
+				continue
+			}
+		}
+		// copy up to the next byte that may start a span
+		n := 1
+		for i+n < len(text) && strings.IndexByte("\x00\\`![<h*_~", text[i+n]) < 0 {
+			n++
+		}
+		b.WriteString(template.HTMLEscapeString(text[i : i+n]))
+		i += n
+	}
+	return b.String()
+}
+
+// codeSpan renders the code span starting text, 0 if it isn't closed
+func codeSpan(text string) (int, string) {
+	ticks := len(text) - len(strings.TrimLeft(text, "`"))
+	delim := text[:ticks]
+	for from := ticks; from < len(text); {
+		end := strings.Index(text[from:], delim)
+		if end < 0 {
+			return 0, ""
+		}
+		end += from
+		// a longer run of backquotes doesn't close the span
+		if end+ticks < len(text) && text[end+ticks] == '`' {
+			from = end + ticks
+			for from < len(text) && text[from] == '`' {
+				from++
+			}
+			continue
+		}
+		code := strings.ReplaceAll(text[ticks:end], "\n", " ")
+		if len(code) > 2 && code[0] == ' ' && code[len(code)-1] == ' ' {
+			code = code[1 : len(code)-1]
+		}
+		return end + ticks, "<code>" + template.HTMLEscapeString(code) + "</code>"
+	}
+	return 0, ""
+}
+
+// linkAt parses [label](dest "title") at text[i], 0 if it isn't a link
+func (s *spans) linkAt(i int) (n int, label, dest string) {
+	closeLabel := s.closer(i)
+	if closeLabel < 0 || closeLabel+1 >= len(s.text) || s.text[closeLabel+1] != '(' {
+		return 0, "", ""
+	}
+	// parentheses in the destination must be balanced
+	end := s.closer(closeLabel + 1)
+	if end < 0 {
+		return 0, "", ""
+	}
+	dest = strings.TrimSpace(s.text[closeLabel+2 : end])
+	// drop the title
+	if sp := strings.IndexAny(dest, " \n"); sp >= 0 {
+		dest = dest[:sp]
+	}
+	dest = strings.TrimSuffix(strings.TrimPrefix(dest, "<"), ">")
+	return end + 1 - i, s.text[i+1 : closeLabel], dest
+}
+
+// emphasis renders *em*, **strong** or ~~strike~~ starting at text[i], 0 if
+// the run isn't closed
+func (r *markdownRenderer) emphasis(s *spans, i int) (int, string) {
+	text := s.text
+	c := text[i]
+	run := 1
+	for i+run < len(text) && text[i+run] == c && run < 2 {
+		run++
+	}
+	if c == '~' && run != 2 {
+		return 0, ""
+	}
+	// _ only works at word boundaries, snake_case stays as is
+	if c == '_' && i > 0 && isWordByte(text[i-1]) {
+		return 0, ""
+	}
+	delim := text[i : i+run]
+	body := i + run
+	if body >= len(text) || text[body] == ' ' || text[body] == '\n' || s.unclosed[delim] {
+		return 0, ""
+	}
+	for from := body + 1; from <= len(text)-run; from++ {
+		end := strings.Index(text[from:], delim)
+		if end < 0 {
+			break
+		}
+		end += from
+		if text[end-1] == ' ' || text[end-1] == '\n' || text[end-1] == '\\' {
+			from = end
+			continue
+		}
+		if c == '_' && end+run < len(text) && isWordByte(text[end+run]) {
+			from = end
+			continue
+		}
+		tag := "em"
+		switch {
+		case c == '~':
+			tag = "del"
+		case run == 2:
+			tag = "strong"
+		}
+		return end + run - i, "<" + tag + ">" + r.inline(text[body:end]) + "</" + tag + ">"
+	}
+	// no closer follows, nor does one for any later opener
+	s.unclosed[delim] = true
+	return 0, ""
+}
+
+// safeURL returns dest if it can't run script, relative ones resolved against the base
+func (r *markdownRenderer) safeURL(dest string) (string, bool) {
+	u, err := url.Parse(dest)
+	if err != nil {
+		return "", false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https", "mailto":
+		return u.String(), true
+	case "":
+		if u.Host != "" || strings.HasPrefix(u.Path, "/") || u.Path == "" {
+			return u.String(), true
+		}
+		base := &url.URL{Path: r.base + "/"}
+		return base.ResolveReference(u).String(), true
+	}
+	return "", false
+}
+
+func hasLinkScheme(dest string) bool {
+	lower := strings.ToLower(dest)
+	return strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://") || strings.HasPrefix(lower, "mailto:")
+}
+
+func isWordByte(c byte) bool {
+	return isIdentByte(c) || isDigit(c)
+}
+
+func isMarkdownPunct(c byte) bool {
+	return strings.IndexByte("!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~", c) >= 0
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderMarkdownLinear(t *testing.T) {
+	const size = 256 << 10
+	var ticks strings.Builder
+	for k := 700; k > 0; k-- {
+		ticks.WriteString(strings.Repeat("`", k) + "a")
+	}
+	tests := []struct {
+		name string
+		src  string
+	}{
+		{"unclosed em", strings.Repeat("*a ", size/3)},
+		{"unclosed strong", strings.Repeat("**a ", size/4)},
+		{"unclosed under", strings.Repeat("_a ", size/3)},
+		{"unclosed strike", strings.Repeat("~~a ", size/4)},
+		{"unclosed link", strings.Repeat("[](", size/3)},
+		{"unclosed label", strings.Repeat("[a", size/2)},
+		{"unclosed image", strings.Repeat("![a", size/3)},
+		{"unclosed autolink", strings.Repeat("<a", size/2)},
+		{"backquote runs", ticks.String()},
+		{"nested links", strings.Repeat("[", size/5) + "a" + strings.Repeat("](b)", size/5)},
+		{"nested quotes", strings.Repeat(">", size)},
+		{"nested lists", strings.Repeat("1. ", size/3)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			renderMarkdown(tt.src, "/dir")
+			// the quadratic scans took from seconds to most of a minute
+			if elapsed := time.Since(start); elapsed > 3*time.Second {
+				t.Fatalf("rendering %d bytes took %v", len(tt.src), elapsed)
+			}
+		})
+	}
+}
+
+func TestRenderMarkdownUnclosedSpans(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"*a b* *c", "<p><em>a b</em> *c</p>\n"},
+		{"~~a ~~b~~", "<p><del>a ~~b</del></p>\n"},
+		// an unclosed run of backquotes stays text as a whole
+		{"``a` b", "<p>``a` b</p>\n"},
+		{"x ```a`` b`` c`", "<p>x ```a<code> b</code> c`</p>\n"},
+		{"[a [b](c)", `<p>[a <a href="/dir/c">b</a></p>` + "\n"},
+		{"[a](b(c) d", "<p>[a](b(c) d</p>\n"},
+		{"<x <https://a.b>", `<p>&lt;x <a href="https://a.b">https://a.b</a></p>` + "\n"},
+	}
+	for _, tt := range tests {
+		if got := string(renderMarkdown(tt.src, "/dir")); got != tt.want {
+			t.Errorf("renderMarkdown(%q) = %q; want %q", tt.src, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	resp "httpserver/internal/response"
+	logger "httpserver/pkg/log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// DirResult describes a created directory
+type DirResult struct {
+	// path relative to workDir
+	Path string `json:"path"`
+	Mode string `json:"mode"`
+}
+
+// creates a directory
+// query params:
+// - path: the directory to create
+// - parents: if true, create missing parents and succeed when the directory exists, like mkdir -p
+// - mode: octal permission bits, default 0755
+func (s *Server) mkdirHandler(w http.ResponseWriter, r *http.Request) resp.Response {
+	localPath, err := s.paths.Resolve(r.FormValue("path"))
+	if err != nil {
+		logger.Error(fmt.Sprintf("invalid path: %v", err))
+		return pathErrorResponse(err)
+	}
+	if s.paths.IsRoot(localPath) {
+		logger.Error("no directory name given")
+		return errorCodeResponse(http.StatusBadRequest, resp.CodeInvalidPath, errors.New("directory path is required"))
+	}
+
+	parents := false
+	if v := r.FormValue("parents"); v != "" {
+		if parents, err = strconv.ParseBool(v); err != nil {
+			logger.Error(fmt.Sprintf("invalid parents: %q", v))
+			return errorResponse(http.StatusBadRequest, fmt.Errorf("invalid parents: %q", v))
+		}
+	}
+	mode := os.FileMode(0755)
+	if v := r.FormValue("mode"); v != "" {
+		m, err := strconv.ParseUint(v, 8, 32)
+		if err != nil || m > 0777 {
+			logger.Error(fmt.Sprintf("invalid mode: %q", v))
+			return errorResponse(http.StatusBadRequest, fmt.Errorf("invalid mode: %q", v))
+		}
+		mode = os.FileMode(m)
+	}
+
+	if info, err := s.fs.Stat(localPath); err == nil {
+		if !info.IsDir() {
+			logger.Error("a file with that name already exist")
+			return errorCodeResponse(http.StatusConflict, resp.CodeFileExists, errors.New("a file with that name already exist"))
+		}
+		if !parents {
+			logger.Error("directory already exist")
+			return errorCodeResponse(http.StatusConflict, resp.CodeFileExists, errors.New("directory already exist"))
+		}
+		return successResponse(http.StatusOK, "Directory already exist", DirResult{
+			Path: s.paths.Rel(localPath),
+			Mode: fmt.Sprintf("%04o", info.Mode().Perm()),
+		})
+	}
+
+	if parents {
+		err = s.fs.MkdirAll(localPath, mode)
+	} else {
+		err = s.fs.Mkdir(localPath, mode)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			logger.Error(fmt.Sprintf("parent directory not found: %v", err))
+			return errorCodeResponse(http.StatusNotFound, resp.CodeNotFound, errors.New("parent directory not found"))
+		case errors.Is(err, os.ErrExist):
+			logger.Error(fmt.Sprintf("directory already exist: %v", err))
+			return errorCodeResponse(http.StatusConflict, resp.CodeFileExists, errors.New("directory already exist"))
+		case errors.Is(err, syscall.ENOTDIR):
+			logger.Error(fmt.Sprintf("parent is not a directory: %v", err))
+			return errorCodeResponse(http.StatusConflict, resp.CodeFileExists, errors.New("parent is not a directory"))
+		}
+		logger.Error(fmt.Sprintf("failed to make dir: %v", err))
+		return errorResponse(http.StatusInternalServerError, errors.New("failed to make dir"))
+	}
+	// the umask may have removed bits, apply the requested mode as is
+	if err := s.fs.Chmod(localPath, mode); err != nil {
+		logger.Warn(fmt.Sprintf("failed to chmod %v: %v", localPath, err))
+	}
+	syncDir(s.fs, filepath.Dir(localPath))
+
+	return successResponse(http.StatusCreated, "Directory created successfully", DirResult{
+		Path: s.paths.Rel(localPath),
+		Mode: fmt.Sprintf("%04o", mode),
+	})
+}
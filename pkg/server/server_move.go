@@ -0,0 +1,148 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	resp "httpserver/internal/response"
+	logger "httpserver/pkg/log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// MoveResult describes a finished move
+type MoveResult struct {
+	// paths relative to workDir
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// moves or renames a file or directory
+// query params:
+// - from: the path to move
+// - to: the new path, missing parent dirs are created
+// - overwrite: if true, replace an existing destination of the same kind, a
+// replaced dir is moved to the trash
+func (s *Server) moveHandler(w http.ResponseWriter, r *http.Request) resp.Response {
+	from, err := s.paths.Resolve(r.FormValue("from"))
+	if err != nil {
+		logger.Error(fmt.Sprintf("invalid from: %v", err))
+		return pathErrorResponse(err)
+	}
+	to, err := s.paths.Resolve(r.FormValue("to"))
+	if err != nil {
+		logger.Error(fmt.Sprintf("invalid to: %v", err))
+		return pathErrorResponse(err)
+	}
+	overwrite := false
+	if v := r.FormValue("overwrite"); v != "" {
+		if overwrite, err = strconv.ParseBool(v); err != nil {
+			logger.Error(fmt.Sprintf("invalid overwrite: %q", v))
+			return errorResponse(http.StatusBadRequest, fmt.Errorf("invalid overwrite: %q", v))
+		}
+	}
+
+	if s.paths.IsRoot(from) || s.paths.IsRoot(to) {
+		logger.Error("refuse to move work dir")
+		return errorCodeResponse(http.StatusForbidden, resp.CodeRootForbidden, errors.New("cannot move work dir"))
+	}
+
+	// a symlink is moved as a link
+	srcInfo, err := s.fs.Lstat(from)
+	if err != nil {
+		logger.Error(fmt.Sprintf("file not found: %v", err))
+		return errorCodeResponse(http.StatusNotFound, resp.CodeNotFound, errors.New("file not found"))
+	}
+	if from == to {
+		logger.Error("source and destination are the same")
+		return errorCodeResponse(http.StatusBadRequest, resp.CodeMoveSamePath, errors.New("source and destination are the same"))
+	}
+	if srcInfo.IsDir() && within(from, to) {
+		logger.Error("cannot move a directory into itself")
+		return errorCodeResponse(http.StatusBadRequest, resp.CodeMoveIntoItself, errors.New("cannot move a directory into itself"))
+	}
+	// replacing a dir that holds the source would trash the source with it
+	if within(to, from) {
+		logger.Error("cannot move onto a directory containing the source")
+		return errorCodeResponse(http.StatusBadRequest, resp.CodeMoveIntoItself, errors.New("cannot move onto a directory containing the source"))
+	}
+
+	// only dirs limited at the destination but not at the source see the content arrive,
+	// a replaced dir goes to the trash and a replaced file may be kept as a version,
+	// both still count
+	usage := s.quota.usage(from)
+	var replaced quotaUsage
+	destInfo, err := s.fs.Lstat(to)
+	if err == nil && !os.SameFile(srcInfo, destInfo) && overwrite && !destInfo.IsDir() && !s.versions.keeps(destInfo) {
+		replaced = s.quota.usage(to)
+	}
+	res, err := s.quota.reserve(to, usage.sub(replaced), from)
+	if err != nil {
+		logger.Error(fmt.Sprintf("move rejected: %v", err))
+		return quotaErrorResponse(err)
+	}
+	defer res.release()
+
+	if destInfo != nil && !os.SameFile(srcInfo, destInfo) {
+		// os.SameFile: a case only rename on a case insensitive filesystem
+		if !overwrite {
+			logger.Error("destination already exist")
+			return errorCodeResponse(http.StatusConflict, resp.CodeFileExists, errors.New("destination already exist"))
+		}
+		if destInfo.IsDir() != srcInfo.IsDir() {
+			logger.Error("destination is of another kind")
+			return errorCodeResponse(http.StatusConflict, resp.CodeFileExists, errors.New("cannot overwrite a directory with a file or a file with a directory"))
+		}
+		// a replaced file is kept as a version like an overwritten upload,
+		// versions don't hold trees so a replaced dir goes to the trash
+		if destInfo.IsDir() {
+			if _, err := s.trash.put(to); err != nil {
+				logger.Error(fmt.Sprintf("failed to move destination to trash: %v", err))
+				return errorResponse(http.StatusInternalServerError, errors.New("failed to remove destination"))
+			}
+		} else {
+			if err := s.versions.save(to); err != nil {
+				logger.Error(fmt.Sprintf("failed to keep version: %v", err))
+				return errorResponse(http.StatusInternalServerError, errors.New("failed to keep version"))
+			}
+			if err := s.fs.Remove(to); err != nil {
+				logger.Error(fmt.Sprintf("failed to remove destination: %v", err))
+				return errorResponse(http.StatusInternalServerError, errors.New("failed to remove destination"))
+			}
+			s.quota.update(to, quotaUsage{}.sub(replaced))
+		}
+	}
+
+	if err := s.fs.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		logger.Error(fmt.Sprintf("failed to make dir: %v", err))
+		return errorResponse(http.StatusInternalServerError, errors.New("failed to make dir"))
+	}
+
+	if err := moveFile(s.fs, from, to); err != nil {
+		logger.Error(fmt.Sprintf("failed to move %v to %v: %v", from, to, err))
+		return errorResponse(http.StatusInternalServerError, errors.New("failed to move"))
+	}
+	s.quota.moved(from, to, usage)
+
+	return successResponse(http.StatusOK, "Move successfully", MoveResult{
+		From: s.paths.Rel(from),
+		To:   s.paths.Rel(to),
+	})
+}
+
+// moveFile renames from to to, falling back to copy and delete across devices
+func moveFile(fsys Storage, from, to string) error {
+	err := fsys.Rename(from, to)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	logger.Info(fmt.Sprintf("cross device move of %v, copying", from))
+	if err := copyTree(fsys, from, to); err != nil {
+		fsys.RemoveAll(to)
+		return err
+	}
+	return fsys.RemoveAll(from)
+}
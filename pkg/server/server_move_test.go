@@ -0,0 +1,86 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestMoveOverwrite(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		// content of the files afterwards
+		want map[string]string
+		gone []string
+		// items in the trash afterwards
+		trashed int
+	}{
+		{
+			name: "file to new path", query: "from=x.txt&to=n/x.txt", status: http.StatusOK,
+			want: map[string]string{"n/x.txt": "x"}, gone: []string{"x.txt"},
+		},
+		{
+			name: "file onto file", query: "from=x.txt&to=y.txt", status: http.StatusConflict,
+			want: map[string]string{"x.txt": "x", "y.txt": "y"},
+		},
+		{
+			name: "file replaces file", query: "from=x.txt&to=y.txt&overwrite=true", status: http.StatusOK,
+			want: map[string]string{"y.txt": "x"}, gone: []string{"x.txt"},
+		},
+		{
+			name: "file onto dir", query: "from=x.txt&to=d&overwrite=true", status: http.StatusConflict,
+			want: map[string]string{"x.txt": "x", "d/g.txt": "g"},
+		},
+		{
+			name: "dir replaces dir", query: "from=d&to=a/b&overwrite=true", status: http.StatusOK,
+			want: map[string]string{"a/b/g.txt": "g"}, gone: []string{"d", "a/b/c"}, trashed: 1,
+		},
+		{
+			name: "dir into itself", query: "from=a&to=a/b/n", status: http.StatusBadRequest,
+			want: map[string]string{"a/b/c/f.txt": "f"}, gone: []string{"a/b/n"},
+		},
+		{
+			name: "dir onto its parent", query: "from=a/b/c&to=a/b&overwrite=true", status: http.StatusBadRequest,
+			want: map[string]string{"a/b/c/f.txt": "f"},
+		},
+		{
+			name: "file onto an ancestor", query: "from=a/b/c/f.txt&to=a&overwrite=true", status: http.StatusBadRequest,
+			want: map[string]string{"a/b/c/f.txt": "f"},
+		},
+		{
+			name: "same path", query: "from=x.txt&to=x.txt&overwrite=true", status: http.StatusBadRequest,
+			want: map[string]string{"x.txt": "x"},
+		},
+		{
+			name: "work dir", query: "from=&to=n&overwrite=true", status: http.StatusForbidden,
+			want: map[string]string{"x.txt": "x"}, gone: []string{"n"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachStorage(t, ServerConfig{}, func(t *testing.T, ts *testServer) {
+				ts.upload("a/b/c", map[string]string{"f.txt": "f"}, "", http.StatusOK)
+				ts.upload("d", map[string]string{"g.txt": "g"}, "", http.StatusOK)
+				ts.upload("", map[string]string{"x.txt": "x", "y.txt": "y"}, "", http.StatusOK)
+
+				ts.call("POST", "/move?"+tt.query, tt.status, nil)
+				for path, want := range tt.want {
+					if got := ts.content(path); got != want {
+						t.Errorf("%s = %q; want %q", path, got, want)
+					}
+				}
+				for _, path := range tt.gone {
+					if ts.exists(path) {
+						t.Errorf("%s still exists", path)
+					}
+				}
+				var items []TrashItem
+				ts.call("GET", "/trash", http.StatusOK, &items)
+				if len(items) != tt.trashed {
+					t.Errorf("%d items in the trash; want %d", len(items), tt.trashed)
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,239 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NamingStrategy decides the stored name of an upload and what happens when
+// a file with that name already exists
+type NamingStrategy string
+
+const (
+	// keep the uploaded name, reject the upload on conflict
+	NamingOriginal NamingStrategy = "original"
+	// keep the uploaded name, replace an existing file
+	NamingOverwrite NamingStrategy = "overwrite"
+	// keep the uploaded name, append " (1)", " (2)"... on conflict
+	NamingSuffix NamingStrategy = "suffix"
+	// prefix the uploaded name with the upload time
+	NamingTimestamp NamingStrategy = "timestamp"
+	// random uuid keeping the extension
+	NamingUUID NamingStrategy = "uuid"
+	// sha256 of the content keeping the extension, identical content is stored once
+	NamingHash NamingStrategy = "hash"
+)
+
+var ErrFileExists = errors.New("file already exist")
+
+// maxSuffix bounds the search for a free "name (n).ext"
+const maxSuffix = 10000
+
+// ParseNamingStrategy validates a strategy name, empty means NamingOriginal
+func ParseNamingStrategy(name string) (NamingStrategy, error) {
+	switch strategy := NamingStrategy(strings.ToLower(strings.TrimSpace(name))); strategy {
+	case "":
+		return NamingOriginal, nil
+	case NamingOriginal, NamingOverwrite, NamingSuffix, NamingTimestamp, NamingUUID, NamingHash:
+		return strategy, nil
+	default:
+		return "", fmt.Errorf("unknown file naming strategy: %q", name)
+	}
+}
+
+// namingStrategy returns the strategy for a request.
+// query params:
+// - naming: one of the NamingStrategy values
+// - overwrite: if true, shortcut for naming=overwrite
+// falls back to ServerConfig.FileNamingStrategy
+func (s *Server) namingStrategy(r *http.Request) (NamingStrategy, error) {
+	if naming := r.FormValue("naming"); naming != "" {
+		return ParseNamingStrategy(naming)
+	}
+	if overwrite := r.FormValue("overwrite"); overwrite != "" {
+		v, err := strconv.ParseBool(overwrite)
+		if err != nil {
+			return "", fmt.Errorf("invalid overwrite: %q", overwrite)
+		}
+		if v {
+			return NamingOverwrite, nil
+		}
+		return NamingOriginal, nil
+	}
+	return ParseNamingStrategy(s.FileNamingStrategy)
+}
+
+// placeFile moves the complete file src into dir under the name chosen by
+// strategy and returns the final path. src must be on the same filesystem,
+// it usually is a staging file, so the file shows up atomically in dir.
+// A replaced file is kept as a version, the quota is checked and updated.
+func (s *Server) placeFile(src, dir, name string, strategy NamingStrategy) (string, error) {
+	info, err := s.fs.Stat(src)
+	if err != nil {
+		return "", err
+	}
+	added := quotaUsage{Bytes: info.Size(), Files: 1}
+
+	if strategy == NamingOverwrite {
+		dest := filepath.Join(dir, name)
+		// a replaced file kept as a version still counts
+		var replaced quotaUsage
+		if info, err := s.fs.Lstat(dest); err == nil {
+			if info.IsDir() {
+				return "", ErrFileExists
+			}
+			if !s.versions.keeps(info) {
+				replaced = quotaUsage{Bytes: info.Size(), Files: 1}
+			}
+		}
+		res, err := s.quota.reserve(dest, added.sub(replaced), "")
+		if err != nil {
+			return "", err
+		}
+		defer res.release()
+		if err := s.versions.save(dest); err != nil {
+			return "", err
+		}
+		if err := s.fs.Rename(src, dest); err != nil {
+			return "", err
+		}
+		s.quota.update(dest, added.sub(replaced))
+		return dest, nil
+	}
+
+	res, err := s.quota.reserve(filepath.Join(dir, name), added, "")
+	if err != nil {
+		return "", err
+	}
+	defer res.release()
+
+	if strategy == NamingHash {
+		sum, err := hashFile(s.fs, src)
+		if err != nil {
+			return "", err
+		}
+		dest := filepath.Join(dir, sum+filepath.Ext(name))
+		if info, err := s.fs.Stat(dest); err == nil && !info.IsDir() {
+			// same content already stored
+			return dest, s.fs.Remove(src)
+		}
+		if err := renameNoReplace(s.fs, src, dest); err != nil {
+			return "", err
+		}
+		s.quota.update(dest, added)
+		return dest, nil
+	}
+
+	name, err = strategyName(name, strategy)
+	if err != nil {
+		return "", err
+	}
+	for i := 0; i < maxSuffix; i++ {
+		dest := filepath.Join(dir, suffixName(name, i))
+		err := renameNoReplace(s.fs, src, dest)
+		if err == nil {
+			s.quota.update(dest, added)
+			return dest, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return dest, err
+		}
+		if strategy == NamingOriginal {
+			return "", ErrFileExists
+		}
+	}
+	return "", ErrFileExists
+}
+
+// strategyName returns the name to try first for the timestamp and uuid
+// strategies, name itself for the others
+func strategyName(name string, strategy NamingStrategy) (string, error) {
+	switch strategy {
+	case NamingTimestamp:
+		return time.Now().Format("20060102-150405") + "_" + name, nil
+	case NamingUUID:
+		id, err := newUUID()
+		if err != nil {
+			return "", err
+		}
+		return id + filepath.Ext(name), nil
+	}
+	return name, nil
+}
+
+// suffixName returns "name (i).ext", name itself for i == 0
+func suffixName(name string, i int) string {
+	if i == 0 {
+		return name
+	}
+	ext := filepath.Ext(name)
+	if ext == name {
+		// dot files like ".bashrc"
+		ext = ""
+	}
+	return fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), i, ext)
+}
+
+// renameNoReplace renames src to dest failing with os.ErrExist instead of
+// replacing dest. A hard link makes the check and the rename atomic.
+func renameNoReplace(fsys Storage, src, dest string) error {
+	if err := fsys.Link(src, dest); err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return err
+		}
+		// hard links unsupported, fall back to check then rename
+		if _, err := fsys.Lstat(dest); err == nil {
+			return &os.LinkError{Op: "rename", Old: src, New: dest, Err: os.ErrExist}
+		}
+		return fsys.Rename(src, dest)
+	}
+	return fsys.Remove(src)
+}
+
+func hashFile(fsys Storage, path string) (string, error) {
+	f, err := fsys.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// newUUID returns a random (version 4) uuid
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// validUUID accepts the uuids made by newUUID only
+func validUUID(id string) bool {
+	if len(id) != 36 {
+		return false
+	}
+	for _, c := range id {
+		if !strings.ContainsRune("0123456789abcdef-", c) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"testing"
+)
+
+func TestNamingStrategies(t *testing.T) {
+	sum := sha256.Sum256([]byte("new"))
+	tests := []struct {
+		name   string
+		file   string
+		query  string
+		status int
+		// the stored path must match
+		path string
+		// content of a.txt afterwards
+		existing string
+	}{
+		{name: "original", file: "a.txt", status: http.StatusBadRequest, existing: "old"},
+		{name: "original free", file: "b.txt", status: http.StatusOK, path: `^b\.txt$`, existing: "old"},
+		{name: "overwrite", file: "a.txt", query: "naming=overwrite", status: http.StatusOK, path: `^a\.txt$`, existing: "new"},
+		{name: "overwrite flag", file: "a.txt", query: "overwrite=true", status: http.StatusOK, path: `^a\.txt$`, existing: "new"},
+		{name: "suffix", file: "a.txt", query: "naming=suffix", status: http.StatusOK, path: `^a \(2\)\.txt$`, existing: "old"},
+		{name: "suffix dot file", file: ".env", query: "naming=suffix", status: http.StatusOK, path: `^\.env \(1\)$`, existing: "old"},
+		{name: "timestamp", file: "a.txt", query: "naming=timestamp", status: http.StatusOK, path: `^\d{8}-\d{6}_a\.txt$`, existing: "old"},
+		{name: "uuid", file: "a.txt", query: "naming=uuid", status: http.StatusOK, path: `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}\.txt$`, existing: "old"},
+		{name: "hash", file: "a.txt", query: "naming=hash", status: http.StatusOK, path: "^" + hex.EncodeToString(sum[:]) + `\.txt$`, existing: "old"},
+		{name: "unknown", file: "a.txt", query: "naming=random", status: http.StatusBadRequest, existing: "old"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachStorage(t, ServerConfig{}, func(t *testing.T, ts *testServer) {
+				ts.upload("", map[string]string{"a.txt": "old", "a (1).txt": "old", ".env": "old"}, "", http.StatusOK)
+
+				results := ts.upload("", map[string]string{tt.file: "new"}, tt.query, tt.status)
+				if tt.status == http.StatusOK {
+					if !regexp.MustCompile(tt.path).MatchString(results[0].Path) {
+						t.Fatalf("stored as %q; want %s", results[0].Path, tt.path)
+					}
+					if got := ts.content(results[0].Path); got != "new" {
+						t.Fatalf("stored content = %q", got)
+					}
+				}
+				if got := ts.content("a.txt"); got != tt.existing {
+					t.Fatalf("a.txt = %q; want %q", got, tt.existing)
+				}
+			})
+		})
+	}
+}
+
+func TestNamingHashStoresOnce(t *testing.T) {
+	forEachStorage(t, ServerConfig{}, func(t *testing.T, ts *testServer) {
+		first := ts.upload("", map[string]string{"a.txt": "same"}, "naming=hash", http.StatusOK)
+		second := ts.upload("", map[string]string{"b.txt": "same"}, "naming=hash", http.StatusOK)
+		if first[0].Path != second[0].Path {
+			t.Fatalf("same content stored as %q and %q", first[0].Path, second[0].Path)
+		}
+		var list ListResult
+		ts.call("GET", "/list", http.StatusOK, &list)
+		if list.Total != 1 {
+			t.Fatalf("%d files stored; want 1", list.Total)
+		}
+	})
+}
+
+// files placed at once under one name all get a name of their own
+func TestNamingSuffixConcurrent(t *testing.T) {
+	const n = 20
+	forEachStorage(t, ServerConfig{}, func(t *testing.T, ts *testServer) {
+		ts.call("POST", "/mkdir?path=d", http.StatusCreated, nil)
+		root, _ := ts.s.paths.Root()
+		var wg sync.WaitGroup
+		paths := make([]string, n)
+		for i := range n {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				src := filepath.Join(root, fmt.Sprintf("src%d", i))
+				if err := writeFile(ts.s.fs, src, []byte(fmt.Sprint(i)), 0644); err != nil {
+					return
+				}
+				if dest, err := ts.s.placeFile(src, filepath.Join(root, "d"), "a.txt", NamingSuffix); err == nil {
+					paths[i] = ts.s.paths.Rel(dest)
+				}
+			}()
+		}
+		wg.Wait()
+
+		seen := make(map[string]bool)
+		for i, path := range paths {
+			if path == "" || seen[path] {
+				t.Fatalf("upload %d stored as %q, paths %q", i, path, paths)
+			}
+			seen[path] = true
+			if got := ts.content(path); got != fmt.Sprint(i) {
+				t.Fatalf("%s = %q; want %q", path, got, fmt.Sprint(i))
+			}
+		}
+	})
+}
+
+func TestRenameNoReplaceRace(t *testing.T) {
+	const n = 20
+	forEachStorage(t, ServerConfig{}, func(t *testing.T, ts *testServer) {
+		root, _ := ts.s.paths.Root()
+		dest := filepath.Join(root, "dest")
+		errs := make([]error, n)
+		var wg sync.WaitGroup
+		for i := range n {
+			src := filepath.Join(root, fmt.Sprintf("src%d", i))
+			if err := writeFile(ts.s.fs, src, []byte(fmt.Sprint(i)), 0644); err != nil {
+				t.Fatal(err)
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs[i] = renameNoReplace(ts.s.fs, src, dest)
+			}()
+		}
+		wg.Wait()
+
+		winner := -1
+		for i, err := range errs {
+			switch {
+			case err == nil && winner >= 0:
+				t.Fatalf("renames %d and %d both succeeded", winner, i)
+			case err == nil:
+				winner = i
+			case !errors.Is(err, os.ErrExist):
+				t.Fatalf("rename %d: %v; want %v", i, err, os.ErrExist)
+			}
+		}
+		if winner < 0 {
+			t.Fatal("no rename succeeded")
+		}
+		if got := ts.content("dest"); got != fmt.Sprint(winner) {
+			t.Fatalf("dest = %q; want the content of the winner %d", got, winner)
+		}
+		// the losers keep their source
+		for i := range n {
+			if i != winner && !ts.exists(fmt.Sprintf("src%d", i)) {
+				t.Fatalf("src%d lost", i)
+			}
+		}
+	})
+}
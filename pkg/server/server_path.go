@@ -0,0 +1,225 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	resp "httpserver/internal/response"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// stateDirName is the dir inside the work dir holding server owned state,
+// it is hidden from listings and can't be addressed by users
+const stateDirName = ".httpserver"
+
+var (
+	ErrPathReserved  = errors.New("path is reserved")
+	ErrPathInvalid   = errors.New("invalid path")
+	ErrPathTraversal = errors.New("path traversal is not allowed")
+	ErrPathEscape    = errors.New("path escapes work dir")
+)
+
+// PathError is returned when a user supplied path can't be confined to the root
+type PathError struct {
+	Code int
+	Path string
+	Err  error
+}
+
+func (e *PathError) Error() string {
+	return fmt.Sprintf("%v: %q", e.Err, e.Path)
+}
+
+func (e *PathError) Unwrap() error {
+	return e.Err
+}
+
+// Status maps the error code to a http status
+func (e *PathError) Status() int {
+	switch e.Code {
+	case resp.CodePathTraversal, resp.CodeSymlinkEscape, resp.CodeRootForbidden, resp.CodePathReserved:
+		return http.StatusForbidden
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// PathResolver turns user supplied paths (query params, form fields, mux vars,
+// multipart filenames) into local paths verified to be inside root.
+// ".." segments are rejected instead of being cleaned away, and symlinks are
+// followed to make sure they don't point outside of root.
+type PathResolver struct {
+	fs Storage
+}
+
+// NewPathResolver confines paths to the root of fs
+func NewPathResolver(fs Storage) *PathResolver {
+	return &PathResolver{fs: fs}
+}
+
+// Root returns the absolute, symlink free root dir
+func (p *PathResolver) Root() (string, error) {
+	return p.fs.Root()
+}
+
+// Resolve resolves a slash or backslash separated path relative to root.
+// An empty path resolves to root itself.
+func (p *PathResolver) Resolve(userPath string) (string, error) {
+	rel, err := cleanRelPath(userPath)
+	if err != nil {
+		return "", err
+	}
+
+	root, err := p.Root()
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve work dir: %w", err)
+	}
+
+	local := filepath.Join(root, filepath.FromSlash(rel))
+	if err := checkSymlinks(p.fs, root, local, userPath); err != nil {
+		return "", err
+	}
+	return local, nil
+}
+
+// ResolveName resolves a single file name (e.g. a multipart filename) inside
+// dir, which must already be resolved.
+func (p *PathResolver) ResolveName(dir, name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\\x00") || hasVolumeName(name) {
+		return "", &PathError{Code: resp.CodeInvalidPath, Path: name, Err: ErrPathInvalid}
+	}
+
+	root, err := p.Root()
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve work dir: %w", err)
+	}
+
+	local := filepath.Join(dir, name)
+	if !within(root, local) {
+		return "", &PathError{Code: resp.CodePathTraversal, Path: name, Err: ErrPathTraversal}
+	}
+	if isStateDir(root, local) {
+		return "", &PathError{Code: resp.CodePathReserved, Path: name, Err: ErrPathReserved}
+	}
+	if err := checkSymlinks(p.fs, root, local, name); err != nil {
+		return "", err
+	}
+	return local, nil
+}
+
+// Rel returns the slash separated path of local relative to root, "" for root
+func (p *PathResolver) Rel(local string) string {
+	root, err := p.Root()
+	if err != nil {
+		return ""
+	}
+	rel, err := filepath.Rel(root, local)
+	if err != nil || rel == "." {
+		return ""
+	}
+	return filepath.ToSlash(rel)
+}
+
+// IsRoot reports whether local is the root dir
+func (p *PathResolver) IsRoot(local string) bool {
+	root, err := p.Root()
+	if err != nil {
+		return false
+	}
+	return filepath.Clean(local) == root
+}
+
+// cleanRelPath normalizes a user path to a clean slash separated relative path
+func cleanRelPath(userPath string) (string, error) {
+	path := strings.TrimSpace(userPath)
+	if strings.ContainsRune(path, 0) || hasVolumeName(path) {
+		return "", &PathError{Code: resp.CodeInvalidPath, Path: userPath, Err: ErrPathInvalid}
+	}
+
+	path = strings.ReplaceAll(path, "\\", "/")
+	var segs []string
+	for _, seg := range strings.Split(path, "/") {
+		switch seg {
+		case "", ".":
+			continue
+		case "..":
+			return "", &PathError{Code: resp.CodePathTraversal, Path: userPath, Err: ErrPathTraversal}
+		}
+		segs = append(segs, seg)
+	}
+	if len(segs) > 0 && segs[0] == stateDirName {
+		return "", &PathError{Code: resp.CodePathReserved, Path: userPath, Err: ErrPathReserved}
+	}
+	return strings.Join(segs, "/"), nil
+}
+
+// StateDir returns the dir for server owned state named name, creating it if needed
+func (p *PathResolver) StateDir(name string) (string, error) {
+	root, err := p.Root()
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve work dir: %w", err)
+	}
+	dir := filepath.Join(root, stateDirName, name)
+	if err := p.fs.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// isStateDir reports whether local is the state dir or inside it
+func isStateDir(root, local string) bool {
+	return within(filepath.Join(root, stateDirName), local)
+}
+
+// hasVolumeName catches windows drive letters and UNC prefixes on every platform
+func hasVolumeName(path string) bool {
+	if len(path) >= 2 && (path[1] == ':' || isSlash(path[0]) && isSlash(path[1])) {
+		return true
+	}
+	return filepath.VolumeName(path) != ""
+}
+
+func isSlash(c byte) bool {
+	return c == '/' || c == '\\'
+}
+
+// checkSymlinks follows symlinks of the deepest existing ancestor of local
+// and makes sure the real path stays inside root
+func checkSymlinks(fsys Storage, root, local, userPath string) error {
+	for p := local; ; {
+		real, err := fsys.EvalSymlinks(p)
+		if err == nil {
+			if !within(root, real) {
+				return &PathError{Code: resp.CodeSymlinkEscape, Path: userPath, Err: ErrPathEscape}
+			}
+			return nil
+		}
+		// ENOTDIR: a parent is a regular file, the path just doesn't exist
+		if !os.IsNotExist(err) && !errors.Is(err, syscall.ENOTDIR) {
+			return fmt.Errorf("failed to resolve path: %w", err)
+		}
+
+		// dangling symlink, creating through it would write to its target
+		if fi, lerr := fsys.Lstat(p); lerr == nil && fi.Mode()&os.ModeSymlink != 0 {
+			return &PathError{Code: resp.CodeSymlinkEscape, Path: userPath, Err: ErrPathEscape}
+		}
+
+		parent := filepath.Dir(p)
+		if parent == p || !within(root, parent) {
+			return nil
+		}
+		p = parent
+	}
+}
+
+// within reports whether path is root or inside root
+func within(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newPathFixture builds a work dir with a dir, a regular file, a symlink
+// inside the root, one escaping it and a dangling one
+func newPathFixture(t *testing.T) (*PathResolver, string) {
+	t.Helper()
+	base := t.TempDir()
+	root := filepath.Join(base, "root")
+	outside := filepath.Join(base, "outside")
+	for _, dir := range []string{filepath.Join(root, "a"), outside} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(root, "f.txt"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"in":      "a",
+		"abs":     filepath.Join(root, "a"),
+		"out":     outside,
+		"up":      "..",
+		"a/deep":  "../../outside",
+		"dangle":  filepath.Join(root, "missing"),
+		"a/chain": "../out",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	paths := NewPathResolver(NewOSStorage(root))
+	real, err := paths.Root()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return paths, real
+}
+
+func TestResolve(t *testing.T) {
+	paths, root := newPathFixture(t)
+
+	tests := []struct {
+		name string
+		path string
+		// local path relative to root, when err is nil
+		want string
+		err  error
+	}{
+		{name: "empty is root", path: "", want: ""},
+		{name: "slash is root", path: "/", want: ""},
+		{name: "plain", path: "a/b.txt", want: "a/b.txt"},
+		{name: "leading slash", path: "/a/b.txt", want: "a/b.txt"},
+		{name: "dot segments", path: "./a/./b.txt", want: "a/b.txt"},
+		{name: "backslashes", path: `a\b.txt`, want: "a/b.txt"},
+		{name: "reserved name below first segment", path: "a/.httpserver", want: "a/.httpserver"},
+
+		{name: "parent", path: "..", err: ErrPathTraversal},
+		{name: "parent prefix", path: "../etc/passwd", err: ErrPathTraversal},
+		{name: "parent after dir", path: "a/../../etc", err: ErrPathTraversal},
+		{name: "parent staying inside", path: "a/../f.txt", err: ErrPathTraversal},
+		{name: "absolute parent", path: "/../etc", err: ErrPathTraversal},
+		{name: "backslash parent", path: `..\etc`, err: ErrPathTraversal},
+		{name: "mixed separators", path: `a\..\../etc`, err: ErrPathTraversal},
+		{name: "trailing parent", path: "a/..", err: ErrPathTraversal},
+		// handlers get decoded values, anything still encoded is a literal name
+		{name: "encoded dots", path: "%2e%2e/etc", want: "%2e%2e/etc"},
+		{name: "encoded slash", path: "..%2fetc", want: "..%2fetc"},
+		{name: "double encoded", path: "%252e%252e%252fetc", want: "%252e%252e%252fetc"},
+
+		{name: "nul", path: "a\x00b", err: ErrPathInvalid},
+		{name: "nul after dir", path: "a/\x00", err: ErrPathInvalid},
+		{name: "drive letter", path: "C:/Windows", err: ErrPathInvalid},
+		{name: "drive relative", path: "c:evil", err: ErrPathInvalid},
+		{name: "drive backslash", path: `D:\x`, err: ErrPathInvalid},
+		{name: "unc", path: `\\server\share\x`, err: ErrPathInvalid},
+		{name: "unc forward slashes", path: "//server/share/x", err: ErrPathInvalid},
+		{name: "unc device", path: `\\?\C:\x`, err: ErrPathInvalid},
+
+		{name: "state dir", path: ".httpserver", err: ErrPathReserved},
+		{name: "inside state dir", path: ".httpserver/tus/x", err: ErrPathReserved},
+		{name: "state dir leading slash", path: "/.httpserver", err: ErrPathReserved},
+		{name: "state dir dot prefix", path: "./.httpserver/x", err: ErrPathReserved},
+		{name: "state dir backslash", path: `\.httpserver\x`, err: ErrPathReserved},
+
+		{name: "relative symlink inside", path: "in/x", want: "in/x"},
+		{name: "absolute symlink inside", path: "abs", want: "abs"},
+		{name: "escaping symlink", path: "out", err: ErrPathEscape},
+		{name: "below escaping symlink", path: "out/x", err: ErrPathEscape},
+		{name: "symlink to parent back inside", path: "up/root/f.txt", want: "up/root/f.txt"},
+		{name: "symlink to parent", path: "up/outside/x", err: ErrPathEscape},
+		{name: "nested escaping symlink", path: "a/deep", err: ErrPathEscape},
+		{name: "chained escaping symlink", path: "a/chain/x", err: ErrPathEscape},
+		{name: "dangling symlink", path: "dangle", err: ErrPathEscape},
+		{name: "below dangling symlink", path: "dangle/x", err: ErrPathEscape},
+
+		{name: "below regular file", path: "f.txt/x", want: "f.txt/x"},
+		{name: "deep below regular file", path: "f.txt/x/y", want: "f.txt/x/y"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := paths.Resolve(tt.path)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("Resolve(%q) = %q, %v; want error %v", tt.path, got, err, tt.err)
+				}
+				var pathErr *PathError
+				if !errors.As(err, &pathErr) {
+					t.Fatalf("Resolve(%q) error %T is not a *PathError", tt.path, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Resolve(%q) failed: %v", tt.path, err)
+			}
+			if want := filepath.Join(root, filepath.FromSlash(tt.want)); got != want {
+				t.Fatalf("Resolve(%q) = %q; want %q", tt.path, got, want)
+			}
+		})
+	}
+}
+
+func TestResolveName(t *testing.T) {
+	paths, root := newPathFixture(t)
+
+	tests := []struct {
+		name string
+		dir  string
+		file string
+		want string
+		err  error
+	}{
+		{name: "plain", dir: "a", file: "b.txt", want: "a/b.txt"},
+		{name: "dotfile", dir: "", file: ".env", want: ".env"},
+		{name: "reserved name below root", dir: "a", file: ".httpserver", want: "a/.httpserver"},
+
+		{name: "empty", dir: "", file: "", err: ErrPathInvalid},
+		{name: "dot", dir: "a", file: ".", err: ErrPathInvalid},
+		{name: "parent", dir: "a", file: "..", err: ErrPathInvalid},
+		{name: "slash", dir: "", file: "a/b", err: ErrPathInvalid},
+		{name: "traversal", dir: "a", file: "../../etc", err: ErrPathInvalid},
+		{name: "backslash", dir: "", file: `..\etc`, err: ErrPathInvalid},
+		{name: "nul", dir: "", file: "b\x00.txt", err: ErrPathInvalid},
+		{name: "drive letter", dir: "", file: "C:evil", err: ErrPathInvalid},
+
+		{name: "state dir", dir: "", file: ".httpserver", err: ErrPathReserved},
+		{name: "escaping symlink", dir: "", file: "out", err: ErrPathEscape},
+		{name: "dangling symlink", dir: "", file: "dangle", err: ErrPathEscape},
+		{name: "nested escaping symlink", dir: "a", file: "deep", err: ErrPathEscape},
+		{name: "below regular file", dir: "f.txt", file: "x", want: "f.txt/x"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := filepath.Join(root, filepath.FromSlash(tt.dir))
+			got, err := paths.ResolveName(dir, tt.file)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("ResolveName(%q, %q) = %q, %v; want error %v", tt.dir, tt.file, got, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ResolveName(%q, %q) failed: %v", tt.dir, tt.file, err)
+			}
+			if want := filepath.Join(root, filepath.FromSlash(tt.want)); got != want {
+				t.Fatalf("ResolveName(%q, %q) = %q; want %q", tt.dir, tt.file, got, want)
+			}
+		})
+	}
+}
+
+func TestPathErrorStatus(t *testing.T) {
+	paths, _ := newPathFixture(t)
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"../x", 403},
+		{"out", 403},
+		{".httpserver", 403},
+		{"a\x00", 400},
+		{"C:/x", 400},
+	}
+	for _, tt := range tests {
+		_, err := paths.Resolve(tt.path)
+		var pathErr *PathError
+		if !errors.As(err, &pathErr) {
+			t.Fatalf("Resolve(%q) = %v; want a *PathError", tt.path, err)
+		}
+		if got := pathErr.Status(); got != tt.status {
+			t.Errorf("Resolve(%q) status = %d; want %d", tt.path, got, tt.status)
+		}
+	}
+}
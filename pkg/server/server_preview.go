@@ -0,0 +1,149 @@
+package server
+
+import (
+	"fmt"
+	"html/template"
+	logger "httpserver/pkg/log"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// text files up to this size are shown on the preview page, larger ones are
+// served as plain text
+const previewMaxSize = 1 << 20
+
+// PreviewData is the preview page of a text file
+type PreviewData struct {
+	// path relative to workDir
+	Path string
+	Name string
+	// href of the containing directory
+	Dir   string
+	Size  int64
+	Lines []template.HTML
+}
+
+// textTypes are the non text/* types shown as text
+var textTypes = map[string]bool{
+	"application/json":       true,
+	"application/javascript": true,
+	"application/xml":        true,
+	"application/x-sh":       true,
+	"application/toml":       true,
+	"application/yaml":       true,
+	"application/x-yaml":     true,
+	"application/sql":        true,
+}
+
+// isTextType reports whether a file of type mediaType or named name is text
+func isTextType(mediaType, name string) bool {
+	if strings.HasPrefix(mediaType, "text/") || textTypes[mediaType] {
+		return true
+	}
+	_, ok := highlightLangs[strings.ToLower(path.Ext(name))]
+	return ok
+}
+
+// isInlineType reports whether browsers can show a file of type mediaType themselves
+func isInlineType(mediaType string) bool {
+	switch {
+	case strings.HasPrefix(mediaType, "image/"),
+		strings.HasPrefix(mediaType, "audio/"),
+		strings.HasPrefix(mediaType, "video/"),
+		mediaType == "application/pdf":
+		return true
+	}
+	return false
+}
+
+// serveBrowserFile shows a file in the browser: images, PDF, audio and video
+// inline, text on the preview page and other files as a download
+// query params:
+// - download: if true, always download
+func (s *Server) serveBrowserFile(w http.ResponseWriter, r *http.Request, localPath string, info os.FileInfo) {
+	download := false
+	if v := r.URL.Query().Get("download"); v != "" {
+		var err error
+		if download, err = strconv.ParseBool(v); err != nil {
+			logger.Error(fmt.Sprintf("invalid download: %q", v))
+			http.Error(w, fmt.Sprintf("invalid download: %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctype := detectMimeType(s.fs, localPath, info.Name())
+	mediaType, params, err := mime.ParseMediaType(ctype)
+	if err != nil {
+		ctype, mediaType = "application/octet-stream", "application/octet-stream"
+	}
+
+	disposition := "attachment"
+	if !download {
+		switch {
+		case isTextType(mediaType, info.Name()):
+			if info.Size() <= previewMaxSize && s.servePreview(w, r, localPath, info) {
+				return
+			}
+			// never let the browser render html or svg sent as text
+			ctype = mime.FormatMediaType("text/plain", params)
+			disposition = "inline"
+		case isInlineType(mediaType):
+			disposition = "inline"
+			if mediaType == "image/svg+xml" {
+				// svg can carry scripts
+				w.Header().Set("Content-Security-Policy", "sandbox")
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", ctype)
+	file, servedInfo, err := s.openPrecompressed(w, r, localPath, info)
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to open file: %v", err))
+		http.Error(w, "failed to open file", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Disposition", contentDisposition(disposition, info.Name()))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	s.serveFile(w, r, file, servedInfo)
+}
+
+// servePreview renders the preview page of a text file, false when the
+// content is not UTF-8 text
+func (s *Server) servePreview(w http.ResponseWriter, r *http.Request, localPath string, info os.FileInfo) bool {
+	file, err := s.fs.Open(localPath)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	b, err := io.ReadAll(io.LimitReader(file, previewMaxSize))
+	if err != nil || !utf8.Valid(b) {
+		return false
+	}
+
+	rel := s.paths.Rel(localPath)
+	dir := path.Dir("/" + rel)
+	if dir == "/" {
+		dir = ""
+	}
+	data := PreviewData{
+		Path:  rel,
+		Name:  info.Name(),
+		Dir:   dir,
+		Size:  info.Size(),
+		Lines: highlight(info.Name(), strings.TrimSuffix(string(b), "\n")),
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := previewTemplate.Execute(w, data); err != nil {
+		logger.Error(fmt.Sprintf("failed to execute template: %v", err))
+	}
+	return true
+}
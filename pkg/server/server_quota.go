@@ -0,0 +1,344 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	resp "httpserver/internal/response"
+	logger "httpserver/pkg/log"
+	"io"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// the usage of the work dir is counted once at start, then every handler
+// adding or removing content updates it. Directories are not counted.
+// Deleted files in the trash and the replaced content kept as versions still
+// count toward the quota of their original path until purged or pruned,
+// pending uploads are held by reservations only. Changes made to the work
+// dir by other programs are only seen after a restart.
+
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// DirQuota limits the content of a directory, zero means no limit
+type DirQuota struct {
+	MaxBytes int64 `json:"max_bytes"`
+	MaxFiles int64 `json:"max_files"`
+}
+
+func (q DirQuota) limited() bool {
+	return q.MaxBytes > 0 || q.MaxFiles > 0
+}
+
+// quotaUsage is an amount of content, negative when content goes away
+type quotaUsage struct {
+	Bytes int64
+	Files int64
+}
+
+func (u quotaUsage) sub(other quotaUsage) quotaUsage {
+	return quotaUsage{Bytes: u.Bytes - other.Bytes, Files: u.Files - other.Files}
+}
+
+// quotaScope is a limited directory, "" for the work dir
+type quotaScope struct {
+	path     string
+	limit    DirQuota
+	used     quotaUsage
+	reserved quotaUsage
+}
+
+// contains reports whether rel is inside the scope
+func (q *quotaScope) contains(rel string) bool {
+	return q.path == "" || rel == q.path || strings.HasPrefix(rel, q.path+"/")
+}
+
+// fits reports whether delta more content stays within the limit
+func (q *quotaScope) fits(delta quotaUsage) bool {
+	if q.limit.MaxBytes > 0 && delta.Bytes > 0 && q.used.Bytes+q.reserved.Bytes+delta.Bytes > q.limit.MaxBytes {
+		return false
+	}
+	if q.limit.MaxFiles > 0 && delta.Files > 0 && q.used.Files+q.reserved.Files+delta.Files > q.limit.MaxFiles {
+		return false
+	}
+	return true
+}
+
+type quotaTracker struct {
+	fs     Storage
+	paths  *PathResolver
+	scopes []*quotaScope
+
+	mu sync.Mutex
+}
+
+// newQuotaTracker tracks the work dir against global and each entry of dirs,
+// keyed by path relative to the work dir
+func newQuotaTracker(fs Storage, paths *PathResolver, global DirQuota, dirs map[string]DirQuota) *quotaTracker {
+	t := &quotaTracker{fs: fs, paths: paths}
+	if global.limited() {
+		t.scopes = append(t.scopes, &quotaScope{path: "", limit: global})
+	}
+	for dir, limit := range dirs {
+		rel, err := cleanRelPath(dir)
+		if err != nil {
+			logger.Warn(fmt.Sprintf("ignore quota of %q: %v", dir, err))
+			continue
+		}
+		if !limit.limited() {
+			continue
+		}
+		t.scopes = append(t.scopes, &quotaScope{path: rel, limit: limit})
+	}
+	// the innermost dir is reported first when several are exceeded
+	sort.Slice(t.scopes, func(i, j int) bool { return len(t.scopes[i].path) > len(t.scopes[j].path) })
+	return t
+}
+
+// enabled reports whether any limit is configured, nothing is tracked otherwise
+func (t *quotaTracker) enabled() bool {
+	return len(t.scopes) > 0
+}
+
+// quotaStore keeps content removed from the work dir that still counts
+type quotaStore interface {
+	// stored calls count with the original path and usage of every item
+	stored(count func(local string, u quotaUsage))
+}
+
+// scan counts the current content of the work dir and of stores
+func (t *quotaTracker) scan(stores ...quotaStore) {
+	if !t.enabled() {
+		return
+	}
+	root, err := t.paths.Root()
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to resolve work dir: %v", err))
+		return
+	}
+
+	// collected first, the stores update the tracker under their own lock
+	type storedUsage struct {
+		local string
+		u     quotaUsage
+	}
+	var stored []storedUsage
+	for _, store := range stores {
+		store.stored(func(local string, u quotaUsage) {
+			stored = append(stored, storedUsage{local, u})
+		})
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, q := range t.scopes {
+		q.used = quotaUsage{}
+	}
+	for _, item := range stored {
+		t.add(item.local, item.u)
+	}
+	walkDir(t.fs, root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			logger.Warn(fmt.Sprintf("quota scan skips %v: %v", p, err))
+			return nil
+		}
+		if isStateDir(root, p) {
+			return filepath.SkipDir
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		t.add(p, quotaUsage{Bytes: info.Size(), Files: 1})
+		return nil
+	})
+	for _, q := range t.scopes {
+		logger.Info(fmt.Sprintf("quota usage of %q: %d bytes, %d files", "/"+q.path, q.used.Bytes, q.used.Files))
+	}
+}
+
+// update records content added at (or, when negative, removed from) local
+func (t *quotaTracker) update(local string, delta quotaUsage) {
+	if !t.enabled() {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.add(local, delta)
+}
+
+// add records delta at local, t.mu must be held
+func (t *quotaTracker) add(local string, delta quotaUsage) {
+	rel := t.paths.Rel(local)
+	for _, q := range t.scopes {
+		if q.contains(rel) {
+			q.used.Bytes += delta.Bytes
+			q.used.Files += delta.Files
+		}
+	}
+}
+
+// moved records content moving from one path to another
+func (t *quotaTracker) moved(from, to string, u quotaUsage) {
+	t.update(from, quotaUsage{}.sub(u))
+	t.update(to, u)
+}
+
+// quotaReservation holds room for content being written, so concurrent
+// writers can't overrun a limit together
+type quotaReservation struct {
+	t      *quotaTracker
+	scopes []*quotaScope
+	amount quotaUsage
+}
+
+// reserve holds room for delta at local, scopes also containing from are
+// skipped as the content only moves inside them. from may be empty.
+func (t *quotaTracker) reserve(local string, delta quotaUsage, from string) (*quotaReservation, error) {
+	res := &quotaReservation{t: t}
+	if !t.enabled() {
+		return res, nil
+	}
+	rel := t.paths.Rel(local)
+	fromRel := ""
+	if from != "" {
+		fromRel = t.paths.Rel(from)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, q := range t.scopes {
+		if !q.contains(rel) || (from != "" && q.contains(fromRel)) {
+			continue
+		}
+		res.scopes = append(res.scopes, q)
+	}
+	if err := res.add(delta); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// check reports whether delta fits at local without holding the room
+func (t *quotaTracker) check(local string, delta quotaUsage) error {
+	res, err := t.reserve(local, delta, "")
+	if err != nil {
+		return err
+	}
+	res.release()
+	return nil
+}
+
+// add reserves delta more, t.mu must be held
+func (r *quotaReservation) add(delta quotaUsage) error {
+	for _, q := range r.scopes {
+		if !q.fits(delta) {
+			return fmt.Errorf("%w: /%v", ErrQuotaExceeded, q.path)
+		}
+	}
+	// only growth is held, room freed by a delta is not handed out early
+	held := quotaUsage{Bytes: max(delta.Bytes, 0), Files: max(delta.Files, 0)}
+	for _, q := range r.scopes {
+		q.reserved.Bytes += held.Bytes
+		q.reserved.Files += held.Files
+	}
+	r.amount.Bytes += held.Bytes
+	r.amount.Files += held.Files
+	return nil
+}
+
+// grow reserves delta more
+func (r *quotaReservation) grow(delta quotaUsage) error {
+	if len(r.scopes) == 0 {
+		return nil
+	}
+	r.t.mu.Lock()
+	defer r.t.mu.Unlock()
+	return r.add(delta)
+}
+
+// release gives the room back, the written content is recorded with update
+func (r *quotaReservation) release() {
+	if len(r.scopes) == 0 {
+		return
+	}
+	r.t.mu.Lock()
+	defer r.t.mu.Unlock()
+	for _, q := range r.scopes {
+		q.reserved = q.reserved.sub(r.amount)
+	}
+	r.amount = quotaUsage{}
+}
+
+// quotaWriter reserves room for every write before passing it on
+type quotaWriter struct {
+	w   io.Writer
+	res *quotaReservation
+}
+
+func (q *quotaWriter) Write(p []byte) (int, error) {
+	if err := q.res.grow(quotaUsage{Bytes: int64(len(p))}); err != nil {
+		return 0, err
+	}
+	return q.w.Write(p)
+}
+
+// usage counts the content at local, a file or a whole directory, it is not
+// walked when nothing is tracked
+func (t *quotaTracker) usage(local string) quotaUsage {
+	u := quotaUsage{}
+	if !t.enabled() {
+		return u
+	}
+	walkDir(t.fs, local, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			u.Bytes += info.Size()
+			u.Files++
+		}
+		return nil
+	})
+	return u
+}
+
+// quotaErrorResponse answers 507 Insufficient Storage
+func quotaErrorResponse(err error) resp.Response {
+	return errorCodeResponse(http.StatusInsufficientStorage, resp.CodeQuotaExceeded, err)
+}
+
+// QuotaReport is the usage of a limited directory
+type QuotaReport struct {
+	// path relative to workDir, "" for workDir itself
+	Path      string `json:"path"`
+	MaxBytes  int64  `json:"max_bytes"`
+	MaxFiles  int64  `json:"max_files"`
+	UsedBytes int64  `json:"used_bytes"`
+	UsedFiles int64  `json:"used_files"`
+}
+
+// reports the usage of every limited directory
+func (s *Server) quotaHandler(w http.ResponseWriter, r *http.Request) resp.Response {
+	s.quota.mu.Lock()
+	reports := make([]QuotaReport, 0, len(s.quota.scopes))
+	for _, q := range s.quota.scopes {
+		reports = append(reports, QuotaReport{
+			Path:      q.path,
+			MaxBytes:  q.limit.MaxBytes,
+			MaxFiles:  q.limit.MaxFiles,
+			UsedBytes: q.used.Bytes,
+			UsedFiles: q.used.Files,
+		})
+	}
+	s.quota.mu.Unlock()
+
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Path < reports[j].Path })
+	return successResponse(http.StatusOK, "Quota successfully", reports)
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestQuotaLimits(t *testing.T) {
+	type step struct {
+		dir, name, content, query string
+		status                    int
+	}
+	tests := []struct {
+		name  string
+		steps []step
+		// usage of the work dir and of lim afterwards
+		used, limUsed quotaUsage
+	}{
+		{
+			name:  "fits",
+			steps: []step{{dir: "lim", name: "a.txt", content: "12345", status: http.StatusOK}},
+			used:  quotaUsage{Bytes: 10, Files: 2}, limUsed: quotaUsage{Bytes: 10, Files: 2},
+		},
+		{
+			name:  "dir bytes",
+			steps: []step{{dir: "lim", name: "a.txt", content: "123456", status: http.StatusInsufficientStorage}},
+			used:  quotaUsage{Bytes: 5, Files: 1}, limUsed: quotaUsage{Bytes: 5, Files: 1},
+		},
+		{
+			name: "dir files",
+			steps: []step{
+				{dir: "lim/d", name: "a.txt", content: "1", status: http.StatusOK},
+				{dir: "lim/d", name: "b.txt", content: "1", status: http.StatusInsufficientStorage},
+			},
+			used: quotaUsage{Bytes: 6, Files: 2}, limUsed: quotaUsage{Bytes: 6, Files: 2},
+		},
+		{
+			// the staged content sits beside the replaced file until placed
+			name:  "overwrite",
+			steps: []step{{dir: "lim", name: "x.txt", content: "54321", query: "overwrite=true", status: http.StatusOK}},
+			used:  quotaUsage{Bytes: 5, Files: 1}, limUsed: quotaUsage{Bytes: 5, Files: 1},
+		},
+		{
+			name:  "overwrite too large",
+			steps: []step{{dir: "lim", name: "x.txt", content: "123456", query: "overwrite=true", status: http.StatusInsufficientStorage}},
+			used:  quotaUsage{Bytes: 5, Files: 1}, limUsed: quotaUsage{Bytes: 5, Files: 1},
+		},
+		{
+			name: "global",
+			steps: []step{
+				{name: "a.txt", content: strings.Repeat("a", 96), status: http.StatusInsufficientStorage},
+				{name: "a.txt", content: strings.Repeat("a", 95), status: http.StatusOK},
+			},
+			used: quotaUsage{Bytes: 100, Files: 2}, limUsed: quotaUsage{Bytes: 5, Files: 1},
+		},
+		{
+			name: "freed by a rejected upload",
+			steps: []step{
+				{dir: "lim", name: "a.txt", content: "123456", status: http.StatusInsufficientStorage},
+				{dir: "lim", name: "b.txt", content: "12345", status: http.StatusOK},
+			},
+			used: quotaUsage{Bytes: 10, Files: 2}, limUsed: quotaUsage{Bytes: 10, Files: 2},
+		},
+	}
+	config := ServerConfig{
+		QuotaMaxBytes: 100,
+		DirQuotas:     map[string]DirQuota{"lim": {MaxBytes: 10, MaxFiles: 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachStorage(t, config, func(t *testing.T, ts *testServer) {
+				ts.upload("lim", map[string]string{"x.txt": "12345"}, "", http.StatusOK)
+				for _, s := range tt.steps {
+					ts.upload(s.dir, map[string]string{s.name: s.content}, s.query, s.status)
+				}
+
+				reports := ts.usage()
+				if len(reports) != 2 {
+					t.Fatalf("reports %+v; want the work dir and lim", reports)
+				}
+				for i, want := range []quotaUsage{tt.used, tt.limUsed} {
+					if got := reports[i]; got.UsedBytes != want.Bytes || got.UsedFiles != want.Files {
+						t.Errorf("usage of %q = %d bytes, %d files; want %+v", got.Path, got.UsedBytes, got.UsedFiles, want)
+					}
+				}
+			})
+		})
+	}
+}
+
+// concurrent uploads never overrun the quota together
+func TestQuotaConcurrentUploads(t *testing.T) {
+	const n, size, limit = 20, 100, 1000
+	config := ServerConfig{DirQuotas: map[string]DirQuota{"lim": {MaxBytes: limit}}}
+	forEachStorage(t, config, func(t *testing.T, ts *testServer) {
+		post := func(name string) int {
+			var body bytes.Buffer
+			mw := multipart.NewWriter(&body)
+			part, _ := mw.CreateFormFile("file", name)
+			part.Write([]byte(strings.Repeat("x", size)))
+			mw.Close()
+			return ts.do("POST", "/upload?distPath=lim", &body, mw.FormDataContentType()).Code
+		}
+
+		codes := make([]int, n)
+		var wg sync.WaitGroup
+		for i := range n {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				codes[i] = post(fmt.Sprintf("f%d.txt", i))
+			}()
+		}
+		wg.Wait()
+
+		stored := 0
+		for i, code := range codes {
+			switch code {
+			case http.StatusOK:
+				stored++
+			case http.StatusInsufficientStorage:
+			default:
+				t.Fatalf("upload %d = %d", i, code)
+			}
+		}
+		if stored == 0 || stored*size > limit {
+			t.Fatalf("%d uploads stored; want 1 to %d", stored, limit/size)
+		}
+		if files := ts.files("lim"); len(files) != stored {
+			t.Fatalf("%d files in lim; want %d", len(files), stored)
+		}
+		if got := ts.usage()[0]; got.UsedBytes != int64(stored*size) || got.UsedFiles != int64(stored) {
+			t.Fatalf("usage = %+v; want %d files", got, stored)
+		}
+
+		// nothing is left reserved, the rest of the room can be filled
+		for i := stored; i < limit/size; i++ {
+			if code := post(fmt.Sprintf("g%d.txt", i)); code != http.StatusOK {
+				t.Fatalf("upload into the free room = %d", code)
+			}
+		}
+		if code := post("full.txt"); code != http.StatusInsufficientStorage {
+			t.Fatalf("upload past the limit = %d", code)
+		}
+	})
+}
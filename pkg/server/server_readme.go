@@ -0,0 +1,68 @@
+package server
+
+import (
+	"fmt"
+	"html/template"
+	logger "httpserver/pkg/log"
+	"io"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// READMEs larger than this are not shown in listings
+const readmeMaxSize = 256 << 10
+
+// readmeNames are the files shown below a listing, in order of preference
+var readmeNames = []string{"README.md", "README.txt"}
+
+// readme renders the README of the directory at localPath, files being its
+// entries. It returns the name of the file and its HTML, both empty when
+// the dir has no README that can be shown.
+func (s *Server) readme(localPath string, files []fs.DirEntry) (string, template.HTML) {
+	for _, want := range readmeNames {
+		for _, f := range files {
+			if !strings.EqualFold(f.Name(), want) || f.IsDir() {
+				continue
+			}
+			// a README may be a symlink pointing outside of workDir
+			local, err := s.paths.ResolveName(localPath, f.Name())
+			if err != nil {
+				logger.Warn(fmt.Sprintf("skip readme %v: %v", f.Name(), err))
+				continue
+			}
+			src, ok := s.readReadme(local)
+			if !ok {
+				return "", ""
+			}
+			if strings.EqualFold(path.Ext(want), ".md") {
+				base := "/files/" + filepath.ToSlash(s.paths.Rel(localPath))
+				return f.Name(), renderMarkdown(src, strings.TrimSuffix(base, "/"))
+			}
+			return f.Name(), template.HTML("<pre>" + template.HTMLEscapeString(src) + "</pre>")
+		}
+	}
+	return "", ""
+}
+
+// readReadme returns the content of a README, false when it is too large or
+// not UTF-8 text
+func (s *Server) readReadme(localPath string) (string, bool) {
+	info, err := s.fs.Stat(localPath)
+	if err != nil || !info.Mode().IsRegular() || info.Size() > readmeMaxSize {
+		return "", false
+	}
+	file, err := s.fs.Open(localPath)
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to open readme: %v", err))
+		return "", false
+	}
+	defer file.Close()
+	b, err := io.ReadAll(io.LimitReader(file, readmeMaxSize))
+	if err != nil || !utf8.Valid(b) {
+		return "", false
+	}
+	return string(b), true
+}
@@ -0,0 +1,888 @@
+package server
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	logger "httpserver/pkg/log"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3 compatible frontend, served on its own listener when S3Addr is set.
+// Buckets are the top-level dirs of the work dir and object keys the paths
+// inside them, only path style urls (http://host/bucket/key) are supported.
+// An empty dir shows up as a "dir/" key, like the folders of the S3 console.
+// Objects are written like uploads: staged, then placed replacing the old
+// content which is kept as a version. Deleted objects go to the trash.
+
+const (
+	s3Namespace  = "http://s3.amazonaws.com/doc/2006-03-01/"
+	s3TimeFormat = "2006-01-02T15:04:05.000Z"
+	s3MaxKeys    = 1000
+	// largest xml body accepted, for multi object delete and multipart completion
+	s3MaxXMLSize = 2 << 20
+)
+
+// s3Error is an error answered with the S3 error document
+type s3Error struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *s3Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// s3Errorf returns base with another message
+func s3Errorf(base *s3Error, format string, args ...any) *s3Error {
+	return &s3Error{Status: base.Status, Code: base.Code, Message: fmt.Sprintf(format, args...)}
+}
+
+var (
+	errS3AccessDenied          = &s3Error{http.StatusForbidden, "AccessDenied", "access denied"}
+	errS3InvalidAccessKey      = &s3Error{http.StatusForbidden, "InvalidAccessKeyId", "the access key id does not exist"}
+	errS3SignatureMismatch     = &s3Error{http.StatusForbidden, "SignatureDoesNotMatch", "the request signature does not match"}
+	errS3TimeSkewed            = &s3Error{http.StatusForbidden, "RequestTimeTooSkewed", "the request time is too far from the server time"}
+	errS3InvalidArgument       = &s3Error{http.StatusBadRequest, "InvalidArgument", "invalid argument"}
+	errS3InvalidRequest        = &s3Error{http.StatusBadRequest, "InvalidRequest", "invalid request"}
+	errS3InvalidBucketName     = &s3Error{http.StatusBadRequest, "InvalidBucketName", "invalid bucket name"}
+	errS3EntityTooLarge        = &s3Error{http.StatusBadRequest, "EntityTooLarge", "the object exceeds the maximum upload size"}
+	errS3IncompleteBody        = &s3Error{http.StatusBadRequest, "IncompleteBody", "the body is shorter than the content length"}
+	errS3BadDigest             = &s3Error{http.StatusBadRequest, "BadDigest", "the Content-MD5 does not match the body"}
+	errS3ContentSHA256Mismatch = &s3Error{http.StatusBadRequest, "XAmzContentSHA256Mismatch", "the x-amz-content-sha256 does not match the body"}
+	errS3MalformedXML          = &s3Error{http.StatusBadRequest, "MalformedXML", "malformed xml"}
+	errS3InvalidPart           = &s3Error{http.StatusBadRequest, "InvalidPart", "a part is missing or its etag does not match"}
+	errS3InvalidPartOrder      = &s3Error{http.StatusBadRequest, "InvalidPartOrder", "the parts are not in ascending order"}
+	errS3NoSuchBucket          = &s3Error{http.StatusNotFound, "NoSuchBucket", "the bucket does not exist"}
+	errS3NoSuchKey             = &s3Error{http.StatusNotFound, "NoSuchKey", "the key does not exist"}
+	errS3NoSuchUpload          = &s3Error{http.StatusNotFound, "NoSuchUpload", "the upload does not exist"}
+	errS3BucketExists          = &s3Error{http.StatusConflict, "BucketAlreadyOwnedByYou", "the bucket already exists"}
+	errS3BucketNotEmpty        = &s3Error{http.StatusConflict, "BucketNotEmpty", "the bucket is not empty"}
+	errS3KeyConflict           = &s3Error{http.StatusConflict, "InvalidRequest", "the key conflicts with a directory or a file"}
+	errS3MissingContentLength  = &s3Error{http.StatusLengthRequired, "MissingContentLength", "the content length is required"}
+	errS3Internal              = &s3Error{http.StatusInternalServerError, "InternalError", "internal error"}
+	errS3NotImplemented        = &s3Error{http.StatusNotImplemented, "NotImplemented", "not implemented"}
+	errS3QuotaExceeded         = &s3Error{http.StatusInsufficientStorage, "QuotaExceeded", "quota exceeded"}
+)
+
+type s3ErrorBody struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string
+	Message  string
+	Resource string
+}
+
+// s3WriteError answers err as an S3 error document
+func s3WriteError(w http.ResponseWriter, r *http.Request, err error) {
+	logger.Error(fmt.Sprintf("s3 %v %v: %v", r.Method, r.URL.Path, err))
+	var e *s3Error
+	switch {
+	case errors.As(err, &e):
+	case errors.Is(err, ErrQuotaExceeded):
+		e = s3Errorf(errS3QuotaExceeded, "%v", err)
+	default:
+		e = errS3Internal
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(e.Status)
+	if r.Method == http.MethodHead {
+		return
+	}
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(s3ErrorBody{Code: e.Code, Message: e.Message, Resource: r.URL.Path})
+}
+
+// s3WriteXML answers v as an xml document
+func s3WriteXML(w http.ResponseWriter, v any) error {
+	b, err := xml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("Content-Length", strconv.Itoa(len(xml.Header)+len(b)))
+	io.WriteString(w, xml.Header)
+	_, err = w.Write(b)
+	return err
+}
+
+// s3Request is an authenticated request on a bucket or an object
+type s3Request struct {
+	bucket string
+	key    string
+	sig    *s3Signature
+	// payload checked against the signature
+	body io.Reader
+}
+
+// s3Handler serves the S3 api, routed by hand since the operation depends
+// on the query and the key must be kept as sent
+func (s *Server) s3Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := s.s3Serve(w, r); err != nil {
+			s3WriteError(w, r, err)
+		}
+	})
+}
+
+func (s *Server) s3Serve(w http.ResponseWriter, r *http.Request) error {
+	sig, err := s.s3Authenticate(r)
+	if err != nil {
+		return err
+	}
+	body, err := s3Payload(r, sig)
+	if err != nil {
+		return err
+	}
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	req := &s3Request{bucket: bucket, key: key, sig: sig, body: body}
+	q := r.URL.Query()
+
+	switch {
+	case bucket == "":
+		if r.Method == http.MethodGet && !s3HasParams(q) {
+			return s.s3ListBuckets(w, r, req)
+		}
+	case key == "":
+		switch r.Method {
+		case http.MethodGet:
+			if q.Has("location") {
+				return s.s3GetBucketLocation(w, r, req)
+			}
+			if q.Get("list-type") == "2" && !s3HasParams(q, "list-type", "prefix", "delimiter", "max-keys", "continuation-token", "start-after", "encoding-type", "fetch-owner") {
+				return s.s3ListObjects(w, r, req)
+			}
+		case http.MethodHead:
+			if !s3HasParams(q) {
+				return s.s3HeadBucket(w, r, req)
+			}
+		case http.MethodPut:
+			if !s3HasParams(q) {
+				return s.s3CreateBucket(w, r, req)
+			}
+		case http.MethodDelete:
+			if !s3HasParams(q) {
+				return s.s3DeleteBucket(w, r, req)
+			}
+		case http.MethodPost:
+			if q.Has("delete") {
+				return s.s3DeleteObjects(w, r, req)
+			}
+		}
+	default:
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			if !s3HasParams(q, s3ResponseParams...) {
+				return s.s3GetObject(w, r, req)
+			}
+		case http.MethodPut:
+			if q.Has("uploadId") {
+				return s.s3UploadPart(w, r, req)
+			}
+			if r.Header.Get("X-Amz-Copy-Source") == "" && !s3HasParams(q) {
+				return s.s3PutObject(w, r, req)
+			}
+		case http.MethodPost:
+			if q.Has("uploads") {
+				return s.s3CreateMultipartUpload(w, r, req)
+			}
+			if q.Has("uploadId") {
+				return s.s3CompleteMultipartUpload(w, r, req)
+			}
+		case http.MethodDelete:
+			if q.Has("uploadId") {
+				return s.s3AbortMultipartUpload(w, r, req)
+			}
+			if !s3HasParams(q) {
+				return s.s3DeleteObject(w, r, req)
+			}
+		}
+	}
+	return s3Errorf(errS3NotImplemented, "%v %v is not supported", r.Method, r.URL.RequestURI())
+}
+
+// s3HasParams reports whether q holds a param besides known ones, meaning
+// an unsupported sub-resource like ?acl or ?tagging. Presigning params and
+// the x-id added by some sdks are ignored.
+func s3HasParams(q url.Values, known ...string) bool {
+	for k := range q {
+		if strings.HasPrefix(k, "X-Amz-") || k == "x-id" {
+			continue
+		}
+		if !slices.Contains(known, k) {
+			return true
+		}
+	}
+	return false
+}
+
+// s3ResponseParams override headers of a GetObject response
+var s3ResponseParams = []string{
+	"response-content-type",
+	"response-content-language",
+	"response-expires",
+	"response-cache-control",
+	"response-content-disposition",
+	"response-content-encoding",
+}
+
+// s3BucketDir resolves the dir of an existing bucket
+func (s *Server) s3BucketDir(bucket string) (string, error) {
+	root, err := s.paths.Root()
+	if err != nil {
+		return "", err
+	}
+	local, err := s.paths.ResolveName(root, bucket)
+	if err != nil {
+		return "", s3Errorf(errS3InvalidBucketName, "%v", err)
+	}
+	info, err := s.fs.Stat(local)
+	if err != nil || !info.IsDir() {
+		return "", errS3NoSuchBucket
+	}
+	return local, nil
+}
+
+// s3ObjectPath resolves the key of req inside its bucket
+func (s *Server) s3ObjectPath(req *s3Request) (string, error) {
+	if _, err := s.s3BucketDir(req.bucket); err != nil {
+		return "", err
+	}
+	local, err := s.paths.Resolve(req.bucket + "/" + req.key)
+	if err != nil {
+		var pathErr *PathError
+		if errors.As(err, &pathErr) {
+			return "", s3Errorf(errS3InvalidArgument, "invalid key: %v", err)
+		}
+		return "", err
+	}
+	if s.paths.Rel(local) == req.bucket {
+		return "", s3Errorf(errS3InvalidArgument, "invalid key: %q", req.key)
+	}
+	return local, nil
+}
+
+type s3Owner struct {
+	ID          string
+	DisplayName string
+}
+
+type s3Bucket struct {
+	Name         string
+	CreationDate string
+}
+
+type s3ListAllMyBucketsResult struct {
+	XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+	Xmlns   string     `xml:"xmlns,attr"`
+	Owner   s3Owner    `xml:"Owner"`
+	Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+// lists the top-level dirs
+func (s *Server) s3ListBuckets(w http.ResponseWriter, r *http.Request, req *s3Request) error {
+	root, err := s.paths.Root()
+	if err != nil {
+		return err
+	}
+	entries, err := s.fs.ReadDir(root)
+	if err != nil {
+		return err
+	}
+	result := s3ListAllMyBucketsResult{
+		Xmlns: s3Namespace,
+		Owner: s3Owner{ID: req.sig.accessKey, DisplayName: req.sig.accessKey},
+	}
+	for _, e := range entries {
+		if e.Name() == stateDirName {
+			continue
+		}
+		info, err := s.fs.Stat(filepath.Join(root, e.Name()))
+		if err != nil || !info.IsDir() {
+			continue
+		}
+		result.Buckets = append(result.Buckets, s3Bucket{Name: e.Name(), CreationDate: s3Time(info.ModTime())})
+	}
+	return s3WriteXML(w, result)
+}
+
+type s3LocationConstraint struct {
+	XMLName xml.Name `xml:"LocationConstraint"`
+	Xmlns   string   `xml:"xmlns,attr"`
+}
+
+// answers the default region, signatures of any region are accepted
+func (s *Server) s3GetBucketLocation(w http.ResponseWriter, r *http.Request, req *s3Request) error {
+	if _, err := s.s3BucketDir(req.bucket); err != nil {
+		return err
+	}
+	return s3WriteXML(w, s3LocationConstraint{Xmlns: s3Namespace})
+}
+
+func (s *Server) s3HeadBucket(w http.ResponseWriter, r *http.Request, req *s3Request) error {
+	if _, err := s.s3BucketDir(req.bucket); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// creates a top-level dir, the location constraint is ignored
+func (s *Server) s3CreateBucket(w http.ResponseWriter, r *http.Request, req *s3Request) error {
+	root, err := s.paths.Root()
+	if err != nil {
+		return err
+	}
+	local, err := s.paths.ResolveName(root, req.bucket)
+	if err != nil {
+		return s3Errorf(errS3InvalidBucketName, "%v", err)
+	}
+	if err := s.fs.Mkdir(local, 0755); err != nil {
+		if os.IsExist(err) {
+			return errS3BucketExists
+		}
+		return err
+	}
+	syncDir(s.fs, root)
+	w.Header().Set("Location", "/"+req.bucket)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// removes an empty top-level dir
+func (s *Server) s3DeleteBucket(w http.ResponseWriter, r *http.Request, req *s3Request) error {
+	local, err := s.s3BucketDir(req.bucket)
+	if err != nil {
+		return err
+	}
+	entries, err := s.fs.ReadDir(local)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return errS3BucketNotEmpty
+	}
+	if err := s.fs.Remove(local); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+type s3Object struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+type s3CommonPrefix struct {
+	Prefix string
+}
+
+type s3ListBucketResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Xmlns                 string   `xml:"xmlns,attr"`
+	Name                  string
+	Prefix                string
+	Delimiter             string `xml:",omitempty"`
+	StartAfter            string `xml:",omitempty"`
+	ContinuationToken     string `xml:",omitempty"`
+	NextContinuationToken string `xml:",omitempty"`
+	KeyCount              int
+	MaxKeys               int
+	IsTruncated           bool
+	EncodingType          string           `xml:",omitempty"`
+	Contents              []s3Object       `xml:"Contents"`
+	CommonPrefixes        []s3CommonPrefix `xml:"CommonPrefixes"`
+}
+
+// s3ListEntry is a key of a listing, or a common prefix
+type s3ListEntry struct {
+	key    string
+	info   os.FileInfo
+	prefix bool
+}
+
+// ListObjectsV2
+// query params:
+// - prefix: only keys starting with it
+// - delimiter: keys containing it after the prefix are rolled up into common prefixes
+// - max-keys: at most 1000, the default
+// - continuation-token / start-after: list keys after it
+// - encoding-type: url to percent encode the keys
+func (s *Server) s3ListObjects(w http.ResponseWriter, r *http.Request, req *s3Request) error {
+	q := r.URL.Query()
+	bucketDir, err := s.s3BucketDir(req.bucket)
+	if err != nil {
+		return err
+	}
+	prefix, delimiter := q.Get("prefix"), q.Get("delimiter")
+	maxKeys := s3MaxKeys
+	if v := q.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return s3Errorf(errS3InvalidArgument, "invalid max-keys %q", v)
+		}
+		maxKeys = min(n, s3MaxKeys)
+	}
+	encodingType := q.Get("encoding-type")
+	if encodingType != "" && encodingType != "url" {
+		return s3Errorf(errS3InvalidArgument, "invalid encoding-type %q", encodingType)
+	}
+	after := q.Get("start-after")
+	token := q.Get("continuation-token")
+	if token != "" {
+		b, err := base64.RawURLEncoding.DecodeString(token)
+		if err != nil {
+			return s3Errorf(errS3InvalidArgument, "invalid continuation-token")
+		}
+		after = string(b)
+	}
+
+	entries, err := s.s3List(bucketDir, req.bucket, prefix, delimiter)
+	if err != nil {
+		return err
+	}
+	start := sort.Search(len(entries), func(i int) bool { return entries[i].key > after })
+	entries = entries[start:]
+
+	encode := func(s string) string { return s }
+	if encodingType == "url" {
+		encode = url.QueryEscape
+	}
+	result := s3ListBucketResult{
+		Xmlns:             s3Namespace,
+		Name:              req.bucket,
+		Prefix:            encode(prefix),
+		Delimiter:         encode(delimiter),
+		StartAfter:        encode(q.Get("start-after")),
+		ContinuationToken: token,
+		MaxKeys:           maxKeys,
+		EncodingType:      encodingType,
+	}
+	if len(entries) > maxKeys {
+		entries = entries[:maxKeys]
+		result.IsTruncated = true
+		if maxKeys > 0 {
+			result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(entries[maxKeys-1].key))
+		} else {
+			result.NextContinuationToken = token
+		}
+	}
+	for _, e := range entries {
+		if e.prefix {
+			result.CommonPrefixes = append(result.CommonPrefixes, s3CommonPrefix{Prefix: encode(e.key)})
+			continue
+		}
+		obj := s3Object{
+			Key:          encode(e.key),
+			LastModified: s3Time(e.info.ModTime()),
+			ETag:         s.s3ETags.get(filepath.Join(bucketDir, filepath.FromSlash(e.key)), e.info),
+			StorageClass: "STANDARD",
+		}
+		// empty dirs are listed as empty objects
+		if !e.info.IsDir() {
+			obj.Size = e.info.Size()
+		}
+		result.Contents = append(result.Contents, obj)
+	}
+	result.KeyCount = len(entries)
+	return s3WriteXML(w, result)
+}
+
+// s3List returns the keys of the bucket starting with prefix sorted, rolled
+// up at the delimiter. Only the dir of the prefix is read when the delimiter
+// is "/", the common case of browsing dir by dir.
+func (s *Server) s3List(bucketDir, bucket, prefix, delimiter string) ([]s3ListEntry, error) {
+	root, err := s.paths.Root()
+	if err != nil {
+		return nil, err
+	}
+	base := prefix[:strings.LastIndex(prefix, "/")+1]
+	dir, err := s.paths.Resolve(bucket + "/" + base)
+	if err != nil {
+		return nil, nil
+	}
+	real, err := s.fs.EvalSymlinks(dir)
+	if err != nil {
+		return nil, nil
+	}
+	if info, err := s.fs.Stat(real); err != nil || !info.IsDir() {
+		return nil, nil
+	}
+
+	var entries []s3ListEntry
+	seen := make(map[string]bool)
+	add := func(key string, info os.FileInfo) {
+		if !strings.HasPrefix(key, prefix) {
+			return
+		}
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				key = key[:len(prefix)+i+len(delimiter)]
+				if !seen[key] {
+					seen[key] = true
+					entries = append(entries, s3ListEntry{key: key, prefix: true})
+				}
+				return
+			}
+		}
+		entries = append(entries, s3ListEntry{key: key, info: info})
+	}
+	// target of a symlink inside the work dir, nil otherwise
+	follow := func(p, key string) os.FileInfo {
+		if _, err := s.paths.Resolve(bucket + "/" + key); err != nil {
+			return nil
+		}
+		info, err := s.fs.Stat(p)
+		if err != nil {
+			return nil
+		}
+		return info
+	}
+
+	if delimiter == "/" {
+		children, err := s.fs.ReadDir(real)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range children {
+			p := filepath.Join(real, e.Name())
+			key := base + e.Name()
+			if isStateDir(root, p) || !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			info, err := e.Info()
+			if err != nil {
+				continue
+			}
+			if e.Type()&fs.ModeSymlink != 0 {
+				if info = follow(p, key); info == nil {
+					continue
+				}
+			}
+			switch {
+			case info.IsDir():
+				add(key+"/", info)
+			case info.Mode().IsRegular():
+				add(key, info)
+			}
+		}
+	} else {
+		err = walkDir(s.fs, real, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || p == real {
+				return err
+			}
+			if isStateDir(root, p) {
+				return filepath.SkipDir
+			}
+			rel, err := filepath.Rel(real, p)
+			if err != nil {
+				return err
+			}
+			key := base + filepath.ToSlash(rel)
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			switch {
+			case d.IsDir():
+				dirKey := key + "/"
+				if !strings.HasPrefix(dirKey, prefix) && !strings.HasPrefix(prefix, dirKey) {
+					return filepath.SkipDir
+				}
+				if children, err := s.fs.ReadDir(p); err == nil && len(children) == 0 {
+					add(dirKey, info)
+				}
+			case d.Type()&fs.ModeSymlink != 0:
+				if target := follow(p, key); target != nil && target.Mode().IsRegular() {
+					add(key, target)
+				}
+			case info.Mode().IsRegular():
+				add(key, info)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+	return entries, nil
+}
+
+// GetObject and HeadObject, with ranges and conditional requests
+func (s *Server) s3GetObject(w http.ResponseWriter, r *http.Request, req *s3Request) error {
+	local, err := s.s3ObjectPath(req)
+	if err != nil {
+		return err
+	}
+	info, err := s.fs.Stat(local)
+	if err != nil {
+		return errS3NoSuchKey
+	}
+	if info.IsDir() != strings.HasSuffix(req.key, "/") || (!info.IsDir() && !info.Mode().IsRegular()) {
+		return errS3NoSuchKey
+	}
+
+	q := r.URL.Query()
+	for _, param := range s3ResponseParams {
+		if v := q.Get(param); v != "" {
+			w.Header().Set(strings.TrimPrefix(param, "response-"), v)
+		}
+	}
+	w.Header().Set("ETag", s.s3ETags.get(local, info))
+	if info.IsDir() {
+		// the dir marker is an empty object
+		http.ServeContent(w, r, "", info.ModTime(), bytes.NewReader(nil))
+		return nil
+	}
+
+	file, err := s.fs.Open(local)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", detectMimeType(s.fs, local, info.Name()))
+	}
+	http.ServeContent(w, r, "", info.ModTime(), file)
+	return nil
+}
+
+// PutObject, a key ending with "/" and an empty body creates a dir
+// headers:
+// - Content-MD5: optional, checked against the body
+func (s *Server) s3PutObject(w http.ResponseWriter, r *http.Request, req *s3Request) error {
+	local, err := s.s3ObjectPath(req)
+	if err != nil {
+		return err
+	}
+	size := s3PayloadLength(r)
+	if size < 0 {
+		return errS3MissingContentLength
+	}
+	if strings.HasSuffix(req.key, "/") {
+		if size > 0 {
+			return s3Errorf(errS3InvalidArgument, "a key ending with / can only be empty")
+		}
+		if err := s.fs.MkdirAll(local, 0755); err != nil {
+			return s3Errorf(errS3KeyConflict, "%v", err)
+		}
+		w.Header().Set("ETag", s3EmptyETag)
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+	if s.MaxUploadSize > 0 && size > s.MaxUploadSize {
+		return errS3EntityTooLarge
+	}
+
+	staged, sum, err := s.s3Stage(local, req.body, size, r.Header.Get("Content-MD5"))
+	if err != nil {
+		return err
+	}
+	defer s.fs.Remove(staged)
+	etag := `"` + hex.EncodeToString(sum) + `"`
+	if _, err := s.s3Place(staged, local, etag); err != nil {
+		return err
+	}
+	w.Header().Set("ETag", etag)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// s3Stage writes size bytes of body to a new staging file, reserving room at
+// local for it, and returns the file and the md5 of its content
+func (s *Server) s3Stage(local string, body io.Reader, size int64, contentMD5 string) (string, []byte, error) {
+	var wantMD5 []byte
+	if contentMD5 != "" {
+		b, err := base64.StdEncoding.DecodeString(contentMD5)
+		if err != nil || len(b) != md5.Size {
+			return "", nil, s3Errorf(errS3InvalidArgument, "invalid Content-MD5")
+		}
+		wantMD5 = b
+	}
+
+	res, err := s.quota.reserve(local, quotaUsage{Files: 1}, "")
+	if err != nil {
+		return "", nil, err
+	}
+	defer res.release()
+
+	tmpFile, err := s.createStaging()
+	if err != nil {
+		return "", nil, err
+	}
+	h := md5.New()
+	n, err := io.Copy(io.MultiWriter(&quotaWriter{w: tmpFile, res: res}, h), io.LimitReader(body, size))
+	if err == nil && n < size {
+		err = errS3IncompleteBody
+	}
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	sum := h.Sum(nil)
+	if err == nil && wantMD5 != nil && !bytes.Equal(sum, wantMD5) {
+		err = errS3BadDigest
+	}
+	if err == nil {
+		// read up to EOF, where the payload signature is verified
+		var extra int64
+		if extra, err = io.Copy(io.Discard, io.LimitReader(body, 1)); err == nil && extra > 0 {
+			err = s3Errorf(errS3InvalidRequest, "the body is longer than the content length")
+		}
+	}
+	if err != nil {
+		s.fs.Remove(tmpFile.Name())
+		return "", nil, err
+	}
+	return tmpFile.Name(), sum, nil
+}
+
+// s3Place moves a staged object to local, replacing the current one, and
+// records its etag
+func (s *Server) s3Place(staged, local, etag string) (string, error) {
+	if err := s.fs.MkdirAll(filepath.Dir(local), 0755); err != nil {
+		return "", s3Errorf(errS3KeyConflict, "%v", err)
+	}
+	dest, err := s.placeFile(staged, filepath.Dir(local), filepath.Base(local), NamingOverwrite)
+	if err != nil {
+		if errors.Is(err, ErrFileExists) {
+			return "", errS3KeyConflict
+		}
+		return "", err
+	}
+	syncDir(s.fs, filepath.Dir(dest))
+	if info, err := s.fs.Stat(dest); err == nil {
+		s.s3ETags.put(dest, info, etag)
+	}
+	return dest, nil
+}
+
+// s3DeleteKey moves the object at key to the trash, a missing key is not an error
+func (s *Server) s3DeleteKey(req *s3Request) error {
+	local, err := s.s3ObjectPath(req)
+	if err != nil {
+		return err
+	}
+	info, err := s.fs.Lstat(local)
+	if err != nil {
+		return nil
+	}
+	if !info.IsDir() {
+		if strings.HasSuffix(req.key, "/") {
+			return nil
+		}
+		_, err := s.trash.put(local)
+		return err
+	}
+	// only an empty dir is an object, the marker of a dir with content
+	// doesn't exist on its own
+	if !strings.HasSuffix(req.key, "/") {
+		return nil
+	}
+	if entries, err := s.fs.ReadDir(local); err != nil || len(entries) > 0 {
+		return err
+	}
+	return s.fs.Remove(local)
+}
+
+func (s *Server) s3DeleteObject(w http.ResponseWriter, r *http.Request, req *s3Request) error {
+	if err := s.s3DeleteKey(req); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+type s3DeleteRequest struct {
+	Quiet   bool `xml:"Quiet"`
+	Objects []struct {
+		Key string `xml:"Key"`
+	} `xml:"Object"`
+}
+
+type s3Deleted struct {
+	Key string
+}
+
+type s3DeleteError struct {
+	Key     string
+	Code    string
+	Message string
+}
+
+type s3DeleteResult struct {
+	XMLName xml.Name        `xml:"DeleteResult"`
+	Xmlns   string          `xml:"xmlns,attr"`
+	Deleted []s3Deleted     `xml:"Deleted"`
+	Errors  []s3DeleteError `xml:"Error"`
+}
+
+// DeleteObjects, up to 1000 keys
+func (s *Server) s3DeleteObjects(w http.ResponseWriter, r *http.Request, req *s3Request) error {
+	var body s3DeleteRequest
+	if err := s3ReadXML(req.body, &body); err != nil {
+		return err
+	}
+	if len(body.Objects) == 0 || len(body.Objects) > s3MaxKeys {
+		return s3Errorf(errS3MalformedXML, "between 1 and %d keys can be deleted at once", s3MaxKeys)
+	}
+
+	result := s3DeleteResult{Xmlns: s3Namespace}
+	for _, o := range body.Objects {
+		err := s.s3DeleteKey(&s3Request{bucket: req.bucket, key: o.Key, sig: req.sig})
+		if err == nil {
+			if !body.Quiet {
+				result.Deleted = append(result.Deleted, s3Deleted{Key: o.Key})
+			}
+			continue
+		}
+		logger.Error(fmt.Sprintf("s3 failed to delete %v/%v: %v", req.bucket, o.Key, err))
+		var e *s3Error
+		if !errors.As(err, &e) {
+			e = errS3Internal
+		}
+		result.Errors = append(result.Errors, s3DeleteError{Key: o.Key, Code: e.Code, Message: e.Message})
+	}
+	return s3WriteXML(w, result)
+}
+
+// s3ReadXML decodes an xml request body
+func s3ReadXML(body io.Reader, v any) error {
+	b, err := io.ReadAll(io.LimitReader(body, s3MaxXMLSize+1))
+	if err != nil {
+		return err
+	}
+	if len(b) > s3MaxXMLSize {
+		return s3Errorf(errS3MalformedXML, "the body is too large")
+	}
+	if err := xml.Unmarshal(b, v); err != nil {
+		return s3Errorf(errS3MalformedXML, "%v", err)
+	}
+	return nil
+}
+
+// s3Time formats an object date
+func s3Time(t time.Time) string {
+	return t.UTC().Format(s3TimeFormat)
+}
@@ -0,0 +1,503 @@
+package server
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AWS signature version 4, from the Authorization header or from the query
+// of a presigned url
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-authenticating-requests.html
+
+const (
+	s3Algorithm  = "AWS4-HMAC-SHA256"
+	s3DateFormat = "20060102T150405Z"
+	// largest accepted difference between the request date and the server clock
+	s3MaxClockSkew     = 15 * time.Minute
+	s3MaxPresignExpiry = 7 * 24 * time.Hour
+
+	// x-amz-content-sha256 values besides the hex sha256 of the payload
+	s3UnsignedPayload                 = "UNSIGNED-PAYLOAD"
+	s3StreamingPayload                = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	s3StreamingPayloadTrailer         = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER"
+	s3StreamingUnsignedPayloadTrailer = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+)
+
+// sha256 of an empty payload
+const s3EmptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// s3Signature is the verified signature of a request, the chunks of a
+// streaming payload are signed in a chain starting from it
+type s3Signature struct {
+	accessKey string
+	// signing key derived from the secret for the date and region of scope
+	key       []byte
+	date      string
+	scope     string
+	signature string
+	presigned bool
+}
+
+// s3Authenticate verifies the signature of r against the configured keys
+func (s *Server) s3Authenticate(r *http.Request) (*s3Signature, error) {
+	q := r.URL.Query()
+	if q.Has("X-Amz-Signature") {
+		return s.s3AuthenticateQuery(r, q)
+	}
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		return nil, errS3AccessDenied
+	}
+	algorithm, fields, _ := strings.Cut(auth, " ")
+	if algorithm != s3Algorithm {
+		return nil, s3Errorf(errS3InvalidArgument, "unsupported authorization algorithm %q", algorithm)
+	}
+	params := make(map[string]string)
+	for _, field := range strings.Split(fields, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(field), "=")
+		params[k] = v
+	}
+
+	date := r.Header.Get("X-Amz-Date")
+	if date == "" {
+		// the Date header only counts when x-amz-date is missing
+		t, err := http.ParseTime(r.Header.Get("Date"))
+		if err != nil {
+			return nil, s3Errorf(errS3AccessDenied, "missing x-amz-date")
+		}
+		date = t.UTC().Format(s3DateFormat)
+	}
+	t, err := time.Parse(s3DateFormat, date)
+	if err != nil {
+		return nil, s3Errorf(errS3AccessDenied, "invalid x-amz-date %q", date)
+	}
+	if skew := time.Since(t); skew > s3MaxClockSkew || skew < -s3MaxClockSkew {
+		return nil, errS3TimeSkewed
+	}
+
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		return nil, s3Errorf(errS3InvalidRequest, "missing x-amz-content-sha256")
+	}
+	return s.s3Verify(r, q, params["Credential"], params["SignedHeaders"], params["Signature"], date, payloadHash, false)
+}
+
+// s3AuthenticateQuery verifies a presigned url
+func (s *Server) s3AuthenticateQuery(r *http.Request, q url.Values) (*s3Signature, error) {
+	if q.Get("X-Amz-Algorithm") != s3Algorithm {
+		return nil, s3Errorf(errS3InvalidArgument, "unsupported X-Amz-Algorithm %q", q.Get("X-Amz-Algorithm"))
+	}
+	date := q.Get("X-Amz-Date")
+	t, err := time.Parse(s3DateFormat, date)
+	if err != nil {
+		return nil, s3Errorf(errS3AccessDenied, "invalid X-Amz-Date %q", date)
+	}
+	expires, err := strconv.Atoi(q.Get("X-Amz-Expires"))
+	if err != nil || expires < 1 || time.Duration(expires)*time.Second > s3MaxPresignExpiry {
+		return nil, s3Errorf(errS3InvalidArgument, "invalid X-Amz-Expires %q", q.Get("X-Amz-Expires"))
+	}
+	now := time.Now()
+	if now.Before(t.Add(-s3MaxClockSkew)) {
+		return nil, errS3TimeSkewed
+	}
+	if now.After(t.Add(time.Duration(expires) * time.Second)) {
+		return nil, s3Errorf(errS3AccessDenied, "request has expired")
+	}
+
+	payloadHash := q.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		payloadHash = s3UnsignedPayload
+	}
+	return s.s3Verify(r, q, q.Get("X-Amz-Credential"), q.Get("X-Amz-SignedHeaders"), q.Get("X-Amz-Signature"), date, payloadHash, true)
+}
+
+// s3Verify rebuilds the canonical request and compares the signatures
+func (s *Server) s3Verify(r *http.Request, q url.Values, credential, signedHeaders, signature, date, payloadHash string, presigned bool) (*s3Signature, error) {
+	// <access key>/<yyyymmdd>/<region>/s3/aws4_request
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[3] != "s3" || parts[4] != "aws4_request" || signedHeaders == "" || signature == "" {
+		return nil, s3Errorf(errS3AccessDenied, "malformed credential")
+	}
+	if parts[1] != date[:8] {
+		return nil, s3Errorf(errS3AccessDenied, "credential date does not match x-amz-date")
+	}
+	secret, ok := s.S3Keys[parts[0]]
+	if !ok {
+		return nil, errS3InvalidAccessKey
+	}
+
+	headers := strings.Split(signedHeaders, ";")
+	if !slices.Contains(headers, "host") {
+		return nil, s3Errorf(errS3AccessDenied, "host must be signed")
+	}
+	canonicalHeaders := ""
+	for _, name := range headers {
+		canonicalHeaders += name + ":" + s3HeaderValue(r, name) + "\n"
+	}
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		s3URIEncode(r.URL.Path, false),
+		s3CanonicalQuery(q),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	sig := &s3Signature{
+		accessKey: parts[0],
+		key:       s3SigningKey(secret, parts[1], parts[2]),
+		date:      date,
+		scope:     strings.Join(parts[1:], "/"),
+		presigned: presigned,
+	}
+	sig.signature = sig.sign("AWS4-HMAC-SHA256", s3SHA256Hex([]byte(canonicalRequest)))
+	if !hmac.Equal([]byte(sig.signature), []byte(signature)) {
+		return nil, errS3SignatureMismatch
+	}
+	return sig, nil
+}
+
+// sign signs a string made of the algorithm, date, scope and lines
+func (sig *s3Signature) sign(algorithm string, lines ...string) string {
+	stringToSign := strings.Join(append([]string{algorithm, sig.date, sig.scope}, lines...), "\n")
+	return hex.EncodeToString(s3HMAC(sig.key, stringToSign))
+}
+
+func s3SigningKey(secret, day, region string) []byte {
+	key := s3HMAC([]byte("AWS4"+secret), day)
+	key = s3HMAC(key, region)
+	key = s3HMAC(key, "s3")
+	return s3HMAC(key, "aws4_request")
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func s3SHA256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// s3HeaderValue returns the canonical value of a signed header
+func s3HeaderValue(r *http.Request, name string) string {
+	switch name {
+	case "host":
+		return r.Host
+	case "content-length":
+		if r.Header.Get("Content-Length") == "" && r.ContentLength >= 0 {
+			return strconv.FormatInt(r.ContentLength, 10)
+		}
+	case "transfer-encoding":
+		// removed from the header by net/http
+		return strings.Join(r.TransferEncoding, ",")
+	}
+	values := r.Header.Values(name)
+	for i, v := range values {
+		values[i] = strings.Join(strings.Fields(v), " ")
+	}
+	return strings.Join(values, ",")
+}
+
+// s3CanonicalQuery encodes the query sorted by name then value, without the signature
+func s3CanonicalQuery(q url.Values) string {
+	type pair struct{ k, v string }
+	var pairs []pair
+	for k, values := range q {
+		if k == "X-Amz-Signature" {
+			continue
+		}
+		for _, v := range values {
+			pairs = append(pairs, pair{s3URIEncode(k, true), s3URIEncode(v, true)})
+		}
+	}
+	// sorted by encoded name then value, sorting "k=v" would put "a-b=" before "a="
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].k != pairs[j].k {
+			return pairs[i].k < pairs[j].k
+		}
+		return pairs[i].v < pairs[j].v
+	})
+	parts := make([]string, len(pairs))
+	for i, p := range pairs {
+		parts[i] = p.k + "=" + p.v
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3URIEncode percent encodes every byte but the unreserved characters, and
+// slashes unless encodeSlash is set
+func s3URIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '.', c == '_', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Payload returns the body of r checked against its x-amz-content-sha256.
+// A mismatch is reported by Read once the whole payload went through.
+func s3Payload(r *http.Request, sig *s3Signature) (io.Reader, error) {
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	switch {
+	case sig.presigned || payloadHash == s3UnsignedPayload:
+		return r.Body, nil
+	case payloadHash == s3StreamingPayload:
+		return newS3ChunkedReader(r.Body, sig, false), nil
+	case payloadHash == s3StreamingPayloadTrailer:
+		return newS3ChunkedReader(r.Body, sig, true), nil
+	case payloadHash == s3StreamingUnsignedPayloadTrailer:
+		return newS3ChunkedReader(r.Body, nil, true), nil
+	}
+	want, err := hex.DecodeString(payloadHash)
+	if err != nil || len(want) != sha256.Size {
+		return nil, s3Errorf(errS3NotImplemented, "unsupported x-amz-content-sha256 %q", payloadHash)
+	}
+	return &s3HashReader{r: r.Body, h: sha256.New(), want: want}, nil
+}
+
+// s3PayloadLength returns the length of the decoded payload, -1 when unknown
+func s3PayloadLength(r *http.Request) int64 {
+	if v := r.Header.Get("X-Amz-Decoded-Content-Length"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return -1
+		}
+		return n
+	}
+	return r.ContentLength
+}
+
+// s3HashReader checks the sha256 of a payload at EOF
+type s3HashReader struct {
+	r    io.Reader
+	h    hash.Hash
+	want []byte
+}
+
+func (h *s3HashReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.h.Write(p[:n])
+	if err == io.EOF && !hmac.Equal(h.h.Sum(nil), h.want) {
+		return n, errS3ContentSHA256Mismatch
+	}
+	return n, err
+}
+
+// s3ChunkedReader decodes an aws-chunked payload:
+//
+//	<hex size>[;chunk-signature=<signature>]\r\n<data>\r\n ... 0[;chunk-signature=<signature>]\r\n
+//	[<trailer>:<value>\r\n ... [x-amz-trailer-signature:<signature>\r\n]]\r\n
+//
+// With a signature each chunk is verified, chained from the previous one.
+// Trailing checksums are not verified.
+type s3ChunkedReader struct {
+	r       *bufio.Reader
+	sig     *s3Signature
+	trailer bool
+
+	// signature of the previous chunk, and the one sent for the current chunk
+	prev    string
+	pending string
+
+	h         hash.Hash
+	remaining int64
+	inChunk   bool
+	err       error
+}
+
+func newS3ChunkedReader(r io.Reader, sig *s3Signature, trailer bool) *s3ChunkedReader {
+	c := &s3ChunkedReader{r: bufio.NewReader(r), sig: sig, trailer: trailer, h: sha256.New()}
+	if sig != nil {
+		c.prev = sig.signature
+	}
+	return c
+}
+
+var errS3ChunkFormat = s3Errorf(errS3InvalidRequest, "malformed aws-chunked payload")
+
+func (c *s3ChunkedReader) Read(p []byte) (int, error) {
+	for c.err == nil && c.remaining == 0 {
+		c.err = c.nextChunk()
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	c.h.Write(p[:n])
+	c.remaining -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	c.err = err
+	return n, err
+}
+
+// nextChunk ends the current chunk and reads the header of the next one,
+// it returns io.EOF after the last chunk
+func (c *s3ChunkedReader) nextChunk() error {
+	if c.inChunk {
+		if err := c.expectCRLF(); err != nil {
+			return err
+		}
+		if err := c.verifyChunk(); err != nil {
+			return err
+		}
+	}
+
+	line, err := c.readLine()
+	if err != nil {
+		return err
+	}
+	sizeHex, ext, _ := strings.Cut(line, ";")
+	size, err := strconv.ParseInt(sizeHex, 16, 64)
+	if err != nil || size < 0 {
+		return errS3ChunkFormat
+	}
+	if c.sig != nil {
+		signature, ok := strings.CutPrefix(ext, "chunk-signature=")
+		if !ok {
+			return errS3ChunkFormat
+		}
+		c.pending = signature
+	}
+	c.remaining, c.inChunk = size, true
+	if size > 0 {
+		return nil
+	}
+
+	// the last chunk is empty
+	c.inChunk = false
+	if err := c.verifyChunk(); err != nil {
+		return err
+	}
+	if c.trailer {
+		if err := c.readTrailer(); err != nil {
+			return err
+		}
+		return io.EOF
+	}
+	if err := c.expectCRLF(); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+// verifyChunk checks the signature of the data read since the previous chunk
+func (c *s3ChunkedReader) verifyChunk() error {
+	defer c.h.Reset()
+	if c.sig == nil {
+		return nil
+	}
+	want := c.sig.sign("AWS4-HMAC-SHA256-PAYLOAD", c.prev, s3EmptySHA256, hex.EncodeToString(c.h.Sum(nil)))
+	if !hmac.Equal([]byte(want), []byte(c.pending)) {
+		return errS3SignatureMismatch
+	}
+	c.prev = c.pending
+	return nil
+}
+
+// readTrailer reads the trailing headers up to the blank line
+func (c *s3ChunkedReader) readTrailer() error {
+	var canonical, signature string
+	for {
+		line, err := c.readLine()
+		if err == io.EOF && canonical != "" {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if line == "" {
+			break
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return errS3ChunkFormat
+		}
+		name, value = strings.ToLower(strings.TrimSpace(name)), strings.TrimSpace(value)
+		if name == "x-amz-trailer-signature" {
+			signature = value
+			continue
+		}
+		canonical += name + ":" + value + "\n"
+	}
+	if c.sig == nil {
+		return nil
+	}
+	want := c.sig.sign("AWS4-HMAC-SHA256-TRAILER", c.prev, s3SHA256Hex([]byte(canonical)))
+	if !hmac.Equal([]byte(want), []byte(signature)) {
+		return errS3SignatureMismatch
+	}
+	return nil
+}
+
+// s3MaxChunkLine bounds the chunk header and trailer lines
+const s3MaxChunkLine = 4096
+
+// readLine reads a line ended by \r\n, without it. The line is bounded
+// while it is read, the framing is sent by the client.
+func (c *s3ChunkedReader) readLine() (string, error) {
+	var b []byte
+	for {
+		part, err := c.r.ReadSlice('\n')
+		b = append(b, part...)
+		if len(b) > s3MaxChunkLine {
+			return "", errS3ChunkFormat
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			if err == io.EOF && len(b) > 0 {
+				return "", io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		break
+	}
+	line, ok := strings.CutSuffix(string(b), "\r\n")
+	if !ok {
+		return "", errS3ChunkFormat
+	}
+	return line, nil
+}
+
+func (c *s3ChunkedReader) expectCRLF() error {
+	line, err := c.readLine()
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+	if line != "" {
+		return errS3ChunkFormat
+	}
+	return nil
+}
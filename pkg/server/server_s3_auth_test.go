@@ -0,0 +1,58 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestS3CanonicalQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"", ""},
+		{"b=2&a=1", "a=1&b=2"},
+		// by name first, "a-b=" sorts before "a=" as a whole string
+		{"a-b=1&a=2", "a=2&a-b=1"},
+		{"a=2&a=1&a=10", "a=1&a=10&a=2"},
+		{"key=a b&x=/~", "key=a%20b&x=%2F~"},
+		{"prefix=&list-type=2", "list-type=2&prefix="},
+		{"X-Amz-Signature=abc&X-Amz-Date=1", "X-Amz-Date=1"},
+	}
+	for _, tt := range tests {
+		q, err := url.ParseQuery(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := s3CanonicalQuery(q); got != tt.want {
+			t.Errorf("s3CanonicalQuery(%q) = %q; want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestS3ChunkedReaderBoundsLines(t *testing.T) {
+	tests := []struct {
+		name string
+		body io.Reader
+	}{
+		{"endless size", io.LimitReader(strings.NewReader(strings.Repeat("f", 1<<20)), 1<<20)},
+		{"endless extension", strings.NewReader("5;" + strings.Repeat("x", 1<<20) + "\r\nhello\r\n0\r\n\r\n")},
+		{"endless trailer", strings.NewReader("0\r\nx-amz-checksum-crc32:" + strings.Repeat("x", 1<<20) + "\r\n\r\n")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := io.ReadAll(newS3ChunkedReader(tt.body, nil, true))
+			if !errors.Is(err, errS3ChunkFormat) {
+				t.Fatalf("read = %v; want %v", err, errS3ChunkFormat)
+			}
+		})
+	}
+
+	b, err := io.ReadAll(newS3ChunkedReader(strings.NewReader("5\r\nhello\r\n0\r\n\r\n"), nil, true))
+	if err != nil || string(b) != "hello" {
+		t.Fatalf("read = %q, %v; want %q", b, err, "hello")
+	}
+}
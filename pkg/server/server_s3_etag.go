@@ -0,0 +1,118 @@
+package server
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	logger "httpserver/pkg/log"
+	"os"
+	"path/filepath"
+)
+
+// the md5 etags of objects written through S3 are kept in the s3-etags dir
+// inside the state dir, as a file per object keyed by the sha256 of its path.
+// A stored etag is used while the size and mtime of the file match, files
+// changed by other means fall back to fileETag.
+const s3ETagStateDir = "s3-etags"
+
+// s3EmptyETag is the md5 of no content, the etag of dir markers
+var s3EmptyETag = func() string {
+	sum := md5.Sum(nil)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}()
+
+type s3ETag struct {
+	// path relative to workDir
+	Path string `json:"path"`
+	// quoted, as sent in the ETag header
+	ETag    string `json:"etag"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"`
+}
+
+func (e *s3ETag) matches(info os.FileInfo) bool {
+	return e.Size == info.Size() && e.ModTime == info.ModTime().UnixNano()
+}
+
+type s3ETagStore struct {
+	fs    Storage
+	paths *PathResolver
+}
+
+func newS3ETagStore(fs Storage, paths *PathResolver) *s3ETagStore {
+	return &s3ETagStore{fs: fs, paths: paths}
+}
+
+func (e *s3ETagStore) path(local string) (string, error) {
+	root, err := e.paths.StateDir(s3ETagStateDir)
+	if err != nil {
+		return "", err
+	}
+	key := sha256.Sum256([]byte(e.paths.Rel(local)))
+	return filepath.Join(root, hex.EncodeToString(key[:])+".json"), nil
+}
+
+// put records etag for the file at local described by info
+func (e *s3ETagStore) put(local string, info os.FileInfo, etag string) {
+	p, err := e.path(local)
+	if err == nil {
+		var b []byte
+		b, err = json.Marshal(s3ETag{Path: e.paths.Rel(local), ETag: etag, Size: info.Size(), ModTime: info.ModTime().UnixNano()})
+		if err == nil {
+			err = writeFile(e.fs, p, b, 0644)
+		}
+	}
+	if err != nil {
+		logger.Warn(fmt.Sprintf("failed to save etag of %v: %v", local, err))
+	}
+}
+
+// get returns the etag of the file at local described by info
+func (e *s3ETagStore) get(local string, info os.FileInfo) string {
+	if info.IsDir() {
+		return s3EmptyETag
+	}
+	p, err := e.path(local)
+	if err != nil {
+		return fileETag(info)
+	}
+	b, err := readFile(e.fs, p)
+	if err != nil {
+		return fileETag(info)
+	}
+	var etag s3ETag
+	if err := json.Unmarshal(b, &etag); err != nil || !etag.matches(info) {
+		return fileETag(info)
+	}
+	return etag.ETag
+}
+
+// sweep drops the etags of files removed or changed since
+func (e *s3ETagStore) sweep() {
+	root, err := e.paths.StateDir(s3ETagStateDir)
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to open s3 etags dir: %v", err))
+		return
+	}
+	entries, err := e.fs.ReadDir(root)
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to read s3 etags dir: %v", err))
+		return
+	}
+	for _, entry := range entries {
+		p := filepath.Join(root, entry.Name())
+		var etag s3ETag
+		if b, err := readFile(e.fs, p); err == nil && json.Unmarshal(b, &etag) == nil {
+			if local, err := e.paths.Resolve(etag.Path); err == nil {
+				if info, err := e.fs.Stat(local); err == nil && etag.matches(info) {
+					continue
+				}
+			}
+		}
+		if err := e.fs.Remove(p); err != nil {
+			logger.Warn(fmt.Sprintf("failed to remove s3 etag %v: %v", entry.Name(), err))
+		}
+	}
+}
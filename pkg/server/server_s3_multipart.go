@@ -0,0 +1,425 @@
+package server
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	logger "httpserver/pkg/log"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the parts of a multipart upload are kept in the s3-uploads dir inside the
+// state dir, under a dir per upload holding upload.json and a file per part
+// named by its number. Completing the upload joins the parts into a staging
+// file placed like a single PutObject.
+const s3UploadStateDir = "s3-uploads"
+
+const (
+	s3MaxParts = 10000
+	// incomplete uploads are dropped after this long
+	s3UploadMaxAge = 7 * 24 * time.Hour
+)
+
+// s3Upload is the persisted state of a multipart upload
+type s3Upload struct {
+	ID        string         `json:"id"`
+	Bucket    string         `json:"bucket"`
+	Key       string         `json:"key"`
+	Initiated time.Time      `json:"initiated"`
+	Parts     map[int]s3Part `json:"parts"`
+}
+
+type s3Part struct {
+	// md5 of the part, hex encoded
+	ETag string `json:"etag"`
+	Size int64  `json:"size"`
+}
+
+type s3UploadStore struct {
+	fs    Storage
+	paths *PathResolver
+
+	mu sync.Mutex
+}
+
+func newS3UploadStore(fs Storage, paths *PathResolver) *s3UploadStore {
+	return &s3UploadStore{fs: fs, paths: paths}
+}
+
+func (u *s3UploadStore) dir(id string) (string, error) {
+	root, err := u.paths.StateDir(s3UploadStateDir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(root, id), nil
+}
+
+// create persists a new upload
+func (u *s3UploadStore) create(upload *s3Upload) error {
+	dir, err := u.dir(upload.ID)
+	if err != nil {
+		return err
+	}
+	if err := u.fs.Mkdir(dir, 0755); err != nil {
+		return err
+	}
+	return u.save(upload)
+}
+
+// load returns the upload id of the object at bucket/key
+func (u *s3UploadStore) load(id, bucket, key string) (*s3Upload, error) {
+	if !validUUID(id) {
+		return nil, errS3NoSuchUpload
+	}
+	dir, err := u.dir(id)
+	if err != nil {
+		return nil, err
+	}
+	b, err := readFile(u.fs, filepath.Join(dir, "upload.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errS3NoSuchUpload
+		}
+		return nil, err
+	}
+	upload := &s3Upload{}
+	if err := json.Unmarshal(b, upload); err != nil {
+		return nil, err
+	}
+	if upload.Bucket != bucket || upload.Key != key {
+		return nil, errS3NoSuchUpload
+	}
+	if upload.Parts == nil {
+		upload.Parts = make(map[int]s3Part)
+	}
+	return upload, nil
+}
+
+func (u *s3UploadStore) save(upload *s3Upload) error {
+	dir, err := u.dir(upload.ID)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+	return writeFile(u.fs, filepath.Join(dir, "upload.json"), b, 0644)
+}
+
+// addPart moves the staged content of a part into the upload, replacing a
+// previous part with the same number
+func (u *s3UploadStore) addPart(upload *s3Upload, number int, staged string, part s3Part) error {
+	dir, err := u.dir(upload.ID)
+	if err != nil {
+		return err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	// parts are uploaded concurrently, reload to keep the others
+	current, err := u.load(upload.ID, upload.Bucket, upload.Key)
+	if err != nil {
+		return err
+	}
+	if err := u.fs.Rename(staged, filepath.Join(dir, strconv.Itoa(number))); err != nil {
+		return err
+	}
+	current.Parts[number] = part
+	return u.save(current)
+}
+
+func (u *s3UploadStore) partPath(id string, number int) (string, error) {
+	dir, err := u.dir(id)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, strconv.Itoa(number)), nil
+}
+
+func (u *s3UploadStore) remove(id string) error {
+	dir, err := u.dir(id)
+	if err != nil {
+		return err
+	}
+	return u.fs.RemoveAll(dir)
+}
+
+// sweep removes expired uploads
+func (u *s3UploadStore) sweep() {
+	root, err := u.paths.StateDir(s3UploadStateDir)
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to open s3 uploads dir: %v", err))
+		return
+	}
+	entries, err := u.fs.ReadDir(root)
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to read s3 uploads dir: %v", err))
+		return
+	}
+	for _, e := range entries {
+		initiated := time.Time{}
+		if b, err := readFile(u.fs, filepath.Join(root, e.Name(), "upload.json")); err == nil {
+			upload := s3Upload{}
+			if json.Unmarshal(b, &upload) == nil {
+				initiated = upload.Initiated
+			}
+		}
+		if initiated.IsZero() {
+			// never saved, or unreadable
+			if info, err := e.Info(); err == nil {
+				initiated = info.ModTime()
+			}
+		}
+		if time.Since(initiated) < s3UploadMaxAge {
+			continue
+		}
+		if err := u.fs.RemoveAll(filepath.Join(root, e.Name())); err != nil {
+			logger.Warn(fmt.Sprintf("failed to remove s3 upload %v: %v", e.Name(), err))
+			continue
+		}
+		logger.Info(fmt.Sprintf("removed expired s3 upload: %v", e.Name()))
+	}
+}
+
+type s3InitiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string
+	Key      string
+	UploadId string
+}
+
+// CreateMultipartUpload
+func (s *Server) s3CreateMultipartUpload(w http.ResponseWriter, r *http.Request, req *s3Request) error {
+	if _, err := s.s3ObjectPath(req); err != nil {
+		return err
+	}
+	if strings.HasSuffix(req.key, "/") {
+		return s3Errorf(errS3InvalidArgument, "a key ending with / can only be empty")
+	}
+	id, err := newUUID()
+	if err != nil {
+		return err
+	}
+	upload := &s3Upload{
+		ID:        id,
+		Bucket:    req.bucket,
+		Key:       req.key,
+		Initiated: time.Now().UTC(),
+		Parts:     make(map[int]s3Part),
+	}
+	if err := s.s3Uploads.create(upload); err != nil {
+		return err
+	}
+	return s3WriteXML(w, s3InitiateMultipartUploadResult{Xmlns: s3Namespace, Bucket: req.bucket, Key: req.key, UploadId: id})
+}
+
+// UploadPart
+// query params:
+// - uploadId
+// - partNumber: 1 to 10000
+func (s *Server) s3UploadPart(w http.ResponseWriter, r *http.Request, req *s3Request) error {
+	q := r.URL.Query()
+	number, err := strconv.Atoi(q.Get("partNumber"))
+	if err != nil || number < 1 || number > s3MaxParts {
+		return s3Errorf(errS3InvalidArgument, "invalid partNumber %q", q.Get("partNumber"))
+	}
+	local, err := s.s3ObjectPath(req)
+	if err != nil {
+		return err
+	}
+	upload, err := s.s3Uploads.load(q.Get("uploadId"), req.bucket, req.key)
+	if err != nil {
+		return err
+	}
+	size := s3PayloadLength(r)
+	if size < 0 {
+		return errS3MissingContentLength
+	}
+
+	// the parts stay in the state dir until the upload completes, like tus
+	// uploads only the room they will need is checked
+	total := size
+	for n, part := range upload.Parts {
+		if n != number {
+			total += part.Size
+		}
+	}
+	if s.MaxUploadSize > 0 && total > s.MaxUploadSize {
+		return errS3EntityTooLarge
+	}
+	if err := s.quota.check(local, quotaUsage{Bytes: total, Files: 1}); err != nil {
+		return err
+	}
+
+	staged, sum, err := s.s3Stage(local, req.body, size, r.Header.Get("Content-MD5"))
+	if err != nil {
+		return err
+	}
+	part := s3Part{ETag: hex.EncodeToString(sum), Size: size}
+	if err := s.s3Uploads.addPart(upload, number, staged, part); err != nil {
+		s.fs.Remove(staged)
+		return err
+	}
+	w.Header().Set("ETag", `"`+part.ETag+`"`)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+type s3CompleteMultipartUpload struct {
+	Parts []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+type s3CompleteMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string
+	Bucket   string
+	Key      string
+	ETag     string
+}
+
+// CompleteMultipartUpload joins the listed parts into the object
+// query params:
+// - uploadId
+func (s *Server) s3CompleteMultipartUpload(w http.ResponseWriter, r *http.Request, req *s3Request) error {
+	local, err := s.s3ObjectPath(req)
+	if err != nil {
+		return err
+	}
+	uploadID := r.URL.Query().Get("uploadId")
+	upload, err := s.s3Uploads.load(uploadID, req.bucket, req.key)
+	if err != nil {
+		return err
+	}
+	var body s3CompleteMultipartUpload
+	if err := s3ReadXML(req.body, &body); err != nil {
+		return err
+	}
+	if len(body.Parts) == 0 {
+		return s3Errorf(errS3MalformedXML, "no parts to complete")
+	}
+
+	var total int64
+	for i, p := range body.Parts {
+		if i > 0 && p.PartNumber <= body.Parts[i-1].PartNumber {
+			return errS3InvalidPartOrder
+		}
+		part, ok := upload.Parts[p.PartNumber]
+		if !ok || strings.Trim(p.ETag, `"`) != part.ETag {
+			return s3Errorf(errS3InvalidPart, "part %d is missing or its etag does not match", p.PartNumber)
+		}
+		total += part.Size
+	}
+	if s.MaxUploadSize > 0 && total > s.MaxUploadSize {
+		return errS3EntityTooLarge
+	}
+
+	staged, err := s.s3JoinParts(local, upload, body)
+	if err != nil {
+		return err
+	}
+	defer s.fs.Remove(staged)
+	etag := s3MultipartETag(upload, body)
+	if _, err := s.s3Place(staged, local, etag); err != nil {
+		return err
+	}
+	if err := s.s3Uploads.remove(upload.ID); err != nil {
+		logger.Warn(fmt.Sprintf("failed to remove s3 upload %v: %v", upload.ID, err))
+	}
+	return s3WriteXML(w, s3CompleteMultipartUploadResult{
+		Xmlns:    s3Namespace,
+		Location: "/" + req.bucket + "/" + req.key,
+		Bucket:   req.bucket,
+		Key:      req.key,
+		ETag:     etag,
+	})
+}
+
+// s3MultipartETag is the md5 of the md5s of the listed parts followed by
+// the number of parts, like S3 does
+func s3MultipartETag(upload *s3Upload, body s3CompleteMultipartUpload) string {
+	h := md5.New()
+	for _, p := range body.Parts {
+		sum, _ := hex.DecodeString(upload.Parts[p.PartNumber].ETag)
+		h.Write(sum)
+	}
+	return fmt.Sprintf(`"%x-%d"`, h.Sum(nil), len(body.Parts))
+}
+
+// s3JoinParts writes the listed parts in order to a new staging file
+func (s *Server) s3JoinParts(local string, upload *s3Upload, body s3CompleteMultipartUpload) (string, error) {
+	res, err := s.quota.reserve(local, quotaUsage{Files: 1}, "")
+	if err != nil {
+		return "", err
+	}
+	defer res.release()
+
+	tmpFile, err := s.createStaging()
+	if err != nil {
+		return "", err
+	}
+	out := &quotaWriter{w: tmpFile, res: res}
+	for _, p := range body.Parts {
+		if err = s.s3CopyPart(out, upload.ID, p.PartNumber); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		s.fs.Remove(tmpFile.Name())
+		return "", err
+	}
+	return tmpFile.Name(), nil
+}
+
+func (s *Server) s3CopyPart(w io.Writer, id string, number int) error {
+	partPath, err := s.s3Uploads.partPath(id, number)
+	if err != nil {
+		return err
+	}
+	f, err := s.fs.Open(partPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// AbortMultipartUpload drops the parts
+// query params:
+// - uploadId
+func (s *Server) s3AbortMultipartUpload(w http.ResponseWriter, r *http.Request, req *s3Request) error {
+	if _, err := s.s3BucketDir(req.bucket); err != nil {
+		return err
+	}
+	upload, err := s.s3Uploads.load(r.URL.Query().Get("uploadId"), req.bucket, req.key)
+	if err != nil {
+		return err
+	}
+	if err := s.s3Uploads.remove(upload.ID); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
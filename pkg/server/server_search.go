@@ -0,0 +1,288 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	resp "httpserver/internal/response"
+	logger "httpserver/pkg/log"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSearchLimit = 1000
+	maxSearchLimit     = 10000
+)
+
+// searchFilter holds the conditions an entry must all match
+type searchFilter struct {
+	name       string
+	glob       string
+	regex      *regexp.Regexp
+	fileType   string
+	minSize    int64
+	maxSize    int64
+	after      time.Time
+	before     time.Time
+	maxDepth   int
+	limit      int
+	hasMinSize bool
+	hasMaxSize bool
+}
+
+// matchName applies the name conditions, they are cheap and run before any stat
+func (f *searchFilter) matchName(name string) bool {
+	if f.name != "" && !strings.Contains(strings.ToLower(name), f.name) {
+		return false
+	}
+	if f.glob != "" {
+		if ok, _ := path.Match(f.glob, name); !ok {
+			return false
+		}
+	}
+	if f.regex != nil && !f.regex.MatchString(name) {
+		return false
+	}
+	return true
+}
+
+// matchInfo applies the type, size and mtime conditions
+func (f *searchFilter) matchInfo(info os.FileInfo) bool {
+	switch f.fileType {
+	case "file":
+		if info.IsDir() {
+			return false
+		}
+	case "dir":
+		if !info.IsDir() {
+			return false
+		}
+	}
+	// sizes only make sense for files
+	if (f.hasMinSize || f.hasMaxSize) && info.IsDir() {
+		return false
+	}
+	if f.hasMinSize && info.Size() < f.minSize {
+		return false
+	}
+	if f.hasMaxSize && info.Size() > f.maxSize {
+		return false
+	}
+	if !f.after.IsZero() && info.ModTime().Before(f.after) {
+		return false
+	}
+	if !f.before.IsZero() && info.ModTime().After(f.before) {
+		return false
+	}
+	return true
+}
+
+// parseSearchTime accepts RFC 3339 or unix seconds
+func parseSearchTime(v string) (time.Time, error) {
+	if sec, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+func parseSearchFilter(q map[string][]string) (*searchFilter, error) {
+	get := func(key string) string {
+		if v := q[key]; len(v) > 0 {
+			return strings.TrimSpace(v[0])
+		}
+		return ""
+	}
+
+	f := &searchFilter{
+		name:     strings.ToLower(get("name")),
+		glob:     get("glob"),
+		fileType: get("type"),
+		limit:    defaultSearchLimit,
+	}
+	if _, err := path.Match(f.glob, ""); err != nil {
+		return nil, fmt.Errorf("invalid glob: %q", f.glob)
+	}
+	if v := get("regex"); v != "" {
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex: %q", v)
+		}
+		f.regex = re
+	}
+	if f.fileType != "" && f.fileType != "file" && f.fileType != "dir" {
+		return nil, fmt.Errorf("invalid type: %q", f.fileType)
+	}
+
+	var err error
+	if v := get("min_size"); v != "" {
+		if f.minSize, err = strconv.ParseInt(v, 10, 64); err != nil || f.minSize < 0 {
+			return nil, fmt.Errorf("invalid min_size: %q", v)
+		}
+		f.hasMinSize = true
+	}
+	if v := get("max_size"); v != "" {
+		if f.maxSize, err = strconv.ParseInt(v, 10, 64); err != nil || f.maxSize < 0 {
+			return nil, fmt.Errorf("invalid max_size: %q", v)
+		}
+		f.hasMaxSize = true
+	}
+	if v := get("modified_after"); v != "" {
+		if f.after, err = parseSearchTime(v); err != nil {
+			return nil, fmt.Errorf("invalid modified_after: %q", v)
+		}
+	}
+	if v := get("modified_before"); v != "" {
+		if f.before, err = parseSearchTime(v); err != nil {
+			return nil, fmt.Errorf("invalid modified_before: %q", v)
+		}
+	}
+	if v := get("max_depth"); v != "" {
+		if f.maxDepth, err = strconv.Atoi(v); err != nil || f.maxDepth < 0 {
+			return nil, fmt.Errorf("invalid max_depth: %q", v)
+		}
+	}
+	if v := get("limit"); v != "" {
+		if f.limit, err = strconv.Atoi(v); err != nil || f.limit <= 0 {
+			return nil, fmt.Errorf("invalid limit: %q", v)
+		}
+		f.limit = min(f.limit, maxSearchLimit)
+	}
+	return f, nil
+}
+
+// errSearchDone stops the walk once the limit is reached
+var errSearchDone = errors.New("search done")
+
+// searches a directory tree, results are streamed as newline delimited json
+// FileEntry objects while they are found. The walk stops when the client
+// disconnects or the limit is reached.
+// query params:
+// - path: the directory to search, default to workDir
+// - name: case-insensitive substring of the name
+// - glob: the name matches, e.g. "*.log"
+// - regex: the name matches, e.g. "^img_[0-9]+\.jpe?g$"
+// - type: file or dir
+// - min_size, max_size: size bounds in bytes, files only
+// - modified_after, modified_before: RFC 3339 or unix seconds
+// - max_depth: 1 searches the direct children only, default unlimited
+// - limit: max results, default 1000, at most 10000
+func (s *Server) searchHandler(w http.ResponseWriter, r *http.Request) resp.Response {
+	q := r.URL.Query()
+	localPath, err := s.paths.Resolve(q.Get("path"))
+	if err != nil {
+		logger.Error(fmt.Sprintf("invalid path: %v", err))
+		return pathErrorResponse(err)
+	}
+	filter, err := parseSearchFilter(q)
+	if err != nil {
+		logger.Error(err.Error())
+		return errorResponse(http.StatusBadRequest, err)
+	}
+
+	info, err := s.fs.Stat(localPath)
+	if err != nil {
+		logger.Error(fmt.Sprintf("file not found: %v", err))
+		return errorCodeResponse(http.StatusNotFound, resp.CodeNotFound, errors.New("file not found"))
+	}
+	if !info.IsDir() {
+		logger.Error("not a directory")
+		return errorResponse(http.StatusBadRequest, errors.New("not a directory"))
+	}
+	// WalkDir does not descend into a symlinked root, Resolve checked the target is inside
+	if localPath, err = s.fs.EvalSymlinks(localPath); err != nil {
+		logger.Error(fmt.Sprintf("failed to resolve path: %v", err))
+		return errorResponse(http.StatusInternalServerError, errors.New("failed to resolve path"))
+	}
+	root, err := s.paths.Root()
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to resolve work dir: %v", err))
+		return errorResponse(http.StatusInternalServerError, errors.New("failed to resolve work dir"))
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+	ctx := r.Context()
+
+	found := 0
+	err = walkDir(s.fs, localPath, func(p string, d fs.DirEntry, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			// unreadable dirs are skipped, the rest of the tree is still searched
+			logger.Warn(fmt.Sprintf("skip %v: %v", p, err))
+			if d != nil && d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if p == localPath {
+			return nil
+		}
+		if isStateDir(root, p) {
+			return filepath.SkipDir
+		}
+		rel, err := filepath.Rel(localPath, p)
+		if err != nil {
+			return err
+		}
+		// entries at max_depth are still matched, only their children are skipped
+		var next error
+		depth := strings.Count(rel, string(filepath.Separator)) + 1
+		if filter.maxDepth > 0 && depth >= filter.maxDepth && d.IsDir() {
+			next = filepath.SkipDir
+		}
+		if !filter.matchName(d.Name()) {
+			return next
+		}
+
+		lstat, err := d.Info()
+		if err != nil {
+			// removed meanwhile
+			return next
+		}
+		// symlinks match like their target when it is inside the work dir
+		info := lstat
+		if d.Type()&fs.ModeSymlink != 0 {
+			if _, err := s.paths.Resolve(s.paths.Rel(p)); err == nil {
+				if target, err := s.fs.Stat(p); err == nil {
+					info = target
+				}
+			}
+		}
+		if !filter.matchInfo(info) {
+			return next
+		}
+
+		if err := enc.Encode(s.fileEntry(p, lstat)); err != nil {
+			return err
+		}
+		if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return err
+		}
+		found++
+		if found >= filter.limit {
+			return errSearchDone
+		}
+		return next
+	})
+	if err != nil && !errors.Is(err, errSearchDone) {
+		if ctx.Err() != nil {
+			logger.Info(fmt.Sprintf("search cancelled after %d results", found))
+		} else {
+			logger.Error(fmt.Sprintf("search failed: %v", err))
+		}
+	}
+	return nil
+}
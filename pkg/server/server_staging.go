@@ -0,0 +1,89 @@
+package server
+
+import (
+	"fmt"
+	logger "httpserver/pkg/log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// uploads are written to the staging dir inside the state dir, fsynced and
+// only then renamed into place, so listings never show half written files
+// and a failed upload leaves nothing behind under its final name.
+const stagingStateDir = "staging"
+
+// stagingMaxAge is how long an untouched staging file is kept, a running
+// upload keeps updating the mtime of its file
+const stagingMaxAge = time.Hour
+
+// createStaging creates a new staging file
+func (s *Server) createStaging() (File, error) {
+	dir, err := s.paths.StateDir(stagingStateDir)
+	if err != nil {
+		return nil, err
+	}
+	f, err := s.fs.CreateTemp(dir, "upload-*")
+	if err != nil {
+		return nil, err
+	}
+	// CreateTemp uses 0600, stored files get the usual permissions
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		s.fs.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
+}
+
+// sweepStaging removes staging files left by interrupted uploads, those
+// untouched for maxAge
+func (s *Server) sweepStaging(maxAge time.Duration) {
+	dir, err := s.paths.StateDir(stagingStateDir)
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to open staging dir: %v", err))
+		return
+	}
+	entries, err := s.fs.ReadDir(dir)
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to read staging dir: %v", err))
+		return
+	}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || time.Since(info.ModTime()) < maxAge {
+			continue
+		}
+		if err := s.fs.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+			logger.Warn(fmt.Sprintf("failed to remove staging file %v: %v", e.Name(), err))
+			continue
+		}
+		logger.Info(fmt.Sprintf("removed stale staging file: %v", e.Name()))
+	}
+}
+
+// syncFile flushes the content of the file at path to disk
+func syncFile(fsys Storage, path string) error {
+	f, err := fsys.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir flushes a directory entry change (create, rename) to disk.
+// Not every platform supports syncing directories, so errors are only logged.
+func syncDir(fsys Storage, dir string) {
+	d, err := fsys.Open(dir)
+	if err != nil {
+		return
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		logger.Debug(fmt.Sprintf("failed to sync dir %v: %v", dir, err))
+	}
+}
@@ -0,0 +1,32 @@
+package server
+
+import (
+	"os"
+	"testing"
+)
+
+func TestStartSweepsAllStaging(t *testing.T) {
+	forEachStorage(t, ServerConfig{Addr: "127.0.0.1:0"}, func(t *testing.T, ts *testServer) {
+		f, err := ts.s.createStaging()
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		// a fresh file may belong to a running upload
+		ts.s.sweepStaging(stagingMaxAge)
+		if _, err := ts.s.fs.Stat(f.Name()); err != nil {
+			t.Fatalf("fresh staging file removed: %v", err)
+		}
+
+		// none runs before the server starts
+		stop := make(chan os.Signal, 1)
+		stop <- os.Interrupt
+		if err := ts.s.Start(stop, nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ts.s.fs.Stat(f.Name()); !os.IsNotExist(err) {
+			t.Fatalf("staging file left after start: %v", err)
+		}
+	})
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	resp "httpserver/internal/response"
+	logger "httpserver/pkg/log"
+	"net/http"
+	"strconv"
+)
+
+// StatResult is the metadata of a single path
+type StatResult struct {
+	FileEntry
+	// hex encoded, keyed by algorithm, only for regular files
+	Digests map[string]string `json:"digests,omitempty"`
+}
+
+// returns the metadata of a file or directory without downloading it
+// query params:
+// - path: the file or directory, default to workDir
+// - checksum: if true, add the digests of a regular file, computed when not cached
+func (s *Server) statHandler(w http.ResponseWriter, r *http.Request) resp.Response {
+	q := r.URL.Query()
+	localPath, err := s.paths.Resolve(q.Get("path"))
+	if err != nil {
+		logger.Error(fmt.Sprintf("invalid path: %v", err))
+		return pathErrorResponse(err)
+	}
+
+	var checksum bool
+	if v := q.Get("checksum"); v != "" {
+		if checksum, err = strconv.ParseBool(v); err != nil {
+			logger.Error(fmt.Sprintf("invalid checksum: %q", v))
+			return errorResponse(http.StatusBadRequest, fmt.Errorf("invalid checksum: %q", v))
+		}
+	}
+
+	info, err := s.fs.Lstat(localPath)
+	if err != nil {
+		logger.Error(fmt.Sprintf("file not found: %v", err))
+		return errorCodeResponse(http.StatusNotFound, resp.CodeNotFound, errors.New("file not found"))
+	}
+
+	result := StatResult{FileEntry: s.fileEntry(localPath, info)}
+	if checksum {
+		// Resolve only lets through symlinks pointing inside the work dir
+		if target, err := s.fs.Stat(localPath); err == nil && target.Mode().IsRegular() {
+			if sums := s.fileDigests(localPath, target, true); len(sums) > 0 {
+				result.Digests = hexDigests(sums)
+			}
+		}
+	}
+
+	return successResponse(http.StatusOK, "Stat successfully", result)
+}
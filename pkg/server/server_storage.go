@@ -0,0 +1,229 @@
+package server
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Storage is the filesystem the server works on. Names are the local paths
+// returned by PathResolver, absolute and inside Root, the methods behave
+// like their os package counterparts, errors included.
+type Storage interface {
+	// Root returns the absolute, symlink free work dir
+	Root() (string, error)
+
+	Open(name string) (File, error)
+	OpenFile(name string, flag int, perm fs.FileMode) (File, error)
+	// CreateTemp creates a new file in dir opened for reading and writing,
+	// the last "*" of pattern is replaced by a random string
+	CreateTemp(dir, pattern string) (File, error)
+
+	Stat(name string) (fs.FileInfo, error)
+	Lstat(name string) (fs.FileInfo, error)
+	// ReadDir returns the entries of a directory sorted by name
+	ReadDir(name string) ([]fs.DirEntry, error)
+	Readlink(name string) (string, error)
+	EvalSymlinks(name string) (string, error)
+
+	Mkdir(name string, perm fs.FileMode) error
+	MkdirAll(name string, perm fs.FileMode) error
+	// MkdirTemp creates a new dir in dir, the last "*" of pattern is
+	// replaced by a random string
+	MkdirTemp(dir, pattern string) (string, error)
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
+	RemoveAll(name string) error
+	Link(oldname, newname string) error
+	Symlink(oldname, newname string) error
+	Chmod(name string, mode fs.FileMode) error
+	Chtimes(name string, atime, mtime time.Time) error
+}
+
+// File is an open file of a Storage
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Seeker
+	io.Closer
+	Name() string
+	Stat() (fs.FileInfo, error)
+	Sync() error
+	Chmod(mode fs.FileMode) error
+}
+
+// osStorage is the local disk, rooted at the work dir
+type osStorage struct {
+	root string
+}
+
+// NewOSStorage returns the Storage of the local disk, rooted at workDir,
+// the current dir when empty
+func NewOSStorage(workDir string) Storage {
+	return &osStorage{root: workDir}
+}
+
+func (o *osStorage) Root() (string, error) {
+	abs, err := filepath.Abs(o.root)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(abs)
+}
+
+// the methods below return *os.File, so copies keep using copy_file_range
+// and reflinks when both ends are on disk
+
+func (o *osStorage) Open(name string) (File, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (o *osStorage) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (o *osStorage) CreateTemp(dir, pattern string) (File, error) {
+	f, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (o *osStorage) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (o *osStorage) Lstat(name string) (fs.FileInfo, error) {
+	return os.Lstat(name)
+}
+
+func (o *osStorage) ReadDir(name string) ([]fs.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (o *osStorage) Readlink(name string) (string, error) {
+	return os.Readlink(name)
+}
+
+func (o *osStorage) EvalSymlinks(name string) (string, error) {
+	return filepath.EvalSymlinks(name)
+}
+
+func (o *osStorage) Mkdir(name string, perm fs.FileMode) error {
+	return os.Mkdir(name, perm)
+}
+
+func (o *osStorage) MkdirAll(name string, perm fs.FileMode) error {
+	return os.MkdirAll(name, perm)
+}
+
+func (o *osStorage) MkdirTemp(dir, pattern string) (string, error) {
+	return os.MkdirTemp(dir, pattern)
+}
+
+func (o *osStorage) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (o *osStorage) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (o *osStorage) RemoveAll(name string) error {
+	return os.RemoveAll(name)
+}
+
+func (o *osStorage) Link(oldname, newname string) error {
+	return os.Link(oldname, newname)
+}
+
+func (o *osStorage) Symlink(oldname, newname string) error {
+	return os.Symlink(oldname, newname)
+}
+
+func (o *osStorage) Chmod(name string, mode fs.FileMode) error {
+	return os.Chmod(name, mode)
+}
+
+func (o *osStorage) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+// readFile is os.ReadFile on a Storage
+func readFile(fsys Storage, name string) ([]byte, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// writeFile is os.WriteFile on a Storage
+func writeFile(fsys Storage, name string, data []byte, perm fs.FileMode) error {
+	f, err := fsys.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// walkDir is filepath.WalkDir on a Storage, symlinks are not followed
+func walkDir(fsys Storage, root string, fn fs.WalkDirFunc) error {
+	info, err := fsys.Lstat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = walkDirEntry(fsys, root, fs.FileInfoToDirEntry(info), fn)
+	}
+	if err == filepath.SkipDir || err == filepath.SkipAll {
+		return nil
+	}
+	return err
+}
+
+func walkDirEntry(fsys Storage, path string, d fs.DirEntry, fn fs.WalkDirFunc) error {
+	if err := fn(path, d, nil); err != nil || !d.IsDir() {
+		if err == filepath.SkipDir && d.IsDir() {
+			err = nil
+		}
+		return err
+	}
+
+	entries, err := fsys.ReadDir(path)
+	if err != nil {
+		// second call, to report the ReadDir error
+		if err = fn(path, d, err); err != nil {
+			if err == filepath.SkipDir && d.IsDir() {
+				err = nil
+			}
+			return err
+		}
+	}
+
+	for _, e := range entries {
+		if err := walkDirEntry(fsys, filepath.Join(path, e.Name()), e, fn); err != nil {
+			if err == filepath.SkipDir {
+				break
+			}
+			return err
+		}
+	}
+	return nil
+}
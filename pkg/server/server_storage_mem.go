@@ -0,0 +1,655 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// memStorage keeps a whole filesystem in memory, for tests. Paths map to
+// nodes, a hard link is a second path to the same node.
+type memStorage struct {
+	root string
+
+	mu    sync.Mutex
+	nodes map[string]*memNode
+}
+
+// memNode is a file, directory or symlink
+type memNode struct {
+	mode    fs.FileMode
+	modTime time.Time
+	data    []byte
+	// symlink target
+	target string
+}
+
+// maxMemSymlinks bounds symlink chains like ELOOP does
+const maxMemSymlinks = 40
+
+// NewMemStorage returns an empty in-memory Storage whose work dir is root,
+// an absolute path
+func NewMemStorage(root string) Storage {
+	root = filepath.Clean(root)
+	m := &memStorage{root: root, nodes: make(map[string]*memNode)}
+	now := time.Now()
+	for p := root; ; p = filepath.Dir(p) {
+		m.nodes[p] = &memNode{mode: fs.ModeDir | 0755, modTime: now}
+		if filepath.Dir(p) == p {
+			break
+		}
+	}
+	return m
+}
+
+func memError(op, path string, err error) error {
+	return &fs.PathError{Op: op, Path: path, Err: err}
+}
+
+// lookup follows the symlinks of name, of the last element too when
+// followLast is set, and returns the real path. The last element may be
+// missing, then node is nil.
+func (m *memStorage) lookup(op, name string, followLast bool) (string, *memNode, error) {
+	name = filepath.Clean(name)
+	if !filepath.IsAbs(name) {
+		return "", nil, memError(op, name, syscall.EINVAL)
+	}
+	for hops := 0; ; hops++ {
+		if hops > maxMemSymlinks {
+			return "", nil, memError(op, name, syscall.ELOOP)
+		}
+		real, node, rest, err := m.step(op, name, followLast)
+		if err != nil || rest == "" {
+			return real, node, err
+		}
+		name = rest
+	}
+}
+
+// step walks name until the first symlink to follow and returns the path to
+// continue with in rest
+func (m *memStorage) step(op, name string, followLast bool) (real string, node *memNode, rest string, err error) {
+	vol := filepath.VolumeName(name)
+	parts := strings.Split(strings.TrimPrefix(name[len(vol):], string(filepath.Separator)), string(filepath.Separator))
+	cur := vol + string(filepath.Separator)
+	node = m.nodes[cur]
+	if len(parts) == 1 && parts[0] == "" {
+		return cur, node, "", nil
+	}
+	for i, part := range parts {
+		next := filepath.Join(cur, part)
+		n, ok := m.nodes[next]
+		last := i == len(parts)-1
+		if !ok {
+			if last {
+				return next, nil, "", nil
+			}
+			return "", nil, "", memError(op, name, syscall.ENOENT)
+		}
+		if n.mode&fs.ModeSymlink != 0 && (!last || followLast) {
+			target := n.target
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(cur, target)
+			}
+			return "", nil, filepath.Join(append([]string{target}, parts[i+1:]...)...), nil
+		}
+		if !last && !n.mode.IsDir() {
+			return "", nil, "", memError(op, name, syscall.ENOTDIR)
+		}
+		cur = next
+		node = n
+	}
+	return cur, node, "", nil
+}
+
+// parentDir checks the parent of p exists and is a directory
+func (m *memStorage) parentDir(op, p string) error {
+	parent, ok := m.nodes[filepath.Dir(p)]
+	if !ok {
+		return memError(op, p, syscall.ENOENT)
+	}
+	if !parent.mode.IsDir() {
+		return memError(op, p, syscall.ENOTDIR)
+	}
+	return nil
+}
+
+// children returns the paths directly inside dir, sorted
+func (m *memStorage) children(dir string) []string {
+	var names []string
+	for p := range m.nodes {
+		if p != dir && filepath.Dir(p) == dir {
+			names = append(names, p)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (m *memStorage) Root() (string, error) {
+	return m.root, nil
+}
+
+func (m *memStorage) Open(name string) (File, error) {
+	return m.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (m *memStorage) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, node, err := m.lookup("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	switch {
+	case node == nil:
+		if flag&os.O_CREATE == 0 {
+			return nil, memError("open", name, syscall.ENOENT)
+		}
+		if err := m.parentDir("open", p); err != nil {
+			return nil, err
+		}
+		node = &memNode{mode: perm.Perm(), modTime: time.Now()}
+		m.nodes[p] = node
+	case flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, memError("open", name, syscall.EEXIST)
+	case node.mode.IsDir() && writable:
+		return nil, memError("open", name, syscall.EISDIR)
+	case flag&os.O_TRUNC != 0 && writable:
+		node.data = nil
+		node.modTime = time.Now()
+	}
+	return &memFile{m: m, node: node, name: name, flag: flag}, nil
+}
+
+func (m *memStorage) CreateTemp(dir, pattern string) (File, error) {
+	for {
+		name, err := tempName(dir, pattern)
+		if err != nil {
+			return nil, err
+		}
+		f, err := m.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil || !os.IsExist(err) {
+			return f, err
+		}
+	}
+}
+
+func (m *memStorage) MkdirTemp(dir, pattern string) (string, error) {
+	for {
+		name, err := tempName(dir, pattern)
+		if err != nil {
+			return "", err
+		}
+		err = m.Mkdir(name, 0700)
+		if err == nil || !os.IsExist(err) {
+			return name, err
+		}
+	}
+}
+
+// tempName returns a random name in dir following the pattern of os.CreateTemp
+func tempName(dir, pattern string) (string, error) {
+	prefix, suffix := pattern, ""
+	if i := strings.LastIndex(pattern, "*"); i >= 0 {
+		prefix, suffix = pattern[:i], pattern[i+1:]
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, prefix+hex.EncodeToString(b)+suffix), nil
+}
+
+func (m *memStorage) stat(op, name string, follow bool) (fs.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, node, err := m.lookup(op, name, follow)
+	if err != nil {
+		return nil, err
+	}
+	if node == nil {
+		return nil, memError(op, name, syscall.ENOENT)
+	}
+	return node.info(filepath.Base(name)), nil
+}
+
+func (m *memStorage) Stat(name string) (fs.FileInfo, error) {
+	return m.stat("stat", name, true)
+}
+
+func (m *memStorage) Lstat(name string) (fs.FileInfo, error) {
+	return m.stat("lstat", name, false)
+}
+
+func (m *memStorage) ReadDir(name string) ([]fs.DirEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, node, err := m.lookup("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if node == nil {
+		return nil, memError("readdir", name, syscall.ENOENT)
+	}
+	if !node.mode.IsDir() {
+		return nil, memError("readdir", name, syscall.ENOTDIR)
+	}
+	children := m.children(p)
+	entries := make([]fs.DirEntry, 0, len(children))
+	for _, c := range children {
+		entries = append(entries, fs.FileInfoToDirEntry(m.nodes[c].info(filepath.Base(c))))
+	}
+	return entries, nil
+}
+
+func (m *memStorage) Readlink(name string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, node, err := m.lookup("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if node == nil {
+		return "", memError("readlink", name, syscall.ENOENT)
+	}
+	if node.mode&fs.ModeSymlink == 0 {
+		return "", memError("readlink", name, syscall.EINVAL)
+	}
+	return node.target, nil
+}
+
+func (m *memStorage) EvalSymlinks(name string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, node, err := m.lookup("lstat", name, true)
+	if err != nil {
+		return "", err
+	}
+	if node == nil {
+		return "", memError("lstat", name, syscall.ENOENT)
+	}
+	return p, nil
+}
+
+func (m *memStorage) Mkdir(name string, perm fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.mkdir(name, perm)
+}
+
+func (m *memStorage) mkdir(name string, perm fs.FileMode) error {
+	p, node, err := m.lookup("mkdir", name, false)
+	if err != nil {
+		return err
+	}
+	if node != nil {
+		return memError("mkdir", name, syscall.EEXIST)
+	}
+	if err := m.parentDir("mkdir", p); err != nil {
+		return err
+	}
+	m.nodes[p] = &memNode{mode: fs.ModeDir | perm.Perm(), modTime: time.Now()}
+	return nil
+}
+
+func (m *memStorage) MkdirAll(name string, perm fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.mkdirAll(filepath.Clean(name), perm)
+}
+
+func (m *memStorage) mkdirAll(name string, perm fs.FileMode) error {
+	if _, node, err := m.lookup("mkdir", name, true); err == nil && node != nil {
+		if node.mode.IsDir() {
+			return nil
+		}
+		return memError("mkdir", name, syscall.ENOTDIR)
+	}
+	if parent := filepath.Dir(name); parent != name {
+		if err := m.mkdirAll(parent, perm); err != nil {
+			return err
+		}
+	}
+	return m.mkdir(name, perm)
+}
+
+func (m *memStorage) Rename(oldpath, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	from, node, err := m.lookup("rename", oldpath, false)
+	if err != nil {
+		return err
+	}
+	if node == nil {
+		return memError("rename", oldpath, syscall.ENOENT)
+	}
+	to, dest, err := m.lookup("rename", newpath, false)
+	if err != nil {
+		return err
+	}
+	if from == to {
+		return nil
+	}
+	if err := m.parentDir("rename", to); err != nil {
+		return err
+	}
+	if node.mode.IsDir() && within(from, to) {
+		return memError("rename", newpath, syscall.EINVAL)
+	}
+	if dest != nil {
+		switch {
+		case dest.mode.IsDir() && !node.mode.IsDir():
+			return memError("rename", newpath, syscall.EISDIR)
+		case !dest.mode.IsDir() && node.mode.IsDir():
+			return memError("rename", newpath, syscall.ENOTDIR)
+		case dest.mode.IsDir() && len(m.children(to)) > 0:
+			return memError("rename", newpath, syscall.ENOTEMPTY)
+		}
+	}
+
+	moved := make(map[string]*memNode)
+	for p, n := range m.nodes {
+		if within(from, p) {
+			moved[filepath.Join(to, strings.TrimPrefix(p, from))] = n
+			delete(m.nodes, p)
+		}
+	}
+	for p, n := range moved {
+		m.nodes[p] = n
+	}
+	return nil
+}
+
+func (m *memStorage) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, node, err := m.lookup("remove", name, false)
+	if err != nil {
+		return err
+	}
+	if node == nil {
+		return memError("remove", name, syscall.ENOENT)
+	}
+	if node.mode.IsDir() && len(m.children(p)) > 0 {
+		return memError("remove", name, syscall.ENOTEMPTY)
+	}
+	delete(m.nodes, p)
+	return nil
+}
+
+func (m *memStorage) RemoveAll(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, node, err := m.lookup("unlinkat", name, false)
+	if err != nil {
+		if os.IsNotExist(err) || errorsIsErrno(err, syscall.ENOTDIR) {
+			return nil
+		}
+		return err
+	}
+	if node == nil {
+		return nil
+	}
+	for q := range m.nodes {
+		if within(p, q) {
+			delete(m.nodes, q)
+		}
+	}
+	return nil
+}
+
+func (m *memStorage) Link(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, node, err := m.lookup("link", oldname, false)
+	if err != nil {
+		return err
+	}
+	if node == nil {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.ENOENT}
+	}
+	if node.mode.IsDir() {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.EPERM}
+	}
+	to, dest, err := m.lookup("link", newname, false)
+	if err != nil {
+		return err
+	}
+	if dest != nil {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.EEXIST}
+	}
+	if err := m.parentDir("link", to); err != nil {
+		return err
+	}
+	m.nodes[to] = node
+	return nil
+}
+
+func (m *memStorage) Symlink(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	to, dest, err := m.lookup("symlink", newname, false)
+	if err != nil {
+		return err
+	}
+	if dest != nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: syscall.EEXIST}
+	}
+	if err := m.parentDir("symlink", to); err != nil {
+		return err
+	}
+	m.nodes[to] = &memNode{mode: fs.ModeSymlink | 0777, modTime: time.Now(), target: oldname}
+	return nil
+}
+
+func (m *memStorage) Chmod(name string, mode fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, node, err := m.lookup("chmod", name, true)
+	if err != nil {
+		return err
+	}
+	if node == nil {
+		return memError("chmod", name, syscall.ENOENT)
+	}
+	node.mode = node.mode&fs.ModeType | mode.Perm()
+	return nil
+}
+
+func (m *memStorage) Chtimes(name string, atime, mtime time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, node, err := m.lookup("chtimes", name, true)
+	if err != nil {
+		return err
+	}
+	if node == nil {
+		return memError("chtimes", name, syscall.ENOENT)
+	}
+	node.modTime = mtime
+	return nil
+}
+
+// errorsIsErrno reports whether err wraps errno
+func errorsIsErrno(err error, errno syscall.Errno) bool {
+	pathErr, ok := err.(*fs.PathError)
+	return ok && pathErr.Err == errno
+}
+
+func (n *memNode) info(name string) fs.FileInfo {
+	size := int64(len(n.data))
+	if n.mode&fs.ModeSymlink != 0 {
+		size = int64(len(n.target))
+	}
+	return &memFileInfo{name: name, size: size, mode: n.mode, modTime: n.modTime}
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (i *memFileInfo) Name() string       { return i.name }
+func (i *memFileInfo) Size() int64        { return i.size }
+func (i *memFileInfo) Mode() fs.FileMode  { return i.mode }
+func (i *memFileInfo) ModTime() time.Time { return i.modTime }
+func (i *memFileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *memFileInfo) Sys() any           { return nil }
+
+// memFile is an open memNode
+type memFile struct {
+	m      *memStorage
+	node   *memNode
+	name   string
+	flag   int
+	offset int64
+	closed bool
+}
+
+func (f *memFile) check(op string, write bool) error {
+	switch {
+	case f.closed:
+		return memError(op, f.name, os.ErrClosed)
+	case f.node.mode.IsDir():
+		return memError(op, f.name, syscall.EISDIR)
+	case write && f.flag&(os.O_WRONLY|os.O_RDWR) == 0:
+		return memError(op, f.name, syscall.EBADF)
+	case !write && f.flag&os.O_WRONLY != 0:
+		return memError(op, f.name, syscall.EBADF)
+	}
+	return nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	if f.offset >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[f.offset:])
+	f.offset += int64(n)
+	return n, nil
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, memError("readat", f.name, syscall.EINVAL)
+	}
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	if f.flag&os.O_APPEND != 0 {
+		f.offset = int64(len(f.node.data))
+	}
+	end := f.offset + int64(len(p))
+	if end > int64(len(f.node.data)) {
+		grown := make([]byte, end)
+		copy(grown, f.node.data)
+		f.node.data = grown
+	}
+	copy(f.node.data[f.offset:], p)
+	f.offset = end
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+
+	if f.closed {
+		return 0, memError("seek", f.name, os.ErrClosed)
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(len(f.node.data))
+	}
+	if offset < 0 {
+		return 0, memError("seek", f.name, syscall.EINVAL)
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memFile) Close() error {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+
+	if f.closed {
+		return memError("close", f.name, os.ErrClosed)
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+	return f.node.info(filepath.Base(f.name)), nil
+}
+
+func (f *memFile) Sync() error {
+	return nil
+}
+
+func (f *memFile) Chmod(mode fs.FileMode) error {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+	f.node.mode = f.node.mode&fs.ModeType | mode.Perm()
+	return nil
+}
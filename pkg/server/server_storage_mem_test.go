@@ -0,0 +1,313 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testServer runs handlers in memory, the same requests are sent to a server
+// on the local disk and one on NewMemStorage
+type testServer struct {
+	t *testing.T
+	s *Server
+	h http.Handler
+}
+
+func newTestServer(t *testing.T, fs Storage, config ServerConfig) *testServer {
+	t.Helper()
+	if config.MaxUploadSize == 0 {
+		config.MaxUploadSize = 1 << 20
+	}
+	s := NewServerWithStorage(config, fs)
+	s.quota.scan(s.trash, s.versions)
+	return &testServer{t: t, s: s, h: s.handler()}
+}
+
+// forEachStorage runs test against both storage backends
+func forEachStorage(t *testing.T, config ServerConfig, test func(t *testing.T, ts *testServer)) {
+	t.Run("os", func(t *testing.T) {
+		test(t, newTestServer(t, NewOSStorage(t.TempDir()), config))
+	})
+	t.Run("mem", func(t *testing.T) {
+		test(t, newTestServer(t, NewMemStorage(filepath.Join(string(filepath.Separator), "work")), config))
+	})
+}
+
+// testResponse is the json body of a response, data is decoded on demand
+type testResponse struct {
+	Status    int             `json:"status"`
+	Message   string          `json:"message"`
+	ErrorCode int             `json:"error_code"`
+	Data      json.RawMessage `json:"data"`
+}
+
+func (ts *testServer) do(method, target string, body io.Reader, contentType string) *httptest.ResponseRecorder {
+	ts.t.Helper()
+	r := httptest.NewRequest(method, target, body)
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	w := httptest.NewRecorder()
+	ts.h.ServeHTTP(w, r)
+	return w
+}
+
+// call sends a request, expects status and decodes data into out when set
+func (ts *testServer) call(method, target string, status int, out any) testResponse {
+	ts.t.Helper()
+	w := ts.do(method, target, nil, "")
+	return ts.decode(w, method, target, status, out)
+}
+
+func (ts *testServer) decode(w *httptest.ResponseRecorder, method, target string, status int, out any) testResponse {
+	ts.t.Helper()
+	var res testResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		ts.t.Fatalf("%s %s: invalid json %q: %v", method, target, w.Body.String(), err)
+	}
+	if w.Code != status {
+		ts.t.Fatalf("%s %s = %d %q; want %d", method, target, w.Code, res.Message, status)
+	}
+	// error responses carry no data
+	if out != nil && status < http.StatusBadRequest {
+		if err := json.Unmarshal(res.Data, out); err != nil {
+			ts.t.Fatalf("%s %s: invalid data %s: %v", method, target, res.Data, err)
+		}
+	}
+	return res
+}
+
+// upload posts files (name to content) into dir with the extra query params
+func (ts *testServer) upload(dir string, files map[string]string, query string, status int) []UploadResult {
+	ts.t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for name, content := range files {
+		part, err := mw.CreateFormFile("file", name)
+		if err != nil {
+			ts.t.Fatal(err)
+		}
+		part.Write([]byte(content))
+	}
+	mw.Close()
+
+	target := "/upload?distPath=" + url.QueryEscape(dir)
+	if query != "" {
+		target += "&" + query
+	}
+	w := ts.do("POST", target, &body, mw.FormDataContentType())
+	var results []UploadResult
+	ts.decode(w, "POST", target, status, &results)
+	return results
+}
+
+// content downloads path
+func (ts *testServer) content(path string) string {
+	ts.t.Helper()
+	target := "/download?path=" + url.QueryEscape(path)
+	w := ts.do("GET", target, nil, "")
+	if w.Code != http.StatusOK {
+		ts.t.Fatalf("GET %s = %d %q", target, w.Code, w.Body.String())
+	}
+	return w.Body.String()
+}
+
+// exists reports whether path is in the work dir, without following symlinks
+func (ts *testServer) exists(path string) bool {
+	ts.t.Helper()
+	local, err := ts.s.paths.Resolve(path)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	_, err = ts.s.fs.Lstat(local)
+	return err == nil
+}
+
+func (ts *testServer) usage() []QuotaReport {
+	ts.t.Helper()
+	var reports []QuotaReport
+	ts.call("GET", "/quota", http.StatusOK, &reports)
+	return reports
+}
+
+func TestUploadDownloadList(t *testing.T) {
+	forEachStorage(t, ServerConfig{}, func(t *testing.T, ts *testServer) {
+		results := ts.upload("docs", map[string]string{"a.txt": "hello"}, "", http.StatusOK)
+		if len(results) != 1 || results[0].Path != "docs/a.txt" || results[0].Size != 5 {
+			t.Fatalf("upload results = %+v", results)
+		}
+		if got := ts.content("docs/a.txt"); got != "hello" {
+			t.Fatalf("download = %q; want %q", got, "hello")
+		}
+
+		// naming strategies on conflict
+		ts.upload("docs", map[string]string{"a.txt": "x"}, "", http.StatusBadRequest)
+		results = ts.upload("docs", map[string]string{"a.txt": "again"}, "naming=suffix", http.StatusOK)
+		if results[0].Path != "docs/a (1).txt" {
+			t.Fatalf("suffix upload stored as %q", results[0].Path)
+		}
+
+		var list ListResult
+		ts.call("GET", "/list?path=docs", http.StatusOK, &list)
+		if list.Total != 2 || list.Entries[0].Name != "a (1).txt" || list.Entries[1].Name != "a.txt" {
+			t.Fatalf("list = %+v", list)
+		}
+
+		ts.call("GET", "/download?path=missing.txt", http.StatusNotFound, nil)
+		ts.call("GET", "/download?path=../etc/passwd", http.StatusForbidden, nil)
+	})
+}
+
+func TestMkdirMoveCopy(t *testing.T) {
+	forEachStorage(t, ServerConfig{}, func(t *testing.T, ts *testServer) {
+		ts.call("POST", "/mkdir?path=a/b&parents=true", http.StatusCreated, nil)
+		ts.call("POST", "/mkdir?path=a/b", http.StatusConflict, nil)
+		ts.upload("a/b", map[string]string{"f.txt": "data"}, "", http.StatusOK)
+
+		ts.call("POST", "/copy?from=a&to=c", http.StatusOK, nil)
+		if got := ts.content("c/b/f.txt"); got != "data" {
+			t.Fatalf("copied content = %q", got)
+		}
+		ts.call("POST", "/copy?from=a&to=a/b/x", http.StatusBadRequest, nil)
+
+		ts.call("POST", "/move?from=c/b/f.txt&to=g.txt", http.StatusOK, nil)
+		if ts.exists("c/b/f.txt") || ts.content("g.txt") != "data" {
+			t.Fatal("file not moved")
+		}
+		ts.call("POST", "/move?from=g.txt&to=a/b/f.txt", http.StatusConflict, nil)
+		ts.call("POST", "/move?from=g.txt&to=.httpserver/x", http.StatusForbidden, nil)
+	})
+}
+
+func TestCopySymlink(t *testing.T) {
+	forEachStorage(t, ServerConfig{}, func(t *testing.T, ts *testServer) {
+		ts.call("POST", "/mkdir?path=a/b&parents=true", http.StatusCreated, nil)
+		ts.upload("", map[string]string{"f.txt": "root"}, "", http.StatusOK)
+		root, _ := ts.s.paths.Root()
+		if err := ts.s.fs.Symlink("../../f.txt", filepath.Join(root, "a", "b", "up")); err != nil {
+			t.Fatal(err)
+		}
+
+		// one level up "../../f.txt" would leave the work dir
+		var results []UploadResult
+		ts.call("POST", "/copy?from=a/b&to=c", http.StatusOK, &results)
+		link, err := ts.s.fs.Readlink(filepath.Join(root, "c", "up"))
+		if err != nil || link != filepath.Join("..", "f.txt") {
+			t.Fatalf("copied link = %q, %v; want %q", link, err, "../f.txt")
+		}
+
+		ts.call("POST", "/copy?from=a/b&to=c&naming=suffix", http.StatusOK, &results)
+		if !ts.exists("c/up (1)") {
+			t.Fatalf("suffix copy of a symlink missing, results %+v", results)
+		}
+	})
+}
+
+func TestDeleteTrashRestore(t *testing.T) {
+	forEachStorage(t, ServerConfig{}, func(t *testing.T, ts *testServer) {
+		ts.upload("d", map[string]string{"f.txt": "gone"}, "", http.StatusOK)
+
+		var item TrashItem
+		ts.call("DELETE", "/delete?path=d/f.txt", http.StatusOK, &item)
+		if ts.exists("d/f.txt") {
+			t.Fatal("deleted file still there")
+		}
+		var items []TrashItem
+		ts.call("GET", "/trash", http.StatusOK, &items)
+		if len(items) != 1 || items[0].Path != "d/f.txt" {
+			t.Fatalf("trash = %+v", items)
+		}
+
+		ts.call("POST", "/trash/restore?id="+item.ID, http.StatusOK, nil)
+		if got := ts.content("d/f.txt"); got != "gone" {
+			t.Fatalf("restored content = %q", got)
+		}
+		ts.call("POST", "/trash/restore?id="+item.ID, http.StatusNotFound, nil)
+
+		ts.call("DELETE", "/delete?path=d&permanent=true", http.StatusOK, nil)
+		if ts.exists("d") {
+			t.Fatal("permanently deleted dir still there")
+		}
+		ts.call("DELETE", "/delete?path=", http.StatusForbidden, nil)
+	})
+}
+
+func TestOverwriteVersions(t *testing.T) {
+	count := 2
+	forEachStorage(t, ServerConfig{VersionMaxCount: &count}, func(t *testing.T, ts *testServer) {
+		for _, content := range []string{"v1", "v2", "v3", "v4"} {
+			ts.upload("", map[string]string{"f.txt": content}, "overwrite=true", http.StatusOK)
+		}
+		var versions []FileVersion
+		ts.call("GET", "/versions?path=f.txt", http.StatusOK, &versions)
+		if len(versions) != 2 {
+			t.Fatalf("%d versions kept; want 2", len(versions))
+		}
+
+		ts.call("POST", "/versions/restore?path=f.txt&id="+versions[1].ID, http.StatusOK, nil)
+		if got := ts.content("f.txt"); got != "v2" {
+			t.Fatalf("restored content = %q; want %q", got, "v2")
+		}
+	})
+}
+
+func TestQuota(t *testing.T) {
+	config := ServerConfig{DirQuotas: map[string]DirQuota{"q": {MaxBytes: 10}}}
+	forEachStorage(t, config, func(t *testing.T, ts *testServer) {
+		ts.upload("q", map[string]string{"a": "123456"}, "", http.StatusOK)
+		ts.upload("q", map[string]string{"b": "123456"}, "", http.StatusInsufficientStorage)
+
+		// the trash still counts until purged
+		var item TrashItem
+		ts.call("DELETE", "/delete?path=q/a", http.StatusOK, &item)
+		if got := ts.usage()[0]; got.UsedBytes != 6 || got.UsedFiles != 1 {
+			t.Fatalf("usage after delete = %+v", got)
+		}
+		ts.upload("q", map[string]string{"b": "123456"}, "", http.StatusInsufficientStorage)
+
+		ts.call("DELETE", "/trash?id="+item.ID, http.StatusOK, nil)
+		if got := ts.usage()[0]; got.UsedBytes != 0 || got.UsedFiles != 0 {
+			t.Fatalf("usage after purge = %+v", got)
+		}
+		ts.upload("q", map[string]string{"b": "123456"}, "", http.StatusOK)
+		ts.call("POST", "/copy?from=q/b&to=q/c", http.StatusInsufficientStorage, nil)
+		ts.call("POST", "/copy?from=q/b&to=c", http.StatusOK, nil)
+
+		// a fresh scan agrees with the tracked usage
+		want := ts.usage()
+		ts.s.quota.scan(ts.s.trash, ts.s.versions)
+		if got := ts.usage(); got[0] != want[0] {
+			t.Fatalf("scanned usage = %+v; tracked %+v", got, want)
+		}
+	})
+}
+
+func TestReadmeSkipsEscapingSymlink(t *testing.T) {
+	forEachStorage(t, ServerConfig{}, func(t *testing.T, ts *testServer) {
+		root, _ := ts.s.paths.Root()
+		secret := filepath.Join(filepath.Dir(root), "secret.md")
+		if err := writeFile(ts.s.fs, secret, []byte("top secret"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := ts.s.fs.Symlink(secret, filepath.Join(root, "README.md")); err != nil {
+			t.Fatal(err)
+		}
+		ts.upload("", map[string]string{"README.txt": "shown instead"}, "", http.StatusOK)
+
+		w := ts.do("GET", "/files/", nil, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET /files/ = %d", w.Code)
+		}
+		if body := w.Body.String(); strings.Contains(body, "top secret") || !strings.Contains(body, "shown instead") {
+			t.Fatalf("listing shows the wrong readme:\n%s", body)
+		}
+	})
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	resp "httpserver/internal/response"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSweepEveryFreesExpired(t *testing.T) {
+	count := 10
+	config := ServerConfig{QuotaMaxBytes: 1 << 20, VersionMaxCount: &count}
+	forEachStorage(t, config, func(t *testing.T, ts *testServer) {
+		ts.upload("", map[string]string{"f.txt": "v1"}, "", http.StatusOK)
+		ts.upload("", map[string]string{"f.txt": "v2"}, "overwrite=true", http.StatusOK)
+		// items get their expiry when deleted
+		ts.s.trash.retention = time.Millisecond
+		ts.call("DELETE", "/delete?path=f.txt", http.StatusOK, nil)
+		if got := ts.usage()[0]; got.UsedBytes != 4 || got.UsedFiles != 2 {
+			t.Fatalf("usage of the trash and the version = %+v", got)
+		}
+
+		ts.s.versions.maxAge = time.Millisecond
+		done := make(chan struct{})
+		defer close(done)
+		go ts.s.sweepEvery(time.Millisecond, done)
+
+		// nothing lists or restores, only the sweep frees the quota
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			got := ts.usage()[0]
+			if got.UsedBytes == 0 && got.UsedFiles == 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("usage not freed by the sweep: %+v", got)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	})
+}
+
+type testPart struct {
+	field, name, content string
+}
+
+// postParts uploads parts with the form values, in order
+func (ts *testServer) postParts(query string, parts []testPart, values map[string][]string) *httptest.ResponseRecorder {
+	ts.t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for field, vs := range values {
+		for _, v := range vs {
+			mw.WriteField(field, v)
+		}
+	}
+	for _, p := range parts {
+		part, err := mw.CreateFormFile(p.field, p.name)
+		if err != nil {
+			ts.t.Fatal(err)
+		}
+		part.Write([]byte(p.content))
+	}
+	mw.Close()
+	return ts.do("POST", "/upload?"+query, &body, mw.FormDataContentType())
+}
+
+func TestUploadParts(t *testing.T) {
+	hexSum := func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+	tests := []struct {
+		name   string
+		parts  []testPart
+		values map[string][]string
+		status int
+		// per part, in the order of the results
+		fields   []string
+		statuses []int
+		codes    []int
+		stored   []string
+	}{
+		{
+			name:   "all stored",
+			parts:  []testPart{{"file", "a.txt", "a"}, {"docs", "b.txt", "b"}},
+			status: http.StatusOK,
+			// fields are taken in name order
+			fields: []string{"docs", "file"}, statuses: []int{200, 200}, codes: []int{0, 0},
+			stored: []string{"a.txt", "b.txt"},
+		},
+		{
+			name:   "one conflict",
+			parts:  []testPart{{"file", "old.txt", "new"}, {"file", "a.txt", "a"}},
+			status: http.StatusMultiStatus,
+			fields: []string{"file", "file"}, statuses: []int{400, 200}, codes: []int{resp.CodeFileExists, 0},
+			stored: []string{"a.txt"},
+		},
+		{
+			name:   "all failed",
+			parts:  []testPart{{"file", "old.txt", "new"}, {"docs", "old.txt", "new"}},
+			status: http.StatusMultiStatus,
+			fields: []string{"docs", "file"}, statuses: []int{400, 400}, codes: []int{resp.CodeFileExists, resp.CodeFileExists},
+		},
+		{
+			name:   "digest mismatch",
+			parts:  []testPart{{"file", "a.txt", "a"}, {"file", "b.txt", "b"}},
+			values: map[string][]string{"sha256": {hexSum("a"), hexSum("not b")}},
+			status: http.StatusMultiStatus,
+			fields: []string{"file", "file"}, statuses: []int{200, 400}, codes: []int{0, resp.CodeDigestMismatch},
+			stored: []string{"a.txt"},
+		},
+		{
+			name:   "too large",
+			parts:  []testPart{{"file", "a.txt", "a"}, {"file", "big.txt", strings.Repeat("x", 2<<20)}},
+			status: http.StatusMultiStatus,
+			fields: []string{"file", "file"}, statuses: []int{200, 413}, codes: []int{0, resp.CodeUploadTooLarge},
+			stored: []string{"a.txt"},
+		},
+		{
+			name:   "digest count",
+			parts:  []testPart{{"file", "a.txt", "a"}, {"file", "b.txt", "b"}},
+			values: map[string][]string{"sha256": {hexSum("a")}},
+			status: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachStorage(t, ServerConfig{}, func(t *testing.T, ts *testServer) {
+				ts.upload("", map[string]string{"old.txt": "old"}, "", http.StatusOK)
+
+				w := ts.postParts("distPath=", tt.parts, tt.values)
+				var results []UploadResult
+				ts.decode(w, "POST", "/upload", tt.status, &results)
+				if len(results) != len(tt.statuses) {
+					t.Fatalf("%d results; want %d: %+v", len(results), len(tt.statuses), results)
+				}
+				for i, r := range results {
+					if r.Field != tt.fields[i] || r.Status != tt.statuses[i] || r.Code != tt.codes[i] {
+						t.Errorf("result %d = field %q, status %d, code %d; want %q, %d, %d",
+							i, r.Field, r.Status, r.Code, tt.fields[i], tt.statuses[i], tt.codes[i])
+					}
+					if (r.Status == http.StatusOK) != (r.Error == "") {
+						t.Errorf("result %d: status %d with error %q", i, r.Status, r.Error)
+					}
+				}
+
+				var list ListResult
+				ts.call("GET", "/list", http.StatusOK, &list)
+				if list.Total != 1+len(tt.stored) {
+					t.Fatalf("%d files after the upload; want old.txt and %q", list.Total, tt.stored)
+				}
+				for _, name := range tt.stored {
+					if !ts.exists(name) {
+						t.Errorf("%s not stored", name)
+					}
+				}
+				if got := ts.content("old.txt"); got != "old" {
+					t.Errorf("old.txt = %q", got)
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,446 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	resp "httpserver/internal/response"
+	logger "httpserver/pkg/log"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// resized images are cached in the thumbnails dir inside the state dir,
+// named by a hash of the source path, mtime and size and the requested size,
+// so a changed source never hits an old entry
+const thumbnailStateDir = "thumbnails"
+
+const (
+	// largest width or height that can be requested
+	thumbnailMaxSize = 4096
+	// sources with more pixels are refused, decoding holds all of them in memory
+	thumbnailMaxPixels = 50_000_000
+	// default memory budget of the images being decoded
+	thumbnailDefaultMemory = 512 << 20
+	// cache entries are removed this long after they were made
+	thumbnailCacheMaxAge = 30 * 24 * time.Hour
+)
+
+// thumbnail fit modes
+const (
+	// keep the whole image within w x h, never upscaled
+	fitContain = "contain"
+	// fill w x h, cropping what overflows
+	fitCover = "cover"
+	// stretch to w x h
+	fitFill = "fill"
+)
+
+var (
+	errImageUnsupported = errors.New("not a JPEG, PNG or GIF image")
+	errImageTooLarge    = errors.New("image too large")
+)
+
+// isImageName reports whether name has the extension of a supported image
+func isImageName(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".jpg", ".jpeg", ".png", ".gif":
+		return true
+	}
+	return false
+}
+
+// thumbnailer limits the number of images decoded at once and the memory
+// they hold together
+type thumbnailer struct {
+	sem    chan struct{}
+	budget int64
+
+	mu   sync.Mutex
+	used int64
+	// closed when memory is released
+	released chan struct{}
+}
+
+// newThumbnailer decodes up to workers images at once, one per CPU when zero,
+// holding up to memory bytes, thumbnailDefaultMemory when zero
+func newThumbnailer(workers int, memory int64) *thumbnailer {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if memory <= 0 {
+		memory = thumbnailDefaultMemory
+	}
+	return &thumbnailer{sem: make(chan struct{}, workers), budget: memory, released: make(chan struct{})}
+}
+
+// acquire waits until n bytes of the budget are free
+func (t *thumbnailer) acquire(ctx context.Context, n int64) error {
+	if n > t.budget {
+		return errImageTooLarge
+	}
+	for {
+		t.mu.Lock()
+		if t.used+n <= t.budget {
+			t.used += n
+			t.mu.Unlock()
+			return nil
+		}
+		released := t.released
+		t.mu.Unlock()
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (t *thumbnailer) release(n int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.used -= n
+	close(t.released)
+	t.released = make(chan struct{})
+}
+
+// sweepThumbnails removes old cache entries and leftovers of interrupted writes
+func (s *Server) sweepThumbnails() {
+	dir, err := s.paths.StateDir(thumbnailStateDir)
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to open thumbnails dir: %v", err))
+		return
+	}
+	entries, err := s.fs.ReadDir(dir)
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to read thumbnails dir: %v", err))
+		return
+	}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		maxAge := thumbnailCacheMaxAge
+		if strings.HasPrefix(e.Name(), "tmp-") {
+			maxAge = stagingMaxAge
+		}
+		if time.Since(info.ModTime()) < maxAge {
+			continue
+		}
+		if err := s.fs.Remove(filepath.Join(dir, e.Name())); err != nil {
+			logger.Warn(fmt.Sprintf("failed to remove thumbnail %v: %v", e.Name(), err))
+		}
+	}
+}
+
+// returns a resized copy of an image, a PNG for PNG and GIF sources and a JPEG for JPEG ones
+// query params:
+// - path: a JPEG, PNG or GIF file
+// - w, h: max width and height in pixels, at least one of them
+// - fit: contain (default) keeps the whole image within w x h without
+// upscaling, cover fills w x h cropping the overflow, fill stretches to w x h
+func (s *Server) thumbnailHandler(w http.ResponseWriter, r *http.Request) resp.Response {
+	q := r.URL.Query()
+	localPath, err := s.paths.Resolve(q.Get("path"))
+	if err != nil {
+		logger.Error(fmt.Sprintf("invalid path: %v", err))
+		return pathErrorResponse(err)
+	}
+	width, err := thumbnailDimension(q.Get("w"))
+	if err != nil {
+		logger.Error(fmt.Sprintf("invalid w: %v", err))
+		return errorResponse(http.StatusBadRequest, fmt.Errorf("invalid w: %w", err))
+	}
+	height, err := thumbnailDimension(q.Get("h"))
+	if err != nil {
+		logger.Error(fmt.Sprintf("invalid h: %v", err))
+		return errorResponse(http.StatusBadRequest, fmt.Errorf("invalid h: %w", err))
+	}
+	if width == 0 && height == 0 {
+		logger.Error("no thumbnail size given")
+		return errorResponse(http.StatusBadRequest, errors.New("w or h is required"))
+	}
+	fit := q.Get("fit")
+	switch fit {
+	case "":
+		fit = fitContain
+	case fitContain, fitCover, fitFill:
+	default:
+		logger.Error(fmt.Sprintf("invalid fit: %q", fit))
+		return errorResponse(http.StatusBadRequest, fmt.Errorf("invalid fit: %q, want contain, cover or fill", fit))
+	}
+
+	info, err := s.fs.Stat(localPath)
+	if err != nil {
+		logger.Error(fmt.Sprintf("file not found: %v", err))
+		return errorCodeResponse(http.StatusNotFound, resp.CodeNotFound, errors.New("file not found"))
+	}
+	if !info.Mode().IsRegular() {
+		logger.Error("not a file")
+		return errorCodeResponse(http.StatusBadRequest, resp.CodeImageInvalid, errImageUnsupported)
+	}
+
+	sum := sha256.Sum256(fmt.Appendf(nil, "%s\x00%d\x00%d\x00%d\x00%d\x00%s",
+		s.paths.Rel(localPath), info.ModTime().UnixNano(), info.Size(), width, height, fit))
+	key := hex.EncodeToString(sum[:])
+	dir, err := s.paths.StateDir(thumbnailStateDir)
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to open thumbnails dir: %v", err))
+		return errorResponse(http.StatusInternalServerError, errors.New("failed to make thumbnail"))
+	}
+	cached := filepath.Join(dir, key)
+
+	if _, err := s.fs.Stat(cached); err != nil {
+		select {
+		case s.thumbs.sem <- struct{}{}:
+		case <-r.Context().Done():
+			return nil
+		}
+		// the same thumbnail may have been made while waiting
+		var makeErr error
+		if _, err := s.fs.Stat(cached); err != nil {
+			makeErr = s.makeThumbnail(r.Context(), localPath, cached, width, height, fit)
+		}
+		<-s.thumbs.sem
+		if err := makeErr; err != nil {
+			logger.Error(fmt.Sprintf("failed to make thumbnail of %v: %v", localPath, err))
+			switch {
+			case errors.Is(err, errImageUnsupported):
+				return errorCodeResponse(http.StatusUnsupportedMediaType, resp.CodeImageInvalid, err)
+			case errors.Is(err, errImageTooLarge):
+				return errorCodeResponse(http.StatusRequestEntityTooLarge, resp.CodeImageTooLarge, err)
+			}
+			return errorResponse(http.StatusInternalServerError, errors.New("failed to make thumbnail"))
+		}
+	}
+
+	file, err := s.fs.Open(cached)
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to open thumbnail: %v", err))
+		return errorResponse(http.StatusInternalServerError, errors.New("failed to open thumbnail"))
+	}
+	defer file.Close()
+
+	// the cache entry is unnamed, ServeContent sniffs the type
+	w.Header().Set("ETag", `"`+key[:32]+`"`)
+	http.ServeContent(w, r, "", info.ModTime(), file)
+	return nil
+}
+
+// thumbnailDimension parses a requested width or height, 0 when empty
+func thumbnailDimension(v string) (int, error) {
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 || n > thumbnailMaxSize {
+		return 0, fmt.Errorf("%q, want 1 to %d", v, thumbnailMaxSize)
+	}
+	return n, nil
+}
+
+// makeThumbnail decodes src and writes it resized to dest
+func (s *Server) makeThumbnail(ctx context.Context, src, dest string, width, height int, fit string) error {
+	f, err := s.fs.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// check the size before decoding the pixels
+	config, format, err := image.DecodeConfig(f)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errImageUnsupported, err)
+	}
+	if config.Width <= 0 || config.Height <= 0 {
+		return fmt.Errorf("%w: empty image", errImageUnsupported)
+	}
+	if config.Width*config.Height > thumbnailMaxPixels {
+		return fmt.Errorf("%w: %dx%d", errImageTooLarge, config.Width, config.Height)
+	}
+	crop, tw, th := thumbnailGeometry(image.Rect(0, 0, config.Width, config.Height), width, height, fit)
+	memory := thumbnailMemory(config, crop, tw, th)
+	if err := s.thumbs.acquire(ctx, memory); err != nil {
+		if errors.Is(err, errImageTooLarge) {
+			return fmt.Errorf("%w: %dx%d to %dx%d needs %d bytes", err, config.Width, config.Height, tw, th, memory)
+		}
+		return err
+	}
+	defer s.thumbs.release(memory)
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errImageUnsupported, err)
+	}
+	img = resizeImage(img, width, height, fit)
+
+	tmpFile, err := s.fs.CreateTemp(filepath.Dir(dest), "tmp-*")
+	if err != nil {
+		return err
+	}
+	if format == "jpeg" {
+		err = jpeg.Encode(tmpFile, img, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(tmpFile, img)
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = s.fs.Rename(tmpFile.Name(), dest)
+	}
+	if err != nil {
+		s.fs.Remove(tmpFile.Name())
+		return err
+	}
+	return nil
+}
+
+// thumbnailMemory estimates the bytes held while making a thumbnail: the
+// decoded source, its RGBA copy and both passes of the scaling
+func thumbnailMemory(config image.Config, crop image.Rectangle, width, height int) int64 {
+	decoded := int64(config.Width) * int64(config.Height) * bytesPerPixel(config.ColorModel)
+	copied := int64(crop.Dx()) * int64(crop.Dy()) * 4
+	scaled := (int64(width)*int64(crop.Dy()) + int64(width)*int64(height)) * 4
+	return decoded + copied + scaled
+}
+
+// bytesPerPixel is the size of a pixel decoded in model, at most
+func bytesPerPixel(model color.Model) int64 {
+	if _, ok := model.(color.Palette); ok {
+		return 1
+	}
+	switch model {
+	case color.GrayModel:
+		return 1
+	case color.Gray16Model:
+		return 2
+	case color.YCbCrModel:
+		return 3
+	case color.RGBA64Model, color.NRGBA64Model:
+		return 8
+	}
+	return 4
+}
+
+// resizeImage scales img to fit width x height, either may be 0 to follow
+// the aspect ratio
+func resizeImage(img image.Image, width, height int, fit string) *image.RGBA {
+	b, width, height := thumbnailGeometry(img.Bounds(), width, height, fit)
+	src := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	return scaleRGBA(src, width, height)
+}
+
+// thumbnailGeometry returns the part of the source in b that is scaled and
+// the size it is scaled to
+func thumbnailGeometry(b image.Rectangle, width, height int, fit string) (image.Rectangle, int, int) {
+	sw, sh := b.Dx(), b.Dy()
+
+	// a single given side or fit=contain keeps the aspect ratio
+	if width == 0 || height == 0 || fit == fitContain {
+		scale := 0.0
+		switch {
+		case width == 0:
+			scale = float64(height) / float64(sh)
+		case height == 0:
+			scale = float64(width) / float64(sw)
+		default:
+			scale = min(float64(width)/float64(sw), float64(height)/float64(sh))
+		}
+		if fit == fitContain {
+			scale = min(scale, 1)
+		}
+		width = max(int(float64(sw)*scale+0.5), 1)
+		height = max(int(float64(sh)*scale+0.5), 1)
+	} else if fit == fitCover {
+		// crop the center to the target aspect ratio
+		scale := max(float64(width)/float64(sw), float64(height)/float64(sh))
+		cw := min(max(int(float64(width)/scale+0.5), 1), sw)
+		ch := min(max(int(float64(height)/scale+0.5), 1), sh)
+		x := b.Min.X + (sw-cw)/2
+		y := b.Min.Y + (sh-ch)/2
+		b = image.Rect(x, y, x+cw, y+ch)
+	}
+	return b, width, height
+}
+
+// scaleRGBA resizes src to width x height averaging the source pixels
+// covered by each target pixel, one axis at a time. Pixels are
+// premultiplied so transparent ones don't darken their neighbours.
+func scaleRGBA(src *image.RGBA, width, height int) *image.RGBA {
+	sw, sh := src.Rect.Dx(), src.Rect.Dy()
+	if sw == width && sh == height {
+		return src
+	}
+
+	// horizontal pass, width x sh
+	tmp := image.NewRGBA(image.Rect(0, 0, width, sh))
+	spans := boxSpans(sw, width)
+	for y := range sh {
+		row := src.Pix[y*src.Stride:]
+		out := tmp.Pix[y*tmp.Stride:]
+		for x, span := range spans {
+			averagePixels(out[x*4:], row, span, 4)
+		}
+	}
+
+	// vertical pass, width x height
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	spans = boxSpans(sh, height)
+	for x := range width {
+		col := tmp.Pix[x*4:]
+		for y, span := range spans {
+			averagePixels(dst.Pix[y*dst.Stride+x*4:], col, span, tmp.Stride)
+		}
+	}
+	return dst
+}
+
+// boxSpans returns for each of n target pixels the range of the srcN source
+// pixels it covers, at least one
+func boxSpans(srcN, n int) [][2]int {
+	spans := make([][2]int, n)
+	for i := range spans {
+		start := i * srcN / n
+		end := max((i+1)*srcN/n, start+1)
+		spans[i] = [2]int{start, end}
+	}
+	return spans
+}
+
+// averagePixels writes to out the mean of the RGBA pixels span[0] to span[1]
+// of line, stride bytes apart
+func averagePixels(out, line []byte, span [2]int, stride int) {
+	var r, g, b, a int
+	for i := span[0]; i < span[1]; i++ {
+		p := line[i*stride : i*stride+4]
+		r += int(p[0])
+		g += int(p[1])
+		b += int(p[2])
+		a += int(p[3])
+	}
+	n := span[1] - span[0]
+	out[0] = uint8((r + n/2) / n)
+	out[1] = uint8((g + n/2) / n)
+	out[2] = uint8((b + n/2) / n)
+	out[3] = uint8((a + n/2) / n)
+}
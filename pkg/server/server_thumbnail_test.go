@@ -0,0 +1,100 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func encodePNG(t *testing.T, img image.Image) string {
+	t.Helper()
+	var b bytes.Buffer
+	if err := png.Encode(&b, img); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+func TestThumbnailLimits(t *testing.T) {
+	images := map[string]string{
+		"small.png": encodePNG(t, image.NewRGBA(image.Rect(0, 0, 100, 50))),
+		// few pixels, but stretched the scaling would need gigabytes
+		"tall.png": encodePNG(t, image.NewGray(image.Rect(0, 0, 1, 1_000_000))),
+		"big.png":  encodePNG(t, image.NewRGBA(image.Rect(0, 0, 1000, 1000))),
+		"text.png": "not an image",
+	}
+	tests := []struct {
+		name   string
+		query  string
+		memory int64
+		status int
+		// size of the thumbnail
+		width, height int
+	}{
+		{name: "contain", query: "path=small.png&w=10", status: http.StatusOK, width: 10, height: 5},
+		{name: "no upscale", query: "path=small.png&w=400&h=400", status: http.StatusOK, width: 100, height: 50},
+		{name: "fill", query: "path=small.png&w=30&h=30&fit=fill", status: http.StatusOK, width: 30, height: 30},
+		{name: "no size", query: "path=small.png", status: http.StatusBadRequest},
+		{name: "size too large", query: "path=small.png&w=5000", status: http.StatusBadRequest},
+		{name: "not an image", query: "path=text.png&w=10", status: http.StatusUnsupportedMediaType},
+		{name: "stretched", query: "path=tall.png&w=4096&h=4096&fit=fill", status: http.StatusRequestEntityTooLarge},
+		{name: "shrunk", query: "path=tall.png&h=100", status: http.StatusOK, width: 1, height: 100},
+		{name: "within budget", query: "path=big.png&w=10", status: http.StatusOK, width: 10, height: 10},
+		{name: "over budget", query: "path=big.png&w=10", memory: 1 << 20, status: http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachStorage(t, ServerConfig{ThumbnailMemory: tt.memory, MaxUploadSize: 1 << 24}, func(t *testing.T, ts *testServer) {
+				ts.upload("", images, "", http.StatusOK)
+
+				w := ts.do("GET", "/thumbnail?"+tt.query, nil, "")
+				if w.Code != tt.status {
+					t.Fatalf("GET /thumbnail?%s = %d %q; want %d", tt.query, w.Code, w.Body.String(), tt.status)
+				}
+				if tt.status != http.StatusOK {
+					return
+				}
+				config, err := png.DecodeConfig(w.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if config.Width != tt.width || config.Height != tt.height {
+					t.Fatalf("thumbnail is %dx%d; want %dx%d", config.Width, config.Height, tt.width, tt.height)
+				}
+			})
+		})
+	}
+}
+
+func TestThumbnailerSharesMemory(t *testing.T) {
+	th := newThumbnailer(4, 100)
+	if err := th.acquire(context.Background(), 101); err == nil {
+		t.Fatal("acquired more than the budget")
+	}
+	if err := th.acquire(context.Background(), 60); err != nil {
+		t.Fatal(err)
+	}
+
+	// waits until the first image is done
+	acquired := make(chan error, 1)
+	go func() { acquired <- th.acquire(context.Background(), 60) }()
+	select {
+	case <-acquired:
+		t.Fatal("acquired past the budget")
+	case <-time.After(20 * time.Millisecond):
+	}
+	th.release(60)
+	if err := <-acquired; err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := th.acquire(ctx, 60); err == nil {
+		t.Fatal("acquired with a canceled context past the budget")
+	}
+}
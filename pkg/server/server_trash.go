@@ -0,0 +1,382 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	resp "httpserver/internal/response"
+	logger "httpserver/pkg/log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// deleted files are moved to the trash dir inside the state dir, each one as
+// <id> next to <id>.json holding where it came from, until restored, purged
+// or older than the retention
+const trashStateDir = "trash"
+
+var errTrashItemNotFound = errors.New("trash item not found")
+
+// TrashItem is a deleted file or directory
+type TrashItem struct {
+	ID string `json:"id"`
+	// original path relative to workDir
+	Path      string    `json:"path"`
+	IsDir     bool      `json:"is_dir"`
+	Size      int64     `json:"size"`
+	DeletedAt time.Time `json:"deleted_at"`
+	// purged after this time, unset when kept until purged
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+}
+
+type trashStore struct {
+	fs        Storage
+	paths     *PathResolver
+	retention time.Duration
+	quota     *quotaTracker
+
+	mu sync.Mutex
+}
+
+func newTrashStore(fs Storage, paths *PathResolver, retention time.Duration, quota *quotaTracker) *trashStore {
+	return &trashStore{
+		fs:        fs,
+		paths:     paths,
+		retention: retention,
+		quota:     quota,
+	}
+}
+
+func (t *trashStore) files(id string) (info string, data string, err error) {
+	dir, err := t.paths.StateDir(trashStateDir)
+	if err != nil {
+		return "", "", err
+	}
+	return filepath.Join(dir, id+".json"), filepath.Join(dir, id), nil
+}
+
+// origin returns the local path an item was deleted from
+func (t *trashStore) origin(item *TrashItem) string {
+	root, err := t.paths.Root()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(root, filepath.FromSlash(item.Path))
+}
+
+// put moves local into the trash, its content still counts toward the quota
+// of local until purged
+func (t *trashStore) put(local string) (*TrashItem, error) {
+	info, err := t.fs.Lstat(local)
+	if err != nil {
+		return nil, err
+	}
+	id, err := newUUID()
+	if err != nil {
+		return nil, err
+	}
+	item := &TrashItem{
+		ID:        id,
+		Path:      t.paths.Rel(local),
+		IsDir:     info.IsDir(),
+		DeletedAt: time.Now().UTC(),
+	}
+	if !item.IsDir {
+		item.Size = info.Size()
+	}
+	if t.retention > 0 {
+		item.ExpiresAt = item.DeletedAt.Add(t.retention)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	infoPath, dataPath, err := t.files(id)
+	if err != nil {
+		return nil, err
+	}
+	// the info goes first, sweep drops it when the move never happened
+	b, err := json.Marshal(item)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFile(t.fs, infoPath, b, 0644); err != nil {
+		return nil, err
+	}
+	if err := moveFile(t.fs, local, dataPath); err != nil {
+		t.fs.Remove(infoPath)
+		return nil, err
+	}
+	syncDir(t.fs, filepath.Dir(local))
+	return item, nil
+}
+
+func (t *trashStore) load(id string) (*TrashItem, error) {
+	if !validUUID(id) {
+		return nil, errTrashItemNotFound
+	}
+	infoPath, dataPath, err := t.files(id)
+	if err != nil {
+		return nil, err
+	}
+	b, err := readFile(t.fs, infoPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errTrashItemNotFound
+		}
+		return nil, err
+	}
+	item := &TrashItem{}
+	if err := json.Unmarshal(b, item); err != nil {
+		return nil, err
+	}
+	if _, err := t.fs.Lstat(dataPath); err != nil {
+		t.fs.Remove(infoPath)
+		return nil, errTrashItemNotFound
+	}
+	if !item.ExpiresAt.IsZero() && time.Now().After(item.ExpiresAt) {
+		t.remove(item)
+		return nil, errTrashItemNotFound
+	}
+	return item, nil
+}
+
+func (t *trashStore) remove(item *TrashItem) error {
+	infoPath, dataPath, err := t.files(item.ID)
+	if err != nil {
+		return err
+	}
+	usage := t.quota.usage(dataPath)
+	err = t.fs.RemoveAll(dataPath)
+	// part of the tree may be gone even on error
+	t.quota.update(t.origin(item), t.quota.usage(dataPath).sub(usage))
+	if err != nil {
+		return err
+	}
+	return t.fs.Remove(infoPath)
+}
+
+// list returns the items, most recently deleted first
+func (t *trashStore) list() ([]TrashItem, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	dir, err := t.paths.StateDir(trashStateDir)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := t.fs.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]TrashItem, 0)
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok {
+			continue
+		}
+		item, err := t.load(id)
+		if err != nil {
+			if !errors.Is(err, errTrashItemNotFound) {
+				logger.Warn(fmt.Sprintf("failed to load trash item %v: %v", id, err))
+			}
+			continue
+		}
+		items = append(items, *item)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].DeletedAt.After(items[j].DeletedAt) })
+	return items, nil
+}
+
+// restore moves an item back to dest, its original path when empty
+func (t *trashStore) restore(id, dest string) (*TrashItem, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	item, err := t.load(id)
+	if err != nil {
+		return nil, err
+	}
+	if dest == "" {
+		dest = item.Path
+	}
+	local, err := t.paths.Resolve(dest)
+	if err != nil {
+		return nil, err
+	}
+	// the work dir itself always exists
+	if _, err := t.fs.Lstat(local); err == nil {
+		return nil, ErrFileExists
+	}
+
+	infoPath, dataPath, err := t.files(id)
+	if err != nil {
+		return nil, err
+	}
+	// the content already counts at its original path
+	origin := t.origin(item)
+	usage := t.quota.usage(dataPath)
+	res, err := t.quota.reserve(local, usage, origin)
+	if err != nil {
+		return nil, err
+	}
+	defer res.release()
+
+	if err := t.fs.MkdirAll(filepath.Dir(local), 0755); err != nil {
+		return nil, err
+	}
+	if err := moveFile(t.fs, dataPath, local); err != nil {
+		return nil, err
+	}
+	t.fs.Remove(infoPath)
+	syncDir(t.fs, filepath.Dir(local))
+	t.quota.moved(origin, local, usage)
+
+	item.Path = t.paths.Rel(local)
+	return item, nil
+}
+
+// purge deletes an item for good
+func (t *trashStore) purge(id string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	item, err := t.load(id)
+	if err != nil {
+		return err
+	}
+	return t.remove(item)
+}
+
+// stored counts the content of every item at its original path
+func (t *trashStore) stored(count func(local string, u quotaUsage)) {
+	items, err := t.list()
+	if err != nil {
+		logger.Warn(fmt.Sprintf("quota scan skips the trash: %v", err))
+		return
+	}
+	for _, item := range items {
+		_, dataPath, err := t.files(item.ID)
+		if err != nil {
+			continue
+		}
+		count(t.origin(&item), t.quota.usage(dataPath))
+	}
+}
+
+// sweep removes expired items and leftovers of interrupted deletes
+func (t *trashStore) sweep() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	dir, err := t.paths.StateDir(trashStateDir)
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to open trash dir: %v", err))
+		return
+	}
+	entries, err := t.fs.ReadDir(dir)
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to read trash dir: %v", err))
+		return
+	}
+	for _, e := range entries {
+		if id, ok := strings.CutSuffix(e.Name(), ".json"); ok {
+			if _, err := t.load(id); err != nil && !errors.Is(err, errTrashItemNotFound) {
+				logger.Warn(fmt.Sprintf("failed to load trash item %v: %v", id, err))
+			}
+			continue
+		}
+		// content without info can't be restored anyway
+		if _, err := t.fs.Stat(filepath.Join(dir, e.Name()+".json")); os.IsNotExist(err) {
+			if err := t.fs.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+				logger.Warn(fmt.Sprintf("failed to remove trash leftover %v: %v", e.Name(), err))
+			}
+		}
+	}
+}
+
+// trashErrorResponse converts an error of the trash store to a response
+func trashErrorResponse(err error) resp.Response {
+	switch {
+	case errors.Is(err, errTrashItemNotFound):
+		return errorCodeResponse(http.StatusNotFound, resp.CodeTrashNotFound, err)
+	case errors.Is(err, ErrFileExists):
+		return errorCodeResponse(http.StatusConflict, resp.CodeFileExists, err)
+	case errors.Is(err, ErrQuotaExceeded):
+		return quotaErrorResponse(err)
+	}
+	var pathErr *PathError
+	if errors.As(err, &pathErr) {
+		return pathErrorResponse(err)
+	}
+	return errorResponse(http.StatusInternalServerError, errors.New("failed to access trash"))
+}
+
+// lists the trash
+func (s *Server) trashListHandler(w http.ResponseWriter, r *http.Request) resp.Response {
+	items, err := s.trash.list()
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to list trash: %v", err))
+		return trashErrorResponse(err)
+	}
+	return successResponse(http.StatusOK, "List trash successfully", items)
+}
+
+// restores a deleted file or directory
+// form params:
+// - id: the trash item
+// - path: optional destination, default to the original path
+func (s *Server) trashRestoreHandler(w http.ResponseWriter, r *http.Request) resp.Response {
+	item, err := s.trash.restore(r.FormValue("id"), r.FormValue("path"))
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to restore: %v", err))
+		return trashErrorResponse(err)
+	}
+	return successResponse(http.StatusOK, "Restore successfully", item)
+}
+
+// deletes trash items for good
+// query params:
+// - id: repeated, the items to purge
+// - all: if true, empty the whole trash
+func (s *Server) trashPurgeHandler(w http.ResponseWriter, r *http.Request) resp.Response {
+	q := r.URL.Query()
+	ids := q["id"]
+	var all bool
+	if v := q.Get("all"); v != "" {
+		var err error
+		if all, err = strconv.ParseBool(v); err != nil {
+			logger.Error(fmt.Sprintf("invalid all: %q", v))
+			return errorResponse(http.StatusBadRequest, fmt.Errorf("invalid all: %q", v))
+		}
+	}
+	if all {
+		items, err := s.trash.list()
+		if err != nil {
+			logger.Error(fmt.Sprintf("failed to list trash: %v", err))
+			return trashErrorResponse(err)
+		}
+		ids = ids[:0]
+		for _, item := range items {
+			ids = append(ids, item.ID)
+		}
+	}
+	if len(ids) == 0 && !all {
+		logger.Error("no trash item to purge")
+		return errorResponse(http.StatusBadRequest, errors.New("no trash item to purge, pass id or all=true"))
+	}
+
+	for _, id := range ids {
+		if err := s.trash.purge(id); err != nil {
+			logger.Error(fmt.Sprintf("failed to purge %v: %v", id, err))
+			return trashErrorResponse(err)
+		}
+	}
+	return successResponse(http.StatusOK, "Purge successfully", map[string]int{"purged": len(ids)})
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"testing"
+)
+
+func TestTrashRestoreConflicts(t *testing.T) {
+	tests := []struct {
+		name string
+		// uploaded after the delete, path to content
+		files map[string]string
+		// the dir of the item is deleted as well
+		parentGone bool
+		id         string
+		path       string
+		status     int
+		restored   string
+		// content of the files afterwards
+		want    map[string]string
+		trashed int
+	}{
+		{name: "original path", status: http.StatusOK, restored: "d/f.txt", want: map[string]string{"d/f.txt": "f"}},
+		{
+			name: "original path taken", files: map[string]string{"d/f.txt": "new"}, status: http.StatusConflict,
+			want: map[string]string{"d/f.txt": "new"}, trashed: 1,
+		},
+		{name: "other path", path: "n/m/f.txt", status: http.StatusOK, restored: "n/m/f.txt", want: map[string]string{"n/m/f.txt": "f"}},
+		{name: "other path taken", path: "x.txt", status: http.StatusConflict, want: map[string]string{"x.txt": "x"}, trashed: 1},
+		{name: "onto a dir", path: "d", status: http.StatusConflict, trashed: 1},
+		{name: "onto work dir", path: "/", status: http.StatusConflict, trashed: 1},
+		{
+			name: "parent deleted", parentGone: true, status: http.StatusOK, restored: "d/f.txt",
+			want: map[string]string{"d/f.txt": "f"}, trashed: 1,
+		},
+		{name: "outside", path: "../f.txt", status: http.StatusForbidden, trashed: 1},
+		{name: "unknown id", id: "missing", status: http.StatusNotFound, trashed: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachStorage(t, ServerConfig{}, func(t *testing.T, ts *testServer) {
+				ts.upload("d", map[string]string{"f.txt": "f"}, "", http.StatusOK)
+				ts.upload("", map[string]string{"x.txt": "x"}, "", http.StatusOK)
+				ts.call("DELETE", "/delete?path=d/f.txt", http.StatusOK, nil)
+				var items []TrashItem
+				ts.call("GET", "/trash", http.StatusOK, &items)
+				item := items[0]
+				if tt.parentGone {
+					ts.call("DELETE", "/delete?path=d", http.StatusOK, nil)
+				}
+				for p, content := range tt.files {
+					ts.upload(path.Dir(p), map[string]string{path.Base(p): content}, "naming=overwrite", http.StatusOK)
+				}
+
+				id := item.ID
+				if tt.id != "" {
+					id = tt.id
+				}
+				var restored TrashItem
+				target := "/trash/restore?id=" + url.QueryEscape(id) + "&path=" + url.QueryEscape(tt.path)
+				ts.call("POST", target, tt.status, &restored)
+				if restored.Path != tt.restored {
+					t.Errorf("restored to %q; want %q", restored.Path, tt.restored)
+				}
+				for p, want := range tt.want {
+					if got := ts.content(p); got != want {
+						t.Errorf("%s = %q; want %q", p, got, want)
+					}
+				}
+				ts.call("GET", "/trash", http.StatusOK, &items)
+				if len(items) != tt.trashed {
+					t.Errorf("%d items in the trash; want %d", len(items), tt.trashed)
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,564 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	resp "httpserver/internal/response"
+	logger "httpserver/pkg/log"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// tus 1.0 core protocol with the creation, termination and expiration extensions
+// https://tus.io/protocols/resumable-upload
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination,expiration"
+	tusStateDir   = "tus"
+)
+
+var errTusUploadNotFound = errors.New("upload not found")
+
+// tusUpload is the persisted state of a resumable upload.
+// The received bytes live in <id>.bin next to <id>.json, so the current
+// offset is the size of the .bin file and survives a server restart.
+type tusUpload struct {
+	ID       string            `json:"id"`
+	Length   int64             `json:"length"`
+	Metadata map[string]string `json:"metadata"`
+	// destination relative to the work dir
+	Dest    string         `json:"dest"`
+	Naming  NamingStrategy `json:"naming"`
+	Expires time.Time      `json:"expires"`
+	Done    bool           `json:"done"`
+}
+
+type tusStore struct {
+	fs         Storage
+	paths      *PathResolver
+	expiration time.Duration
+
+	mu    sync.Mutex
+	locks map[string]*tusLock
+}
+
+// tusLock is dropped from the map once no request holds or waits for it
+type tusLock struct {
+	sync.Mutex
+	refs int
+}
+
+func newTusStore(fs Storage, paths *PathResolver, expiration time.Duration) *tusStore {
+	return &tusStore{
+		fs:         fs,
+		paths:      paths,
+		expiration: expiration,
+		locks:      make(map[string]*tusLock),
+	}
+}
+
+// lock serializes requests for the same upload
+func (t *tusStore) lock(id string) func() {
+	t.mu.Lock()
+	l, ok := t.locks[id]
+	if !ok {
+		l = &tusLock{}
+		t.locks[id] = l
+	}
+	l.refs++
+	t.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		t.mu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(t.locks, id)
+		}
+		t.mu.Unlock()
+	}
+}
+
+func (t *tusStore) files(id string) (info string, data string, err error) {
+	dir, err := t.paths.StateDir(tusStateDir)
+	if err != nil {
+		return "", "", err
+	}
+	return filepath.Join(dir, id+".json"), filepath.Join(dir, id+".bin"), nil
+}
+
+func (t *tusStore) load(id string) (*tusUpload, error) {
+	if !validTusID(id) {
+		return nil, errTusUploadNotFound
+	}
+	infoPath, _, err := t.files(id)
+	if err != nil {
+		return nil, err
+	}
+	b, err := readFile(t.fs, infoPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errTusUploadNotFound
+		}
+		return nil, err
+	}
+	u := &tusUpload{}
+	if err := json.Unmarshal(b, u); err != nil {
+		return nil, err
+	}
+	if !u.Expires.IsZero() && time.Now().After(u.Expires) {
+		t.remove(id)
+		return nil, errTusUploadNotFound
+	}
+	return u, nil
+}
+
+func (t *tusStore) save(u *tusUpload) error {
+	infoPath, _, err := t.files(u.ID)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	return writeFile(t.fs, infoPath, b, 0644)
+}
+
+func (t *tusStore) remove(id string) {
+	infoPath, dataPath, err := t.files(id)
+	if err != nil {
+		return
+	}
+	t.fs.Remove(dataPath)
+	t.fs.Remove(infoPath)
+}
+
+// offset returns the number of bytes received so far
+func (t *tusStore) offset(u *tusUpload) (int64, error) {
+	if u.Done {
+		return u.Length, nil
+	}
+	_, dataPath, err := t.files(u.ID)
+	if err != nil {
+		return 0, err
+	}
+	info, err := t.fs.Stat(dataPath)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// sweep removes expired uploads
+func (t *tusStore) sweep() {
+	dir, err := t.paths.StateDir(tusStateDir)
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to open tus dir: %v", err))
+		return
+	}
+	entries, err := t.fs.ReadDir(dir)
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to read tus dir: %v", err))
+		return
+	}
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok || !validTusID(id) {
+			continue
+		}
+		unlock := t.lock(id)
+		if _, err := t.load(id); err != nil && !errors.Is(err, errTusUploadNotFound) {
+			logger.Warn(fmt.Sprintf("failed to load tus upload %v: %v", id, err))
+		}
+		unlock()
+	}
+}
+
+func newTusID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func validTusID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// parseTusMetadata parses "key base64value,key2 base64value2"
+func parseTusMetadata(header string) (map[string]string, error) {
+	meta := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return meta, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("empty metadata key")
+		}
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid metadata value for %q", key)
+		}
+		meta[key] = string(decoded)
+	}
+	return meta, nil
+}
+
+func (s *Server) tusHeaders(w http.ResponseWriter) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+// tusCheckVersion rejects requests speaking another protocol version
+func (s *Server) tusCheckVersion(w http.ResponseWriter, r *http.Request) resp.Response {
+	s.tusHeaders(w)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		return errorResponse(http.StatusPreconditionFailed, errors.New("unsupported tus version"))
+	}
+	return nil
+}
+
+func (s *Server) tusOptionsHandler(w http.ResponseWriter, r *http.Request) {
+	s.tusHeaders(w)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	if s.MaxUploadSize > 0 {
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(s.MaxUploadSize, 10))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// headers:
+// - Upload-Length: total size of the upload
+// - Upload-Metadata: filename (or name) and optional distPath, base64 encoded
+func (s *Server) tusCreateHandler(w http.ResponseWriter, r *http.Request) resp.Response {
+	if res := s.tusCheckVersion(w, r); res != nil {
+		return res
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		logger.Error(fmt.Sprintf("invalid Upload-Length: %q", r.Header.Get("Upload-Length")))
+		return errorCodeResponse(http.StatusBadRequest, resp.CodeUploadInvalid, errors.New("invalid Upload-Length"))
+	}
+	if s.MaxUploadSize > 0 && length > s.MaxUploadSize {
+		logger.Error(fmt.Sprintf("upload too large: %d", length))
+		return errorCodeResponse(http.StatusRequestEntityTooLarge, resp.CodeUploadTooLarge, errors.New("upload too large"))
+	}
+
+	meta, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		logger.Error(fmt.Sprintf("invalid Upload-Metadata: %v", err))
+		return errorCodeResponse(http.StatusBadRequest, resp.CodeUploadInvalid, err)
+	}
+	name := meta["filename"]
+	if name == "" {
+		name = meta["name"]
+	}
+	distPath, ok := meta["distPath"]
+	if !ok {
+		distPath = r.FormValue("distPath")
+	}
+	naming, ok := meta["naming"]
+	if !ok {
+		naming = r.FormValue("naming")
+	}
+	if naming == "" {
+		naming = s.FileNamingStrategy
+	}
+	strategy, err := ParseNamingStrategy(naming)
+	if err != nil {
+		logger.Error(fmt.Sprintf("invalid naming strategy: %v", err))
+		return errorCodeResponse(http.StatusBadRequest, resp.CodeUploadInvalid, err)
+	}
+
+	distDir, err := s.paths.Resolve(distPath)
+	if err != nil {
+		logger.Error(fmt.Sprintf("invalid distPath: %v", err))
+		return pathErrorResponse(err)
+	}
+	dest, err := s.paths.ResolveName(distDir, name)
+	if err != nil {
+		logger.Error(fmt.Sprintf("invalid file name: %v", err))
+		return pathErrorResponse(err)
+	}
+	if _, err := s.fs.Stat(dest); err == nil && strategy == NamingOriginal {
+		logger.Error("file already exist")
+		return errorCodeResponse(http.StatusConflict, resp.CodeFileExists, ErrFileExists)
+	}
+	if err := s.tusCheckQuota(dest, length); err != nil {
+		logger.Error(fmt.Sprintf("upload rejected: %v", err))
+		return quotaErrorResponse(err)
+	}
+
+	id, err := newTusID()
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to generate upload id: %v", err))
+		return errorResponse(http.StatusInternalServerError, errors.New("failed to create upload"))
+	}
+	u := &tusUpload{
+		ID:       id,
+		Length:   length,
+		Metadata: meta,
+		Dest:     s.paths.Rel(dest),
+		Naming:   strategy,
+	}
+	if s.tus.expiration > 0 {
+		u.Expires = time.Now().Add(s.tus.expiration).UTC()
+	}
+
+	_, dataPath, err := s.tus.files(id)
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to open tus dir: %v", err))
+		return errorResponse(http.StatusInternalServerError, errors.New("failed to create upload"))
+	}
+	f, err := s.fs.OpenFile(dataPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to create upload file: %v", err))
+		return errorResponse(http.StatusInternalServerError, errors.New("failed to create upload"))
+	}
+	f.Close()
+
+	if err := s.tus.save(u); err != nil {
+		s.tus.remove(id)
+		logger.Error(fmt.Sprintf("failed to save upload info: %v", err))
+		return errorResponse(http.StatusInternalServerError, errors.New("failed to create upload"))
+	}
+
+	if length == 0 {
+		if res := s.tusFinish(u); res != nil {
+			return res
+		}
+	}
+
+	w.Header().Set("Location", "/tus/"+id)
+	if !u.Expires.IsZero() {
+		w.Header().Set("Upload-Expires", u.Expires.Format(http.TimeFormat))
+	}
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+func (s *Server) tusHeadHandler(w http.ResponseWriter, r *http.Request) resp.Response {
+	if res := s.tusCheckVersion(w, r); res != nil {
+		return res
+	}
+
+	id, res := tusID(r)
+	if res != nil {
+		return res
+	}
+	defer s.tus.lock(id)()
+
+	u, offset, res := s.tusLoad(id)
+	if res != nil {
+		return res
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	if !u.Expires.IsZero() {
+		w.Header().Set("Upload-Expires", u.Expires.Format(http.TimeFormat))
+	}
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// headers:
+// - Upload-Offset: must match the offset reported by HEAD
+// - Content-Type: application/offset+octet-stream
+func (s *Server) tusPatchHandler(w http.ResponseWriter, r *http.Request) resp.Response {
+	if res := s.tusCheckVersion(w, r); res != nil {
+		return res
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		logger.Error(fmt.Sprintf("invalid content type: %q", r.Header.Get("Content-Type")))
+		return errorResponse(http.StatusUnsupportedMediaType, errors.New("content type must be application/offset+octet-stream"))
+	}
+
+	id, res := tusID(r)
+	if res != nil {
+		return res
+	}
+	defer s.tus.lock(id)()
+
+	u, offset, res := s.tusLoad(id)
+	if res != nil {
+		return res
+	}
+
+	reqOffset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || reqOffset != offset || u.Done {
+		logger.Error(fmt.Sprintf("offset mismatch: got %q, want %d", r.Header.Get("Upload-Offset"), offset))
+		return errorCodeResponse(http.StatusConflict, resp.CodeUploadOffsetMismatch, errors.New("upload offset mismatch"))
+	}
+
+	// the room may have been taken by others since the upload was created
+	if dest, err := s.paths.Resolve(u.Dest); err == nil {
+		if err := s.tusCheckQuota(dest, u.Length); err != nil {
+			logger.Error(fmt.Sprintf("upload rejected: %v", err))
+			return quotaErrorResponse(err)
+		}
+	}
+
+	_, dataPath, err := s.tus.files(id)
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to open tus dir: %v", err))
+		return errorResponse(http.StatusInternalServerError, errors.New("failed to open upload"))
+	}
+	f, err := s.fs.OpenFile(dataPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to open upload file: %v", err))
+		return errorResponse(http.StatusInternalServerError, errors.New("failed to open upload"))
+	}
+
+	// keep whatever arrived before a disconnect, the client resumes from there
+	n, copyErr := io.Copy(f, io.LimitReader(r.Body, u.Length-offset))
+	if err := f.Close(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	offset += n
+	if copyErr != nil {
+		logger.Error(fmt.Sprintf("failed to append upload: %v", copyErr))
+		return errorResponse(http.StatusInternalServerError, errors.New("failed to append upload"))
+	}
+
+	if offset == u.Length {
+		if res := s.tusFinish(u); res != nil {
+			return res
+		}
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	if !u.Expires.IsZero() {
+		w.Header().Set("Upload-Expires", u.Expires.Format(http.TimeFormat))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (s *Server) tusDeleteHandler(w http.ResponseWriter, r *http.Request) resp.Response {
+	if res := s.tusCheckVersion(w, r); res != nil {
+		return res
+	}
+
+	id, res := tusID(r)
+	if res != nil {
+		return res
+	}
+	defer s.tus.lock(id)()
+
+	if _, _, res := s.tusLoad(id); res != nil {
+		return res
+	}
+	s.tus.remove(id)
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// tusID returns the upload id of the request, checked before anything is
+// keyed by it
+func tusID(r *http.Request) (string, resp.Response) {
+	id := mux.Vars(r)["id"]
+	if !validTusID(id) {
+		logger.Error(fmt.Sprintf("invalid upload id: %q", id))
+		return "", errorCodeResponse(http.StatusNotFound, resp.CodeUploadNotFound, errTusUploadNotFound)
+	}
+	return id, nil
+}
+
+func (s *Server) tusLoad(id string) (*tusUpload, int64, resp.Response) {
+	u, err := s.tus.load(id)
+	if err != nil {
+		if errors.Is(err, errTusUploadNotFound) {
+			return nil, 0, errorCodeResponse(http.StatusNotFound, resp.CodeUploadNotFound, err)
+		}
+		logger.Error(fmt.Sprintf("failed to load upload: %v", err))
+		return nil, 0, errorResponse(http.StatusInternalServerError, errors.New("failed to load upload"))
+	}
+	offset, err := s.tus.offset(u)
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to stat upload: %v", err))
+		return nil, 0, errorResponse(http.StatusInternalServerError, errors.New("failed to load upload"))
+	}
+	return u, offset, nil
+}
+
+// tusCheckQuota checks a file of length bytes fits at dest. The received
+// bytes are kept in the state dir, so nothing is reserved until the upload
+// is complete and placed.
+func (s *Server) tusCheckQuota(dest string, length int64) error {
+	return s.quota.check(dest, quotaUsage{Bytes: length, Files: 1})
+}
+
+// tusFinish moves a complete upload to its destination following its naming strategy
+func (s *Server) tusFinish(u *tusUpload) resp.Response {
+	dest, err := s.paths.Resolve(u.Dest)
+	if err != nil {
+		logger.Error(fmt.Sprintf("invalid upload destination: %v", err))
+		return pathErrorResponse(err)
+	}
+	distDir := filepath.Dir(dest)
+	if err := s.fs.MkdirAll(distDir, 0755); err != nil {
+		logger.Error(fmt.Sprintf("failed to make dir: %v", err))
+		return errorResponse(http.StatusInternalServerError, errors.New("failed to make dir"))
+	}
+
+	_, dataPath, err := s.tus.files(u.ID)
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to open tus dir: %v", err))
+		return errorResponse(http.StatusInternalServerError, errors.New("failed to finish upload"))
+	}
+	if err := syncFile(s.fs, dataPath); err != nil {
+		logger.Error(fmt.Sprintf("failed to sync upload: %v", err))
+		return errorResponse(http.StatusInternalServerError, errors.New("failed to finish upload"))
+	}
+	dest, err = s.placeFile(dataPath, distDir, filepath.Base(dest), u.Naming)
+	if err != nil {
+		if errors.Is(err, ErrFileExists) || errors.Is(err, os.ErrExist) {
+			logger.Error("file already exist")
+			return errorCodeResponse(http.StatusConflict, resp.CodeFileExists, ErrFileExists)
+		}
+		if errors.Is(err, ErrQuotaExceeded) {
+			logger.Error(fmt.Sprintf("upload rejected: %v", err))
+			return quotaErrorResponse(err)
+		}
+		logger.Error(fmt.Sprintf("failed to move upload: %v", err))
+		return errorResponse(http.StatusInternalServerError, errors.New("failed to finish upload"))
+	}
+	syncDir(s.fs, distDir)
+	u.Dest = s.paths.Rel(dest)
+
+	// keep the info until it expires so a client asking for the offset sees
+	// the upload as complete
+	u.Done = true
+	if u.Expires.IsZero() {
+		s.tus.remove(u.ID)
+	} else if err := s.tus.save(u); err != nil {
+		logger.Error(fmt.Sprintf("failed to save upload info: %v", err))
+	}
+	logger.Info(fmt.Sprintf("tus upload %v finished: %v", u.ID, u.Dest))
+	return nil
+}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTusLockDropsIdleEntries(t *testing.T) {
+	store := newTusStore(nil, nil, 0)
+	id := "0123456789abcdef0123456789abcdef"
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock := store.lock(id)
+			unlock()
+		}()
+	}
+	wg.Wait()
+	store.lock("ffffffffffffffffffffffffffffffff")()
+
+	if n := len(store.locks); n != 0 {
+		t.Fatalf("%d lock entries left after all requests finished", n)
+	}
+}
+
+type tusStep struct {
+	method string
+	// Upload-Length of a POST, Upload-Offset of a PATCH
+	header string
+	body   string
+	// sends no Tus-Resumable or another Content-Type
+	noVersion, badType bool
+	status             int
+	// Upload-Offset of the response, unchecked when empty
+	offset string
+}
+
+func TestTusUpload(t *testing.T) {
+	tests := []struct {
+		name       string
+		filename   string
+		expiration time.Duration
+		steps      []tusStep
+		// whether f.txt is stored and its content
+		placed bool
+		stored string
+	}{
+		{
+			name: "in chunks", expiration: time.Hour,
+			steps: []tusStep{
+				{method: "POST", header: "6", status: http.StatusCreated},
+				{method: "HEAD", status: http.StatusOK, offset: "0"},
+				{method: "PATCH", header: "0", body: "abc", status: http.StatusNoContent, offset: "3"},
+				{method: "HEAD", status: http.StatusOK, offset: "3"},
+				{method: "PATCH", header: "3", body: "def", status: http.StatusNoContent, offset: "6"},
+				// the info is kept until it expires
+				{method: "HEAD", status: http.StatusOK, offset: "6"},
+			},
+			placed: true, stored: "abcdef",
+		},
+		{
+			name: "offset mismatch",
+			steps: []tusStep{
+				{method: "POST", header: "6", status: http.StatusCreated},
+				{method: "PATCH", header: "0", body: "abc", status: http.StatusNoContent, offset: "3"},
+				{method: "PATCH", header: "0", body: "abc", status: http.StatusConflict},
+				{method: "PATCH", header: "5", body: "f", status: http.StatusConflict},
+				{method: "PATCH", header: "x", body: "f", status: http.StatusConflict},
+				{method: "HEAD", status: http.StatusOK, offset: "3"},
+			},
+		},
+		{
+			name: "past the length",
+			steps: []tusStep{
+				{method: "POST", header: "3", status: http.StatusCreated},
+				{method: "PATCH", header: "0", body: "abcdef", status: http.StatusNoContent, offset: "3"},
+			},
+			placed: true, stored: "abc",
+		},
+		{
+			name: "after done", expiration: time.Hour,
+			steps: []tusStep{
+				{method: "POST", header: "3", status: http.StatusCreated},
+				{method: "PATCH", header: "0", body: "abc", status: http.StatusNoContent, offset: "3"},
+				{method: "PATCH", header: "3", body: "d", status: http.StatusConflict},
+			},
+			placed: true, stored: "abc",
+		},
+		{
+			name: "removed once done without expiration",
+			steps: []tusStep{
+				{method: "POST", header: "3", status: http.StatusCreated},
+				{method: "PATCH", header: "0", body: "abc", status: http.StatusNoContent, offset: "3"},
+				{method: "HEAD", status: http.StatusNotFound},
+			},
+			placed: true, stored: "abc",
+		},
+		{
+			name: "empty", expiration: time.Hour,
+			steps: []tusStep{
+				{method: "POST", header: "0", status: http.StatusCreated},
+				{method: "HEAD", status: http.StatusOK, offset: "0"},
+			},
+			placed: true,
+		},
+		{
+			name: "expired", expiration: time.Millisecond,
+			steps: []tusStep{
+				{method: "POST", header: "6", status: http.StatusCreated},
+				{method: "PATCH", header: "0", body: "abc", status: http.StatusNotFound},
+				{method: "HEAD", status: http.StatusNotFound},
+			},
+		},
+		{
+			name: "deleted",
+			steps: []tusStep{
+				{method: "POST", header: "6", status: http.StatusCreated},
+				{method: "PATCH", header: "0", body: "abc", status: http.StatusNoContent, offset: "3"},
+				{method: "DELETE", status: http.StatusNoContent},
+				{method: "HEAD", status: http.StatusNotFound},
+				{method: "PATCH", header: "3", body: "def", status: http.StatusNotFound},
+			},
+		},
+		{
+			name: "existing file", filename: "old.txt",
+			steps: []tusStep{{method: "POST", header: "3", status: http.StatusConflict}},
+		},
+		{
+			name:  "too large",
+			steps: []tusStep{{method: "POST", header: "2000000", status: http.StatusRequestEntityTooLarge}},
+		},
+		{
+			name:  "invalid length",
+			steps: []tusStep{{method: "POST", header: "-1", status: http.StatusBadRequest}},
+		},
+		{
+			name:  "no version",
+			steps: []tusStep{{method: "POST", header: "3", noVersion: true, status: http.StatusPreconditionFailed}},
+		},
+		{
+			name: "wrong content type",
+			steps: []tusStep{
+				{method: "POST", header: "3", status: http.StatusCreated},
+				{method: "PATCH", header: "0", body: "abc", badType: true, status: http.StatusUnsupportedMediaType},
+				{method: "HEAD", status: http.StatusOK, offset: "0"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachStorage(t, ServerConfig{}, func(t *testing.T, ts *testServer) {
+				ts.upload("", map[string]string{"old.txt": "old"}, "", http.StatusOK)
+				ts.s.tus.expiration = tt.expiration
+				filename := tt.filename
+				if filename == "" {
+					filename = "f.txt"
+				}
+
+				location := "/tus/00000000000000000000000000000000"
+				for i, step := range tt.steps {
+					target := location
+					if step.method == "POST" {
+						target = "/tus"
+					}
+					r := httptest.NewRequest(step.method, target, strings.NewReader(step.body))
+					if !step.noVersion {
+						r.Header.Set("Tus-Resumable", tusVersion)
+					}
+					switch step.method {
+					case "POST":
+						r.Header.Set("Upload-Length", step.header)
+						r.Header.Set("Upload-Metadata", "filename "+base64.StdEncoding.EncodeToString([]byte(filename)))
+					case "PATCH":
+						r.Header.Set("Upload-Offset", step.header)
+						r.Header.Set("Content-Type", "application/offset+octet-stream")
+						if step.badType {
+							r.Header.Set("Content-Type", "application/octet-stream")
+						}
+					}
+					w := httptest.NewRecorder()
+					ts.h.ServeHTTP(w, r)
+
+					if w.Code != step.status {
+						t.Fatalf("step %d: %s %s = %d %q; want %d", i, step.method, target, w.Code, w.Body.String(), step.status)
+					}
+					if got := w.Header().Get("Upload-Offset"); step.offset != "" && got != step.offset {
+						t.Fatalf("step %d: Upload-Offset = %q; want %q", i, got, step.offset)
+					}
+					if loc := w.Header().Get("Location"); loc != "" {
+						location = loc
+					}
+					if tt.expiration == time.Millisecond {
+						time.Sleep(5 * time.Millisecond)
+					}
+				}
+
+				if !tt.placed {
+					if ts.exists("f.txt") {
+						t.Fatalf("f.txt stored with %q", ts.content("f.txt"))
+					}
+				} else if got := ts.content("f.txt"); got != tt.stored {
+					t.Fatalf("f.txt = %q; want %q", got, tt.stored)
+				}
+				if got := ts.content("old.txt"); got != "old" {
+					t.Fatalf("old.txt = %q", got)
+				}
+			})
+		})
+	}
+}
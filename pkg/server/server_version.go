@@ -0,0 +1,435 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	resp "httpserver/internal/response"
+	logger "httpserver/pkg/log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the previous content of an overwritten file is kept in the versions dir
+// inside the state dir, under a dir per file keyed by its path, each one as
+// <id> next to <id>.json. Once the file is replaced, a version counts toward
+// the quota of the file until pruned.
+const versionStateDir = "versions"
+
+var errVersionNotFound = errors.New("version not found")
+
+// FileVersion is a previous content of a file
+type FileVersion struct {
+	ID string `json:"id"`
+	// path relative to workDir
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	// mtime of the replaced content
+	ModTime time.Time `json:"mtime"`
+	SavedAt time.Time `json:"saved_at"`
+}
+
+type versionStore struct {
+	fs    Storage
+	paths *PathResolver
+	// keep the last maxCount versions of a file, zero means no count limit
+	maxCount int
+	// drop versions saved longer than maxAge ago, zero means no age limit
+	maxAge time.Duration
+	quota  *quotaTracker
+
+	mu sync.Mutex
+}
+
+func newVersionStore(fs Storage, paths *PathResolver, maxCount int, maxAge time.Duration, quota *quotaTracker) *versionStore {
+	return &versionStore{
+		fs:       fs,
+		paths:    paths,
+		maxCount: maxCount,
+		maxAge:   maxAge,
+		quota:    quota,
+	}
+}
+
+// enabled reports whether versions are kept at all
+func (v *versionStore) enabled() bool {
+	return v.maxCount > 0 || v.maxAge > 0
+}
+
+// keeps reports whether save keeps a file described by info, its content
+// then still counts toward the quota once replaced
+func (v *versionStore) keeps(info os.FileInfo) bool {
+	return v.enabled() && info.Mode().IsRegular()
+}
+
+// dir returns the versions dir of local, it is only created by save
+func (v *versionStore) dir(local string) (string, error) {
+	root, err := v.paths.StateDir(versionStateDir)
+	if err != nil {
+		return "", err
+	}
+	key := sha256.Sum256([]byte(v.paths.Rel(local)))
+	return filepath.Join(root, hex.EncodeToString(key[:])), nil
+}
+
+// save keeps the current content of local as a version, before it is replaced.
+// Only regular files are versioned, a missing file is not an error.
+func (v *versionStore) save(local string) error {
+	if !v.enabled() {
+		return nil
+	}
+	info, err := v.fs.Lstat(local)
+	if err != nil || !info.Mode().IsRegular() {
+		return nil
+	}
+	id, err := newUUID()
+	if err != nil {
+		return err
+	}
+	version := FileVersion{
+		ID:      id,
+		Path:    v.paths.Rel(local),
+		Size:    info.Size(),
+		ModTime: info.ModTime().UTC(),
+		SavedAt: time.Now().UTC(),
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	dir, err := v.dir(local)
+	if err != nil {
+		return err
+	}
+	if err := v.fs.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	dataPath := filepath.Join(dir, id)
+	// the file is replaced by a rename, so a hard link keeps the old content
+	// without copying it
+	if err := v.fs.Link(local, dataPath); err != nil {
+		if err := copyFile(v.fs, local, dataPath, info); err != nil {
+			return err
+		}
+	}
+	b, err := json.Marshal(version)
+	if err != nil {
+		v.fs.Remove(dataPath)
+		return err
+	}
+	if err := writeFile(v.fs, dataPath+".json", b, 0644); err != nil {
+		v.fs.Remove(dataPath)
+		return err
+	}
+	v.prune(dir)
+	return nil
+}
+
+// load reads the versions in dir, most recent first
+func (v *versionStore) load(dir string) []FileVersion {
+	entries, err := v.fs.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	versions := make([]FileVersion, 0, len(entries)/2)
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		b, err := readFile(v.fs, filepath.Join(dir, e.Name()))
+		if err != nil {
+			continue
+		}
+		version := FileVersion{}
+		if err := json.Unmarshal(b, &version); err != nil {
+			logger.Warn(fmt.Sprintf("invalid version info %v: %v", e.Name(), err))
+			continue
+		}
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].SavedAt.After(versions[j].SavedAt) })
+	return versions
+}
+
+// prune removes the versions in dir beyond the retention, and dir once empty
+func (v *versionStore) prune(dir string) []FileVersion {
+	versions := v.load(dir)
+	kept := versions[:0]
+	for i, version := range versions {
+		tooMany := v.maxCount > 0 && i >= v.maxCount
+		tooOld := v.maxAge > 0 && time.Since(version.SavedAt) > v.maxAge
+		if !tooMany && !tooOld {
+			kept = append(kept, version)
+			continue
+		}
+		dataPath := filepath.Join(dir, version.ID)
+		usage, counted := v.usage(version, dataPath)
+		if err := v.fs.Remove(dataPath); err != nil && !os.IsNotExist(err) {
+			logger.Warn(fmt.Sprintf("failed to remove version %v: %v", version.ID, err))
+			continue
+		}
+		v.fs.Remove(dataPath + ".json")
+		if counted {
+			v.quota.update(v.origin(version), quotaUsage{}.sub(usage))
+		}
+	}
+	if len(kept) == 0 {
+		// fails while something is left, e.g. an info without data
+		v.fs.Remove(dir)
+	}
+	return kept
+}
+
+// origin returns the local path of the versioned file
+func (v *versionStore) origin(version FileVersion) string {
+	root, err := v.paths.Root()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(root, filepath.FromSlash(version.Path))
+}
+
+// usage returns the usage of the content of a version and whether it counts,
+// it doesn't while still linked as the file itself, e.g. when the file
+// failed to be replaced after save
+func (v *versionStore) usage(version FileVersion, dataPath string) (quotaUsage, bool) {
+	info, err := v.fs.Lstat(dataPath)
+	if err != nil {
+		return quotaUsage{}, false
+	}
+	if current, err := v.fs.Lstat(v.origin(version)); err == nil && os.SameFile(info, current) {
+		return quotaUsage{}, false
+	}
+	return quotaUsage{Bytes: info.Size(), Files: 1}, true
+}
+
+// list returns the versions of local, most recent first
+func (v *versionStore) list(local string) ([]FileVersion, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	dir, err := v.dir(local)
+	if err != nil {
+		return nil, err
+	}
+	return v.prune(dir), nil
+}
+
+// count returns the number of versions of local without pruning, for listings
+func (v *versionStore) count(local string) int {
+	dir, err := v.dir(local)
+	if err != nil {
+		return 0
+	}
+	entries, err := v.fs.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+	n := 0
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".json") {
+			n++
+		}
+	}
+	return n
+}
+
+// find returns a version of local and the path of its content
+func (v *versionStore) find(local, id string) (*FileVersion, string, error) {
+	if !validUUID(id) {
+		return nil, "", errVersionNotFound
+	}
+	versions, err := v.list(local)
+	if err != nil {
+		return nil, "", err
+	}
+	dir, err := v.dir(local)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, version := range versions {
+		if version.ID == id {
+			return &version, filepath.Join(dir, id), nil
+		}
+	}
+	return nil, "", errVersionNotFound
+}
+
+// sweep applies the retention to every file
+func (v *versionStore) sweep() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	root, err := v.paths.StateDir(versionStateDir)
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to open versions dir: %v", err))
+		return
+	}
+	entries, err := v.fs.ReadDir(root)
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to read versions dir: %v", err))
+		return
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			v.prune(filepath.Join(root, e.Name()))
+		}
+	}
+}
+
+// stored counts every version at the path of its file
+func (v *versionStore) stored(count func(local string, u quotaUsage)) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	root, err := v.paths.StateDir(versionStateDir)
+	if err != nil {
+		logger.Warn(fmt.Sprintf("quota scan skips the versions: %v", err))
+		return
+	}
+	entries, err := v.fs.ReadDir(root)
+	if err != nil {
+		logger.Warn(fmt.Sprintf("quota scan skips the versions: %v", err))
+		return
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		dir := filepath.Join(root, e.Name())
+		for _, version := range v.load(dir) {
+			if usage, counted := v.usage(version, filepath.Join(dir, version.ID)); counted {
+				count(v.origin(version), usage)
+			}
+		}
+	}
+}
+
+// versionErrorResponse converts an error of the version store to a response
+func versionErrorResponse(err error) resp.Response {
+	if errors.Is(err, errVersionNotFound) {
+		return errorCodeResponse(http.StatusNotFound, resp.CodeVersionNotFound, err)
+	}
+	return errorResponse(http.StatusInternalServerError, errors.New("failed to access versions"))
+}
+
+// lists the previous contents of a file
+// query params:
+// - path: the file
+func (s *Server) versionListHandler(w http.ResponseWriter, r *http.Request) resp.Response {
+	localPath, err := s.paths.Resolve(r.URL.Query().Get("path"))
+	if err != nil {
+		logger.Error(fmt.Sprintf("invalid path: %v", err))
+		return pathErrorResponse(err)
+	}
+	versions, err := s.versions.list(localPath)
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to list versions: %v", err))
+		return versionErrorResponse(err)
+	}
+	return successResponse(http.StatusOK, "List versions successfully", versions)
+}
+
+// downloads a previous content of a file
+// query params:
+// - path: the file
+// - id: the version
+func (s *Server) versionDownloadHandler(w http.ResponseWriter, r *http.Request) resp.Response {
+	q := r.URL.Query()
+	localPath, err := s.paths.Resolve(q.Get("path"))
+	if err != nil {
+		logger.Error(fmt.Sprintf("invalid path: %v", err))
+		return pathErrorResponse(err)
+	}
+	version, dataPath, err := s.versions.find(localPath, q.Get("id"))
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to find version: %v", err))
+		return versionErrorResponse(err)
+	}
+
+	file, err := s.fs.Open(dataPath)
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to open version: %v", err))
+		return versionErrorResponse(errVersionNotFound)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to stat version: %v", err))
+		return errorResponse(http.StatusInternalServerError, errors.New("failed to open version"))
+	}
+
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", filepath.Base(version.Path)))
+	if ct := mime.TypeByExtension(filepath.Ext(version.Path)); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	w.Header().Set("ETag", fileETag(info))
+	http.ServeContent(w, r, filepath.Base(version.Path), version.ModTime, file)
+	return nil
+}
+
+// restores a previous content of a file, the current content becomes a version
+// form params:
+// - path: the file
+// - id: the version
+func (s *Server) versionRestoreHandler(w http.ResponseWriter, r *http.Request) resp.Response {
+	localPath, err := s.paths.Resolve(r.FormValue("path"))
+	if err != nil {
+		logger.Error(fmt.Sprintf("invalid path: %v", err))
+		return pathErrorResponse(err)
+	}
+	if s.paths.IsRoot(localPath) {
+		logger.Error("cannot restore work dir")
+		return errorCodeResponse(http.StatusForbidden, resp.CodeRootForbidden, errors.New("cannot restore work dir"))
+	}
+	if info, err := s.fs.Lstat(localPath); err == nil && !info.Mode().IsRegular() {
+		logger.Error("not a regular file")
+		return errorCodeResponse(http.StatusConflict, resp.CodeFileExists, errors.New("not a regular file"))
+	}
+	_, dataPath, err := s.versions.find(localPath, r.FormValue("id"))
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to find version: %v", err))
+		return versionErrorResponse(err)
+	}
+
+	// staged before the current content is saved, which may prune this version
+	info, err := s.fs.Stat(dataPath)
+	var staged string
+	if err == nil {
+		staged, err = s.copyToStaging(dataPath, info)
+	}
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to stage version: %v", err))
+		return errorResponse(http.StatusInternalServerError, errors.New("failed to restore version"))
+	}
+	if err := s.fs.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		s.fs.Remove(staged)
+		logger.Error(fmt.Sprintf("failed to make dir: %v", err))
+		return errorResponse(http.StatusInternalServerError, errors.New("failed to make dir"))
+	}
+	dest, err := s.placeFile(staged, filepath.Dir(localPath), filepath.Base(localPath), NamingOverwrite)
+	if err != nil {
+		s.fs.Remove(staged)
+		logger.Error(fmt.Sprintf("failed to restore version: %v", err))
+		if errors.Is(err, ErrQuotaExceeded) {
+			return quotaErrorResponse(err)
+		}
+		return errorResponse(http.StatusInternalServerError, errors.New("failed to restore version"))
+	}
+	syncDir(s.fs, filepath.Dir(dest))
+
+	restored, err := s.fs.Lstat(dest)
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to stat restored file: %v", err))
+		return errorResponse(http.StatusInternalServerError, errors.New("failed to restore version"))
+	}
+	return successResponse(http.StatusOK, "Restore successfully", s.fileEntry(dest, restored))
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestVersionLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxCount int
+		maxAge   time.Duration
+		// the age limit set once the versions are saved
+		expire time.Duration
+		// contents of the versions, most recent first
+		want []string
+	}{
+		{name: "disabled", want: []string{}},
+		{name: "count", maxCount: 3, want: []string{"v4", "v3", "v2"}},
+		{name: "count one", maxCount: 1, want: []string{"v4"}},
+		{name: "age", maxAge: time.Hour, want: []string{"v4", "v3", "v2", "v1", "v0"}},
+		{name: "count and age", maxCount: 2, maxAge: time.Hour, want: []string{"v4", "v3"}},
+		{name: "expired", maxAge: time.Hour, expire: time.Millisecond, want: []string{}},
+		{name: "count expired", maxCount: 2, expire: time.Millisecond, want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			count := tt.maxCount
+			config := ServerConfig{VersionMaxCount: &count, VersionMaxAge: int(tt.maxAge / time.Second), QuotaMaxBytes: 1 << 20}
+			forEachStorage(t, config, func(t *testing.T, ts *testServer) {
+				for i := range 6 {
+					ts.upload("", map[string]string{"f.txt": fmt.Sprintf("v%d", i)}, "overwrite=true", http.StatusOK)
+				}
+				if tt.expire > 0 {
+					ts.s.versions.maxAge = tt.expire
+					time.Sleep(2 * tt.expire)
+				}
+
+				var versions []FileVersion
+				ts.call("GET", "/versions?path=f.txt", http.StatusOK, &versions)
+				if len(versions) != len(tt.want) {
+					t.Fatalf("%d versions; want %d", len(versions), len(tt.want))
+				}
+				for i, version := range versions {
+					w := ts.do("GET", "/versions/download?path=f.txt&id="+url.QueryEscape(version.ID), nil, "")
+					if w.Code != http.StatusOK || w.Body.String() != tt.want[i] {
+						t.Errorf("version %d = %d %q; want %q", i, w.Code, w.Body.String(), tt.want[i])
+					}
+				}
+				// pruned versions no longer count
+				if got := ts.usage()[0]; got.UsedFiles != int64(1+len(tt.want)) || got.UsedBytes != int64(2*(1+len(tt.want))) {
+					t.Errorf("usage = %+v; want the file and %d versions", got, len(tt.want))
+				}
+			})
+		})
+	}
+}
+
+func TestVersionRestoreKeepsCount(t *testing.T) {
+	count := 2
+	forEachStorage(t, ServerConfig{VersionMaxCount: &count}, func(t *testing.T, ts *testServer) {
+		for i := range 3 {
+			ts.upload("", map[string]string{"f.txt": fmt.Sprintf("v%d", i)}, "overwrite=true", http.StatusOK)
+		}
+		var versions []FileVersion
+		ts.call("GET", "/versions?path=f.txt", http.StatusOK, &versions)
+
+		// the oldest version is restored though saving the current content prunes it
+		ts.call("POST", "/versions/restore?path=f.txt&id="+url.QueryEscape(versions[1].ID), http.StatusOK, nil)
+		if got := ts.content("f.txt"); got != "v0" {
+			t.Fatalf("f.txt = %q; want v0", got)
+		}
+		ts.call("GET", "/versions?path=f.txt", http.StatusOK, &versions)
+		if len(versions) != count {
+			t.Fatalf("%d versions; want %d", len(versions), count)
+		}
+		w := ts.do("GET", "/versions/download?path=f.txt&id="+url.QueryEscape(versions[0].ID), nil, "")
+		if got := w.Body.String(); got != "v2" {
+			t.Fatalf("latest version = %q; want the replaced v2", got)
+		}
+
+		ts.call("POST", "/versions/restore?path=f.txt&id=00000000-0000-4000-8000-000000000000", http.StatusNotFound, nil)
+	})
+}
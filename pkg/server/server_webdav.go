@@ -0,0 +1,422 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	logger "httpserver/pkg/log"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/net/webdav"
+)
+
+// the work dir is served over WebDAV class 1 and 2 by golang.org/x/net/webdav
+// on top of webdavFS, which goes through the same path confinement, quota,
+// versions and trash as the REST handlers:
+// - PUT is staged and placed with the overwrite strategy, keeping a version
+// - DELETE and the destination replaced by COPY or MOVE go to the trash
+// - locks are kept in memory
+
+var errWebdavTooLarge = errors.New("file too large")
+
+// webdavRequest carries the error of a request that has a better status than
+// the generic one the webdav package answers with, e.g. 507 for the quota
+type webdavRequest struct {
+	method string
+	// the name being copied or moved by COPY and MOVE
+	source string
+	err    error
+}
+
+type webdavRequestKey struct{}
+
+func webdavRequestFrom(ctx context.Context) *webdavRequest {
+	if req, ok := ctx.Value(webdavRequestKey{}).(*webdavRequest); ok {
+		return req
+	}
+	return &webdavRequest{}
+}
+
+// fail records err and returns it
+func (req *webdavRequest) fail(err error) error {
+	if req.err == nil && webdavStatus(err) != 0 {
+		req.err = err
+	}
+	return err
+}
+
+// webdavStatus maps errors of our own checks to a http status, 0 for others
+func webdavStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrQuotaExceeded):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, errWebdavTooLarge):
+		return http.StatusRequestEntityTooLarge
+	}
+	var pathErr *PathError
+	if errors.As(err, &pathErr) {
+		return pathErr.Status()
+	}
+	return 0
+}
+
+// webdavResponseWriter replaces the status of failed requests by the one of
+// the recorded error
+type webdavResponseWriter struct {
+	http.ResponseWriter
+	req      *webdavRequest
+	replaced bool
+}
+
+func (w *webdavResponseWriter) WriteHeader(code int) {
+	if code >= http.StatusBadRequest {
+		if status := webdavStatus(w.req.err); status != 0 {
+			code = status
+			w.replaced = true
+			w.ResponseWriter.WriteHeader(code)
+			w.ResponseWriter.Write([]byte(http.StatusText(code)))
+			return
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *webdavResponseWriter) Write(b []byte) (int, error) {
+	if w.replaced {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// webdavHandler serves the work dir under prefix
+func (s *Server) webdavHandler(prefix string) http.Handler {
+	h := &webdav.Handler{
+		Prefix:     prefix,
+		FileSystem: &webdavFS{s: s},
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				logger.Error(fmt.Sprintf("webdav %v %v: %v", r.Method, r.URL.Path, err))
+			}
+		},
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut && s.MaxUploadSize > 0 && r.ContentLength > s.MaxUploadSize {
+			logger.Error(fmt.Sprintf("webdav PUT %v: %v", r.URL.Path, errWebdavTooLarge))
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		req := &webdavRequest{method: r.Method}
+		if r.Method == "COPY" || r.Method == "MOVE" {
+			req.source = strings.TrimPrefix(r.URL.Path, prefix)
+		}
+		r = r.WithContext(context.WithValue(r.Context(), webdavRequestKey{}, req))
+		h.ServeHTTP(&webdavResponseWriter{ResponseWriter: w, req: req}, r)
+	})
+}
+
+// webdavFS implements webdav.FileSystem over the work dir
+type webdavFS struct {
+	s *Server
+}
+
+func (d *webdavFS) resolve(ctx context.Context, name string) (string, error) {
+	local, err := d.s.paths.Resolve(name)
+	if err != nil {
+		return "", webdavRequestFrom(ctx).fail(err)
+	}
+	return local, nil
+}
+
+func (d *webdavFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	local, err := d.resolve(ctx, name)
+	if err != nil {
+		return err
+	}
+	if d.s.paths.IsRoot(local) {
+		return os.ErrExist
+	}
+	if err := d.s.fs.Mkdir(local, perm); err != nil {
+		return err
+	}
+	syncDir(d.s.fs, filepath.Dir(local))
+	return nil
+}
+
+func (d *webdavFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	local, err := d.resolve(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) == 0 {
+		f, err := d.s.fs.Open(local)
+		if err != nil {
+			return nil, err
+		}
+		return &webdavFile{File: f, s: d.s, local: local}, nil
+	}
+
+	// the webdav package only writes whole files, on PUT and COPY
+	if flag&os.O_TRUNC == 0 || flag&os.O_CREATE == 0 {
+		return nil, os.ErrPermission
+	}
+	if info, err := d.s.fs.Stat(filepath.Dir(local)); err != nil || !info.IsDir() {
+		return nil, os.ErrNotExist
+	}
+	if info, err := d.s.fs.Stat(local); err == nil && info.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	}
+	req := webdavRequestFrom(ctx)
+	res, err := d.s.quota.reserve(local, quotaUsage{Files: 1}, "")
+	if err != nil {
+		return nil, req.fail(err)
+	}
+	tmpFile, err := d.s.createStaging()
+	if err != nil {
+		res.release()
+		return nil, err
+	}
+	u := &webdavUpload{
+		File:  tmpFile,
+		s:     d.s,
+		local: local,
+		req:   req,
+		res:   res,
+		w:     &quotaWriter{w: tmpFile, res: res},
+	}
+	if req.method == http.MethodPut {
+		u.limit = d.s.MaxUploadSize
+	}
+	return u, nil
+}
+
+// RemoveAll moves name to the trash
+func (d *webdavFS) RemoveAll(ctx context.Context, name string) error {
+	local, err := d.resolve(ctx, name)
+	if err != nil {
+		return err
+	}
+	if d.s.paths.IsRoot(local) {
+		return os.ErrPermission
+	}
+	if _, err := d.s.fs.Lstat(local); err != nil {
+		return err
+	}
+	// COPY and MOVE remove the destination they replace first, it must not
+	// hold the source nor be inside it
+	if req := webdavRequestFrom(ctx); req.source != "" {
+		if from, err := d.s.paths.Resolve(req.source); err == nil && (within(local, from) || within(from, local)) {
+			return os.ErrInvalid
+		}
+	}
+	if _, err := d.s.trash.put(local); err != nil {
+		return webdavRequestFrom(ctx).fail(err)
+	}
+	return nil
+}
+
+func (d *webdavFS) Rename(ctx context.Context, oldName, newName string) error {
+	from, err := d.resolve(ctx, oldName)
+	if err != nil {
+		return err
+	}
+	to, err := d.resolve(ctx, newName)
+	if err != nil {
+		return err
+	}
+	if d.s.paths.IsRoot(from) || d.s.paths.IsRoot(to) {
+		return os.ErrPermission
+	}
+	info, err := d.s.fs.Lstat(from)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() && within(from, to) {
+		return os.ErrInvalid
+	}
+
+	// the destination was moved to the trash already when replaced
+	usage := d.s.quota.usage(from)
+	res, err := d.s.quota.reserve(to, usage, from)
+	if err != nil {
+		return webdavRequestFrom(ctx).fail(err)
+	}
+	defer res.release()
+
+	if err := moveFile(d.s.fs, from, to); err != nil {
+		return err
+	}
+	d.s.quota.moved(from, to, usage)
+	return nil
+}
+
+func (d *webdavFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	local, err := d.resolve(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := d.s.fs.Stat(local)
+	if err != nil {
+		return nil, err
+	}
+	return webdavFileInfo{info}, nil
+}
+
+// webdavFileInfo gives the webdav package the same ETag as the REST handlers
+type webdavFileInfo struct {
+	os.FileInfo
+}
+
+func (fi webdavFileInfo) ETag(ctx context.Context) (string, error) {
+	return fileETag(fi.FileInfo), nil
+}
+
+// webdavFile is a file or dir opened for reading
+type webdavFile struct {
+	File
+	s       *Server
+	local   string
+	entries []os.FileInfo
+	read    bool
+}
+
+func (f *webdavFile) Stat() (os.FileInfo, error) {
+	info, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return webdavFileInfo{info}, nil
+}
+
+// Readdir lists the dir without the state dir and symlinks escaping the work dir
+func (f *webdavFile) Readdir(count int) ([]os.FileInfo, error) {
+	if !f.read {
+		f.read = true
+		root, err := f.s.paths.Root()
+		if err != nil {
+			return nil, err
+		}
+		entries, err := f.s.fs.ReadDir(f.local)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			p := filepath.Join(f.local, e.Name())
+			if isStateDir(root, p) {
+				continue
+			}
+			info, err := e.Info()
+			if err != nil {
+				continue
+			}
+			if e.Type()&fs.ModeSymlink != 0 {
+				if _, err := f.s.paths.Resolve(f.s.paths.Rel(p)); err != nil {
+					continue
+				}
+			}
+			f.entries = append(f.entries, webdavFileInfo{info})
+		}
+	}
+
+	if count <= 0 {
+		entries := f.entries
+		f.entries = nil
+		return entries, nil
+	}
+	if len(f.entries) == 0 {
+		return nil, io.EOF
+	}
+	n := min(count, len(f.entries))
+	entries := f.entries[:n]
+	f.entries = f.entries[n:]
+	return entries, nil
+}
+
+// webdavUpload is a file being written, it is staged and placed on Close
+type webdavUpload struct {
+	File
+	s       *Server
+	local   string
+	req     *webdavRequest
+	res     *quotaReservation
+	w       io.Writer
+	limit   int64
+	written int64
+	err     error
+}
+
+func (u *webdavUpload) Write(p []byte) (int, error) {
+	if u.err != nil {
+		return 0, u.err
+	}
+	if u.limit > 0 && u.written+int64(len(p)) > u.limit {
+		u.err = u.req.fail(errWebdavTooLarge)
+		return 0, u.err
+	}
+	n, err := u.w.Write(p)
+	u.written += int64(n)
+	if err != nil {
+		u.err = u.req.fail(err)
+	}
+	return n, err
+}
+
+func (u *webdavUpload) Read(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (u *webdavUpload) Seek(offset int64, whence int) (int64, error) {
+	return 0, os.ErrPermission
+}
+
+func (u *webdavUpload) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, os.ErrInvalid
+}
+
+func (u *webdavUpload) Stat() (os.FileInfo, error) {
+	info, err := u.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return webdavFileInfo{info}, nil
+}
+
+// Close places the content at its path, replacing the current file
+func (u *webdavUpload) Close() error {
+	staged := u.File.Name()
+	defer u.s.fs.Remove(staged)
+
+	err := u.err
+	if err == nil {
+		err = u.File.Sync()
+	}
+	if closeErr := u.File.Close(); err == nil {
+		err = closeErr
+	}
+	// placing the file accounts for the content itself
+	u.res.release()
+	if err != nil {
+		return err
+	}
+	dest, err := u.s.placeFile(staged, filepath.Dir(u.local), filepath.Base(u.local), NamingOverwrite)
+	if err != nil {
+		return u.req.fail(err)
+	}
+	syncDir(u.s.fs, filepath.Dir(dest))
+	return nil
+}
+
+// webdavPrefix cleans the configured prefix, "" when WebDAV is disabled
+func webdavPrefix(prefix string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return ""
+	}
+	return "/" + prefix
+}
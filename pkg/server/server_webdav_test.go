@@ -0,0 +1,44 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWebdavOverlappingDestination(t *testing.T) {
+	tests := []struct {
+		method      string
+		source      string
+		destination string
+	}{
+		{"MOVE", "/dav/a/b/c", "/dav/a"},
+		{"MOVE", "/dav/a", "/dav/a/b"},
+		{"COPY", "/dav/a/b/c", "/dav/a"},
+		{"COPY", "/dav/a", "/dav/a/b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.source+" to "+tt.destination, func(t *testing.T) {
+			forEachStorage(t, ServerConfig{WebDAVPrefix: "/dav"}, func(t *testing.T, ts *testServer) {
+				ts.upload("a/b/c", map[string]string{"f.txt": "f"}, "", http.StatusOK)
+
+				r := httptest.NewRequest(tt.method, tt.source, nil)
+				r.Header.Set("Destination", tt.destination)
+				r.Header.Set("Overwrite", "T")
+				w := httptest.NewRecorder()
+				ts.h.ServeHTTP(w, r)
+				if w.Code < http.StatusBadRequest {
+					t.Fatalf("%s = %d; want an error", tt.method, w.Code)
+				}
+				if got := ts.content("a/b/c/f.txt"); got != "f" {
+					t.Fatalf("source content = %q", got)
+				}
+				var items []TrashItem
+				ts.call("GET", "/trash", http.StatusOK, &items)
+				if len(items) != 0 {
+					t.Fatalf("trash = %+v; want it empty", items)
+				}
+			})
+		})
+	}
+}